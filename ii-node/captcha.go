@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captcha challenge shown on registration page.
+// Question is shown as text (math mode) or as image
+// rendered by /captcha/<Id> (image mode).
+type Challenge struct {
+	Id       string
+	Question string
+	Image    bool
+	answer   string
+	expire   time.Time
+	ip       string
+}
+
+// Self-hosted captcha. Challenges are stored on server side
+// and can be checked only once. If there are too many challenges,
+// the oldest ones are removed.
+// Mode: "image", "math" or "" (disabled).
+// TTL: time to solve challenge.
+// Max: maximum number of active challenges.
+// PerIP: maximum number of active challenges of one ip.
+type Captcha struct {
+	Mode       string
+	TTL        time.Duration
+	Max        int
+	PerIP      int
+	challenges map[string]*Challenge
+	sync       sync.Mutex
+}
+
+func rnd(max int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0
+	}
+	return int(n.Int64())
+}
+
+func NewCaptcha(mode string) (*Captcha, error) {
+	switch mode {
+	case "", "image", "math":
+	default:
+		return nil, errors.New("Wrong captcha mode: " + mode)
+	}
+	return &Captcha{Mode: mode, TTL: 10 * time.Minute, Max: 4096, PerIP: 8,
+		challenges: make(map[string]*Challenge)}, nil
+}
+
+// Returns true if captcha is enabled
+func (c *Captcha) Enabled() bool {
+	return c != nil && c.Mode != ""
+}
+
+// Creates new challenge for ip. Old challenges are expired here,
+// the oldest challenge is removed if limits are reached.
+func (c *Captcha) New(ip string) *Challenge {
+	if !c.Enabled() {
+		return nil
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	ch := &Challenge{Id: base64.RawURLEncoding.EncodeToString(b),
+		expire: time.Now().Add(c.TTL), ip: ip}
+	if c.Mode == "math" {
+		a, b := rnd(10)+1, rnd(10)+1
+		if rnd(2) == 0 {
+			ch.Question = fmt.Sprintf("%d + %d = ?", a, b)
+			ch.answer = fmt.Sprint(a + b)
+		} else {
+			ch.Question = fmt.Sprintf("%d * %d = ?", a, b)
+			ch.answer = fmt.Sprint(a * b)
+		}
+	} else {
+		for i := 0; i < 5; i++ {
+			ch.answer += fmt.Sprint(rnd(10))
+		}
+		ch.Image = true
+	}
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	now := time.Now()
+	var oldest, oldestIp *Challenge
+	nr := 0
+	for k, v := range c.challenges {
+		if now.After(v.expire) {
+			delete(c.challenges, k)
+			continue
+		}
+		if oldest == nil || v.expire.Before(oldest.expire) {
+			oldest = v
+		}
+		if v.ip == ip {
+			nr++
+			if oldestIp == nil || v.expire.Before(oldestIp.expire) {
+				oldestIp = v
+			}
+		}
+	}
+	if c.PerIP > 0 && nr >= c.PerIP {
+		delete(c.challenges, oldestIp.Id)
+	} else if c.Max > 0 && len(c.challenges) >= c.Max {
+		delete(c.challenges, oldest.Id)
+	}
+	c.challenges[ch.Id] = ch
+	return ch
+}
+
+// Checks answer. Challenge is removed after check.
+func (c *Captcha) Check(id string, answer string) bool {
+	if !c.Enabled() {
+		return true
+	}
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	ch, ok := c.challenges[id]
+	if !ok {
+		return false
+	}
+	delete(c.challenges, id)
+	return time.Now().Before(ch.expire) &&
+		strings.TrimSpace(answer) == ch.answer
+}
+
+// 5x7 glyphs of digits
+var digits = [10][7]string{
+	{"01110", "10001", "10011", "10101", "11001", "10001", "01110"},
+	{"00100", "01100", "00100", "00100", "00100", "00100", "01110"},
+	{"01110", "10001", "00001", "00010", "00100", "01000", "11111"},
+	{"11111", "00010", "00100", "00010", "00001", "10001", "01110"},
+	{"00010", "00110", "01010", "10010", "11111", "00010", "00010"},
+	{"11111", "10000", "11110", "00001", "00001", "10001", "01110"},
+	{"00110", "01000", "10000", "11110", "10001", "10001", "01110"},
+	{"11111", "00001", "00010", "00100", "01000", "01000", "01000"},
+	{"01110", "10001", "10001", "01110", "10001", "10001", "01110"},
+	{"01110", "10001", "10001", "01111", "00001", "00010", "01100"},
+}
+
+// Renders challenge image in PNG. Returns nil if there is
+// no such challenge.
+func (c *Captcha) Image(id string) []byte {
+	c.sync.Lock()
+	ch, ok := c.challenges[id]
+	c.sync.Unlock()
+	if !ok || !ch.Image {
+		return nil
+	}
+	const scale = 4
+	w, h := len(ch.answer)*7*scale+2*scale, 11*scale
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	bg := color.RGBA{0xff, 0xff, 0xf9, 0xff}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+	for i := 0; i < w*h/12; i++ { /* noise */
+		v := uint8(rnd(128) + 96)
+		img.Set(rnd(w), rnd(h), color.RGBA{v, v, v, 0xff})
+	}
+	for k, d := range ch.answer {
+		fg := color.RGBA{uint8(rnd(96)), uint8(rnd(96)), uint8(rnd(96)), 0xff}
+		ox := scale + k*7*scale + rnd(scale*2)
+		oy := scale + rnd(scale*3)
+		for y, row := range digits[d-'0'] {
+			for x, p := range row {
+				if p != '1' {
+					continue
+				}
+				for i := 0; i < scale; i++ {
+					for j := 0; j < scale; j++ {
+						img.Set(ox+x*scale+i+(6-y)*rnd(2), oy+y*scale+j, fg)
+					}
+				}
+			}
+		}
+	}
+	for i := 0; i < 3; i++ { /* strike lines */
+		y := rnd(h)
+		dy := rnd(3) - 1
+		lc := color.RGBA{uint8(rnd(128)), uint8(rnd(128)), uint8(rnd(128)), 0xff}
+		for x := 0; x < w; x++ {
+			img.Set(x, y+dy*x/scale, lc)
+		}
+	}
+	b := new(bytes.Buffer)
+	if err := png.Encode(b, img); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+// Rate limits of registrations (and other expensive requests).
+// PerIP: maximum requests from one ip per Period (0 - unlimited).
+// Global: maximum requests per Period (0 - unlimited).
+type RateLimit struct {
+	PerIP  int
+	Global int
+	Period time.Duration
+	hits   map[string][]time.Time
+	all    []time.Time
+	sync   sync.Mutex
+}
+
+func expire_hits(hits []time.Time, since time.Time) []time.Time {
+	for len(hits) > 0 && hits[0].Before(since) {
+		hits = hits[1:]
+	}
+	return hits
+}
+
+// Check if new request from ip is allowed and remember it.
+// Requests over limits are not remembered.
+func (rl *RateLimit) Hit(ip string) error {
+	if rl == nil {
+		return nil
+	}
+	rl.sync.Lock()
+	defer rl.sync.Unlock()
+	now := time.Now()
+	since := now.Add(-rl.Period)
+	rl.all = expire_hits(rl.all, since)
+	if rl.Global > 0 && len(rl.all) >= rl.Global {
+		return errors.New("Too many requests, try later")
+	}
+	if rl.hits == nil {
+		rl.hits = make(map[string][]time.Time)
+	}
+	for k, v := range rl.hits {
+		if v = expire_hits(v, since); len(v) == 0 {
+			delete(rl.hits, k)
+		} else {
+			rl.hits[k] = v
+		}
+	}
+	if rl.PerIP > 0 && len(rl.hits[ip]) >= rl.PerIP {
+		return errors.New("Too many requests from your address, try later")
+	}
+	rl.all = append(rl.all, now)
+	rl.hits[ip] = append(rl.hits[ip], now)
+	return nil
+}
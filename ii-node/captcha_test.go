@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCaptcha(t *testing.T) {
+	c, err := NewCaptcha("math")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := c.New("ip")
+	if ch == nil || ch.Image || ch.Question == "" {
+		t.Fatal("Can not create math challenge")
+	}
+	if c.Check(ch.Id, ch.answer+"1") {
+		t.Error("Wrong answer accepted")
+	}
+	if c.Check(ch.Id, ch.answer) {
+		t.Error("Challenge can be checked twice")
+	}
+	ch = c.New("ip")
+	if !c.Check(ch.Id, " "+ch.answer+" ") {
+		t.Error("Right answer rejected")
+	}
+	ch = c.New("ip")
+	c.challenges[ch.Id].expire = time.Now().Add(-time.Second)
+	if c.Check(ch.Id, ch.answer) {
+		t.Error("Expired challenge accepted")
+	}
+
+	c, _ = NewCaptcha("image")
+	ch = c.New("ip")
+	if ch == nil || !ch.Image || len(ch.answer) != 5 {
+		t.Fatal("Can not create image challenge")
+	}
+	if _, err := png.Decode(bytes.NewReader(c.Image(ch.Id))); err != nil {
+		t.Error("Wrong captcha image", err)
+	}
+	if c.Image("nosuchid") != nil {
+		t.Error("Image for unknown challenge")
+	}
+	if _, err := NewCaptcha("other"); err == nil {
+		t.Error("Wrong mode accepted")
+	}
+	for i := 0; i < c.PerIP; i++ {
+		c.New("flood")
+	}
+	c.Max = c.PerIP + 2
+	for i := 0; i < c.Max; i++ {
+		c.New(fmt.Sprintf("ip%d", i))
+	}
+	nr := 0
+	for _, v := range c.challenges {
+		if v.ip == "flood" {
+			nr++
+		}
+	}
+	if len(c.challenges) != c.Max || nr != 0 || c.New("other") == nil {
+		t.Errorf("Wrong number of challenges: %d (%d from one ip)", len(c.challenges), nr)
+	}
+	for i := 0; i < 2*c.PerIP; i++ {
+		c.New("flood")
+	}
+	if c.challenges[ch.Id] != nil {
+		t.Error("The oldest challenge is not removed")
+	}
+	var off *Captcha
+	if off.New("ip") != nil || !off.Check("", "") {
+		t.Error("Disabled captcha is not transparent")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rl := &RateLimit{PerIP: 2, Global: 3, Period: time.Hour}
+	for i := 0; i < 2; i++ {
+		if err := rl.Hit("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rl.Hit("a") == nil {
+		t.Error("Per ip limit is not applied")
+	}
+	if err := rl.Hit("b"); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Hit("c") == nil {
+		t.Error("Global limit is not applied")
+	}
+	rl.Period = -time.Second /* all hits are expired */
+	if err := rl.Hit("a"); err != nil {
+		t.Error("Hits are not expired", err)
+	}
+
+	rl = &RateLimit{Global: 10, Period: time.Hour}
+	var wait sync.WaitGroup
+	var ok int32
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if rl.Hit("a") == nil {
+				atomic.AddInt32(&ok, 1)
+			}
+		}()
+	}
+	wait.Wait()
+	if ok != 10 {
+		t.Errorf("Limit is exceeded by parallel registrations: %d", ok)
+	}
+}
+
+func TestRemoteIp(t *testing.T) {
+	proxies, err := parse_proxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		remote, fwd, ip string
+	}{
+		{"1.2.3.4:1000", "5.6.7.8", "1.2.3.4"},
+		{"127.0.0.1:1000", "", "127.0.0.1"},
+		{"127.0.0.1:1000", "5.6.7.8", "5.6.7.8"},
+		{"127.0.0.1:1000", "9.9.9.9, 5.6.7.8, 10.0.0.1", "5.6.7.8"},
+		{"[::1]:1000", "5.6.7.8", "::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = v.remote
+		if v.fwd != "" {
+			r.Header.Set("X-Forwarded-For", v.fwd)
+		}
+		if ip := remote_ip(r, proxies); ip.String() != v.ip {
+			t.Errorf("Wrong ip of %s (%s): %s", v.remote, v.fwd, ip)
+		}
+	}
+	if _, err := parse_proxies("wrong"); err == nil {
+		t.Error("Wrong proxy is accepted")
+	}
+}
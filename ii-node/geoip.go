@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/hugeping/ii-go/ii"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Country resolver for registration policy (see policy.txt).
+// Country returns lower case country code of ip or "" if it is unknown.
+type CountryResolver interface {
+	Country(ip net.IP) string
+}
+
+type ipRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+// Offline resolver. Holds sorted ip ranges loaded from CSV file.
+type GeoIP struct {
+	ranges []ipRange
+}
+
+// Loads GeoIP database from CSV file with lines in format:
+// start_ip,end_ip,country
+// IPv4 and IPv6 ranges are supported. Lines started with # are comments.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var g GeoIP
+	r := csv.NewReader(bufio.NewReader(f))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	line := 0
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("Wrong entry in %s on line %d", path, line)
+		}
+		rng := ipRange{start: net.ParseIP(rec[0]).To16(),
+			end:     net.ParseIP(rec[1]).To16(),
+			country: strings.ToLower(strings.TrimSpace(rec[2]))}
+		if rng.start == nil || rng.end == nil ||
+			bytes.Compare(rng.start, rng.end) > 0 {
+			return nil, fmt.Errorf("Wrong range in %s on line %d", path, line)
+		}
+		g.ranges = append(g.ranges, rng)
+	}
+	sort.SliceStable(g.ranges, func(i, j int) bool {
+		return bytes.Compare(g.ranges[i].start, g.ranges[j].start) < 0
+	})
+	return &g, nil
+}
+
+// Lookup ip in ranges using binary search.
+func (g *GeoIP) Country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return ""
+	}
+	if rng := g.ranges[i-1]; bytes.Compare(ip, rng.end) <= 0 {
+		return rng.country
+	}
+	return ""
+}
+
+// Online resolver, uses whois queries (whois.iana.org and referrals).
+type WhoisResolver struct {
+	Timeout time.Duration
+}
+
+func (wr *WhoisResolver) Country(ip net.IP) string {
+	text := wr.Whois(ip.String())
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		a := strings.SplitN(scanner.Text(), ":", 2)
+		if len(a) == 2 && strings.ToLower(a[0]) == "country" {
+			return strings.ToLower(strings.TrimSpace(a[1]))
+		}
+	}
+	return ""
+}
+
+func (wr *WhoisResolver) Whois(domain string) (result string) {
+	var server string
+	result, err := wr.query(domain, "whois.iana.org")
+	if err != nil {
+		return ""
+	}
+	server = getServer(result)
+	if server == "" {
+		return ""
+	}
+	result, err = wr.query(domain, server)
+	if err != nil {
+		return
+	}
+	refServer := getServer(result)
+	if refServer == "" || refServer == server {
+		return
+	}
+	data, err := wr.query(domain, refServer)
+	if err == nil {
+		result += data
+	}
+	return
+}
+
+// getServer returns server from whois data
+func getServer(data string) string {
+	tokens := []string{
+		"Registrar WHOIS Server: ",
+		"whois: ",
+	}
+
+	for _, token := range tokens {
+		start := strings.Index(data, token)
+		if start != -1 {
+			start += len(token)
+			end := strings.Index(data[start:], "\n")
+			if end == -1 {
+				end = len(data) - start
+			}
+			return strings.TrimSpace(data[start : start+end])
+		}
+	}
+
+	return ""
+}
+
+func (wr *WhoisResolver) query(domain, server string) (string, error) {
+	if !strings.Contains(server, ":") {
+		server += ":43"
+	}
+	timeout := wr.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 10
+	}
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return "", fmt.Errorf("whois: connect to whois server failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = conn.Write([]byte(domain + "\r\n"))
+	if err != nil {
+		return "", fmt.Errorf("whois: send to whois server failed: %v", err)
+	}
+	buffer, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("whois: read from whois server failed: %v", err)
+	}
+	return string(buffer), nil
+}
+
+// Chain of resolvers. First known country is returned.
+// Results (including unknown) are cached.
+type ResolverCache struct {
+	Resolvers []CountryResolver
+	Max       int
+	cache     map[string]string
+	sync      sync.Mutex
+}
+
+func (rc *ResolverCache) Country(ip net.IP) string {
+	key := ip.String()
+	rc.sync.Lock()
+	c, ok := rc.cache[key]
+	rc.sync.Unlock()
+	if ok {
+		return c
+	}
+	for _, r := range rc.Resolvers {
+		if c = r.Country(ip); c != "" {
+			break
+		}
+	}
+	rc.sync.Lock()
+	defer rc.sync.Unlock()
+	if rc.cache == nil || (rc.Max > 0 && len(rc.cache) >= rc.Max) {
+		rc.cache = make(map[string]string)
+	}
+	rc.cache[key] = c
+	return c
+}
+
+// Creates country resolver: offline GeoIP database (if path is not "")
+// with optional whois fallback.
+func NewCountryResolver(path string, whois bool) (CountryResolver, error) {
+	rc := &ResolverCache{Max: 65536}
+	if path != "" {
+		g, err := LoadGeoIP(path)
+		if err != nil {
+			return nil, err
+		}
+		ii.Info.Printf("Loaded %d GeoIP ranges from %s", len(g.ranges), path)
+		rc.Resolvers = append(rc.Resolvers, g)
+	}
+	if whois {
+		rc.Resolvers = append(rc.Resolvers, &WhoisResolver{})
+	}
+	return rc, nil
+}
+
+// Parse list of trusted proxies: comma separated addresses or
+// networks (CIDR).
+func parse_proxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trusted_proxy(ip net.IP, proxies []*net.IPNet) bool {
+	for _, n := range proxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parse_ip(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// Get ip of remote host: RemoteAddr or, if request is got from
+// trusted proxy, the last address of X-Forwarded-For header which
+// is not trusted proxy.
+func remote_ip(r *http.Request, proxies []*net.IPNet) net.IP {
+	ip := parse_ip(r.RemoteAddr)
+	if !trusted_proxy(ip, proxies) {
+		return ip
+	}
+	fwd := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		v := parse_ip(fwd[i])
+		if v == nil {
+			break
+		}
+		ip = v
+		if !trusted_proxy(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// Returns country of ip for registration policy.
+// "us" is returned if country is unknown.
+func getHostCountry(cr CountryResolver, ip net.IP) string {
+	if ip == nil || cr == nil {
+		return "us"
+	}
+	if c := cr.Country(ip); c != "" {
+		return c
+	}
+	ii.Trace.Printf("Unknown country: %s", ip)
+	return "us"
+}
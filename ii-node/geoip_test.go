@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+type countResolver struct {
+	count int
+}
+
+func (c *countResolver) Country(ip net.IP) string {
+	c.count++
+	return "zz"
+}
+
+func TestGeoIP(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "geoip.*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# comment
+"10.0.0.0","10.0.0.255","RU"
+1.0.0.0,1.0.0.255,au
+2001:db8::,2001:db8::ffff,DE
+`)
+	f.Close()
+	g, err := LoadGeoIP(f.Name())
+	if err != nil {
+		t.Fatal("Can not load GeoIP", err)
+	}
+	for ip, c := range map[string]string{
+		"10.0.0.1": "ru", "10.0.0.255": "ru", "10.0.1.0": "",
+		"1.0.0.0": "au", "0.255.255.255": "", "2001:db8::1": "de",
+		"2001:db8::1:0": "",
+	} {
+		if v := g.Country(net.ParseIP(ip)); v != c {
+			t.Errorf("%s: %q != %q", ip, v, c)
+		}
+	}
+	cr := &countResolver{}
+	rc := &ResolverCache{Resolvers: []CountryResolver{g, cr}}
+	if rc.Country(net.ParseIP("10.0.0.1")) != "ru" || cr.count != 0 {
+		t.Error("Wrong resolver chain")
+	}
+	rc.Country(net.ParseIP("8.8.8.8"))
+	if rc.Country(net.ParseIP("8.8.8.8")) != "zz" || cr.count != 1 {
+		t.Error("Results are not cached")
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/hugeping/ii-go/ii"
 	"html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func open_db(path string) *ii.DB {
@@ -38,7 +43,55 @@ func PointPolicy(ui *ii.User, db *ii.DB, m *ii.Msg) bool {
 	return true
 }
 
-func PointMsg(edb *ii.EDB, db *ii.DB, udb *ii.UDB, pauth string, tmsg string) string {
+// Put message in premoderation queue (pending database).
+// Message can be approved, edited or rejected on /moderation page.
+func Premoderate(pdb *ii.DB, m *ii.Msg) error {
+	if pdb.Lookup(m.MsgId) != nil {
+		return pdb.Edit(m)
+	}
+	return pdb.Store(m)
+}
+
+// Check message with spam filter (if any). Spam gets spam/<score> tag
+// and must be sent to premoderation queue. Admin is not checked.
+func SpamCheck(www *WWW, u *ii.User, m *ii.Msg) bool {
+	if www.spam == nil || u.Id == 1 {
+		return false
+	}
+	score := www.spam.Score(m)
+	if score < www.spam.Threshold {
+		return false
+	}
+	ii.Info.Printf("Msg %s from %s looks like spam (%d%%)", m.MsgId, u.Name, int(score*100))
+	m.Tags.Add(fmt.Sprintf("spam/%d", int(score*100)))
+	return true
+}
+
+// Check if point u can post message (see EDB.Access). Returns true
+// if message matched by quarantine block rule must be premoderated.
+// Messages matched by blacklist rules are stored blacklisted.
+// Echo policy is checked for matched messages too. Admin is not checked.
+func PostAccess(www *WWW, u *ii.User, m *ii.Msg) (bool, error) {
+	err := www.edb.Access(m, u, www.db)
+	if err == nil || u.Id == 1 {
+		return false, nil
+	}
+	r := ii.MatchedRule(err)
+	if r != nil && r.Action == "quarantine" && www.pdb != nil {
+		ii.Info.Printf("Msg from %s is quarantined: %s", u.Name, r.Reason)
+		m.Tags.Add(r.Tag())
+		return true, nil
+	}
+	if r != nil && r.Action == "blacklist" {
+		ii.Info.Printf("Msg from %s is blacklisted: %s", u.Name, r.Reason)
+		m.Tags.Add("access/blacklist")
+		return false, nil
+	}
+	return false, err
+}
+
+func PointMsg(www *WWW, pauth string, tmsg string) string {
+	db, pdb, udb := www.db, www.pdb, www.udb
 	udb.LoadUsers()
 
 	if !udb.Access(pauth) {
@@ -65,14 +118,33 @@ func PointMsg(edb *ii.EDB, db *ii.DB, udb *ii.UDB, pauth string, tmsg string) st
 	m.From = ui.Name
 	m.Addr = fmt.Sprintf("%s,%d", db.Name, udb.Id(pauth))
 
-	if !PointPolicy(ui, db, m) {
+	premod := !PointPolicy(ui, db, m)
+	if premod && pdb == nil {
 		ii.Error.Printf("Not verified account! Wait for the administrator.")
 		return fmt.Sprintf("Not verified account! Wait for the administrator.")
 	}
 
-	if !edb.Access(m) && ui.Id != 1 {
-		ii.Error.Printf("Access denied")
-		return fmt.Sprintf("Access denied")
+	quarantine, err := PostAccess(www, ui, m)
+	if err != nil {
+		ii.Error.Printf("Access denied: %s", err)
+		return fmt.Sprintf("Access denied: %s", err)
+	}
+	premod = premod || quarantine
+
+	if SpamCheck(www, ui, m) {
+		if pdb == nil {
+			return "Message looks like spam"
+		}
+		premod = true
+	}
+
+	if premod {
+		if err := Premoderate(pdb, m); err != nil {
+			ii.Error.Printf("Premoderate point msg: %s", err)
+			return fmt.Sprintf("%s", err)
+		}
+		ii.Info.Printf("Point msg %s from %s is waiting for moderation", m.MsgId, ui.Name)
+		return "msg ok (premoderation)"
 	}
 
 	if err := db.Store(m); err != nil {
@@ -82,15 +154,115 @@ func PointMsg(edb *ii.EDB, db *ii.DB, udb *ii.UDB, pauth string, tmsg string) st
 	return "msg ok"
 }
 
+// Check if user (node) can push messages to echo.
+// Tag push of user has comma separated list of echoes (* - all).
+func PushAccess(u *ii.User, echo string) bool {
+	v, ok := u.Tags.Get("push")
+	if !ok {
+		return false
+	}
+	for _, e := range strings.Split(v, ",") {
+		if e == "*" || e == echo {
+			return true
+		}
+	}
+	return false
+}
+
+// Receive messages from other node (u/push).
+// nauth: secret of node account, upush: bundle (msgid:base64 lines),
+// echo: if not empty, only messages of this echo are accepted.
+// Messages are checked like fetched ones: echolist, block rules
+// and spam filter. Returns result line for every message.
+func PushMsgs(www *WWW, nauth string, upush string, echo string) string {
+	www.udb.LoadUsers()
+	if !www.udb.Access(nauth) {
+		ii.Info.Printf("Push: access denied for nauth: %s", nauth)
+		return "error: auth\n"
+	}
+	u := www.udb.UserInfo(nauth)
+	if u == nil {
+		return "error: auth\n"
+	}
+	var res string
+	for _, b := range strings.Split(upush, "\n") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		m, err := ii.DecodeBundle(b)
+		if err == nil && !strings.Contains(b, ":") {
+			err = errors.New("no msgid")
+		}
+		if err != nil {
+			res += fmt.Sprintf("error: wrong bundle: %s\n", err)
+			continue
+		}
+		switch {
+		case (echo != "" && m.Echo != echo) || ii.IsPrivate(m.Echo) ||
+			!PushAccess(u, m.Echo):
+			err = errors.New("access denied: " + m.Echo)
+		case strings.HasPrefix(m.Addr, www.db.Name+","):
+			err = errors.New("local address: " + m.Addr)
+		case www.db.Exists(m.MsgId) != nil:
+			err = errors.New("duplicate")
+		default:
+			err = www.edb.Access(m, nil, nil)
+			if r := ii.MatchedRule(err); r != nil {
+				err = ii.ApplyRule(m, www.pdb, r)
+			}
+			if err == nil && www.spam != nil && www.pdb != nil {
+				err = www.spam.Filter(www.pdb)(m)
+			}
+			if err == nil {
+				err = www.db.Store(m)
+			}
+		}
+		if err == ii.ErrQuarantined {
+			res += fmt.Sprintf("message saved: quarantined: %s\n", m.MsgId)
+		} else if err != nil {
+			res += fmt.Sprintf("error: %s: %s\n", m.MsgId, err)
+		} else {
+			res += fmt.Sprintf("message saved: ok: %s\n", m.MsgId)
+		}
+	}
+	ii.Info.Printf("Push from %s: %d bytes", u.Name, len(upush))
+	return res
+}
+
 var users_opt *string = flag.String("u", "points.txt", "Users database")
 var policy_opt *string = flag.String("p", "policy.txt", "Users policy")
-var blackwords_opt *string = flag.String("b", "blackwords.txt", "Blackwords file")
+var blackwords_opt *string = flag.String("b", "blackwords.txt", "Blackwords file (block words rules)")
+var dryrun_opt *bool = flag.Bool("rules-dry-run", false, "Only log messages matched by block words rules")
 var db_opt *string = flag.String("db", "./db", "II database path (directory)")
 var listen_opt *string = flag.String("L", ":8080", "Listen address")
 var sysname_opt *string = flag.String("sys", "ii-go", "Node name")
 var host_opt *string = flag.String("host", "http://127.0.0.1:8080", "Node address")
 var verbose_opt *bool = flag.Bool("v", false, "Verbose")
 var echo_opt *string = flag.String("e", "list.txt", "Echoes list")
+var geoip_opt *string = flag.String("geoip", "", "GeoIP database (CSV ip ranges)")
+var whois_opt *bool = flag.Bool("whois", false, "Use whois to get country if GeoIP fails")
+var kill_opt *string = flag.String("kill", "killfile.txt", "Users killfiles")
+var read_opt *string = flag.String("read", "read.txt", "Users subscriptions and read positions")
+var bookmarks_opt *string = flag.String("bookmarks", "bookmarks.txt", "Users bookmarks and saved searches")
+var notify_opt *string = flag.String("notify", "notify.txt", "Users notifications")
+var smtp_opt *string = flag.String("smtp", "", "Mail server (host:port) for notifications")
+var smtp_from_opt *string = flag.String("smtp-from", "ii-go@localhost", "Sender of notification e-mails")
+var pending_opt *string = flag.String("pending", "pending", "Premoderation queue database")
+var echo_policy_opt *string = flag.String("echo-policy", "echopolicy.txt", "Posting policies of echoes")
+var peers_opt *string = flag.String("peers", "peers.txt", "Peers to sync with")
+var counts_opt *string = flag.String("peers-counts", "peers-counts.txt", "Echo counts of peers (skip unchanged echoes)")
+var expire_opt *int = flag.Int("expire", 0, "Expire messages by retention policies every N hours (0 - never)")
+var msgsize_opt *int = flag.Int("msgsize", 65536, "Max size of message (encoded)")
+var reload_opt *int = flag.Int("reload", 5, "Check configuration files for changes every N seconds (0 - only on SIGHUP)")
+var spam_opt *string = flag.String("spam", "spam.txt", "Spam filter model (ii-tool spam train)")
+var spam_score_opt *float64 = flag.Float64("spam-score", ii.SPAM_THRESHOLD, "Min spam score (0..1) to premoderate message")
+var audit_opt *string = flag.String("audit", "audit.log", "Audit log of moderation actions")
+var captcha_opt *string = flag.String("captcha", "", "Registration captcha: image or math")
+var reglim_opt *int = flag.Int("reglim", 0, "Max registrations per hour (0 - unlimited)")
+var reglim_ip_opt *int = flag.Int("reglim-ip", 0, "Max registrations per hour from one ip (0 - unlimited)")
+var searchlim_opt *int = flag.Int("searchlim", 30, "Max searches per minute from one ip for anonymous users (0 - unlimited)")
+var proxies_opt *string = flag.String("trusted-proxy", "", "Trusted reverse proxies (comma separated ips or networks), X-Forwarded-For is used only from them")
 
 type WWW struct {
 	Host string
@@ -98,6 +270,21 @@ type WWW struct {
 	db   *ii.DB
 	edb  *ii.EDB
 	udb  *ii.UDB
+	kdb  *ii.KDB
+	rdb  *ii.RDB
+	bdb  *ii.BDB
+	ndb  *ii.NDB
+	pdb  *ii.DB
+	adb  *ii.ADB
+	spam *ii.SpamFilter
+	sync *Syncer
+	nfy  *ii.Notifier
+	geo  CountryResolver
+	cap  *Captcha
+	rlim *RateLimit
+	slim *RateLimit
+	prx  []*net.IPNet
+	pms  pmCache
 }
 
 func get_ue(echoes []string, db *ii.DB, user ii.User, w http.ResponseWriter, r *http.Request) {
@@ -124,48 +311,86 @@ func get_ue(echoes []string, db *ii.DB, user ii.User, w http.ResponseWriter, r *
 	}
 
 }
-func main() {
-	var www WWW
-	ii.OpenLog(ioutil.Discard, os.Stdout, os.Stderr)
-
-	flag.Parse()
 
-	db := open_db(*db_opt)
-	edb := ii.LoadEcholist(*echo_opt)
-	edb.LoadBlockwords(*blackwords_opt)
-	udb := ii.OpenUsers(*users_opt, *policy_opt)
-	if *verbose_opt {
-		ii.OpenLog(os.Stdout, os.Stdout, os.Stderr)
+// Reload echolist, blackwords, echo policy, points and policy if files are changed
+// (or always if force is true). Bad files are reported and previous
+// configuration is kept.
+func ReloadConfig(www *WWW, force bool) {
+	if err := www.edb.Reload(force); err != nil {
+		ii.Error.Printf("Can not reload echolist: %s", err)
 	}
+	var err error
+	if force {
+		err = www.udb.Reload()
+	} else {
+		err = www.udb.LoadUsers()
+	}
+	if err != nil {
+		ii.Error.Printf("Can not reload points: %s", err)
+	}
+}
 
-	db.Name = *sysname_opt
-	www.db = db
-	www.edb = edb
-	www.udb = udb
-	www.Host = *host_opt
-	WebInit(&www)
+// Check configuration files for changes every interval
+// (if it is not 0), reload them immediately on SIGHUP.
+func WatchConfig(www *WWW, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-hup:
+			ii.Info.Printf("SIGHUP: reloading configuration")
+			ReloadConfig(www, true)
+		case <-tick:
+			ReloadConfig(www, false)
+		}
+	}
+}
 
-	fs := http.FileServer(http.Dir("lib"))
-	http.Handle("/lib/", http.StripPrefix("/lib/", fs))
+// Expire messages by retention policies of echoes every interval.
+func ExpireTask(www *WWW, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if ids, err := www.db.Expire(www.edb, time.Now().Unix(), false); err != nil {
+			ii.Error.Printf("Can not expire messages: %s", err)
+		} else if len(ids) > 0 {
+			ii.Info.Printf("%d messages expired", len(ids))
+		}
+		<-t.C
+	}
+}
 
-	http.HandleFunc("/list.txt", func(w http.ResponseWriter, r *http.Request) {
+// Registers IDEC and web handlers in mux.
+// All message reads go through ii.DB read access policy (see ii.DB.Access).
+func Handle(www *WWW, mux *http.ServeMux) {
+	db := www.db
+	edb := www.edb
+	udb := www.udb
+	mux.HandleFunc("/list.txt", func(w http.ResponseWriter, r *http.Request) {
 		echoes := db.Echoes(nil, &ii.Query{})
+		info := edb.Snapshot().Info
 		for _, v := range echoes {
 			if !ii.IsPrivate(v.Name) {
-				fmt.Fprintf(w, "%s:%d:%s\n", v.Name, v.Count, www.edb.Info[v.Name])
+				fmt.Fprintf(w, "%s:%d:%s\n", v.Name, v.Count, info[v.Name])
 			}
 		}
 	})
-	http.HandleFunc("/blacklist.txt", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/blacklist.txt", func(w http.ResponseWriter, r *http.Request) {
 		ids := db.SelectIDS(&ii.Query{Blacklisted: true})
 		for _, v := range ids {
 			fmt.Fprintf(w, "%s\n", v)
 		}
 	})
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handleWWW(&www, w, r)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleWWW(www, w, r)
 	})
-	http.HandleFunc("/u/point/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/u/point/", func(w http.ResponseWriter, r *http.Request) {
 		var pauth, tmsg string
 		switch r.Method {
 		case "GET":
@@ -190,11 +415,9 @@ func main() {
 				if args[2] == "m" {
 					ids := args[3:]
 					for _, i := range ids {
-						m, info := db.GetBundleInfo(i)
-						if m == "" || !db.Access(info, user) {
-							continue
+						if m := db.GetBundleAccess(i, user); m != "" {
+							fmt.Fprintf(w, "%s\n", m)
 						}
-						fmt.Fprintf(w, "%s\n", m)
 					}
 					return
 				}
@@ -210,9 +433,9 @@ func main() {
 			return
 		}
 		ii.Info.Printf("/u/point/%s/%s GET request", pauth, tmsg)
-		fmt.Fprintf(w, PointMsg(edb, db, udb, pauth, tmsg))
+		fmt.Fprintf(w, PointMsg(www, pauth, tmsg))
 	})
-	http.HandleFunc("/u/point", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/u/point", func(w http.ResponseWriter, r *http.Request) {
 		var pauth, tmsg string
 		switch r.Method {
 		case "POST":
@@ -226,9 +449,9 @@ func main() {
 			return
 		}
 		ii.Info.Printf("/u/point/%s/%s POST request", pauth, tmsg)
-		fmt.Fprintf(w, PointMsg(edb, db, udb, pauth, tmsg))
+		fmt.Fprintf(w, PointMsg(www, pauth, tmsg))
 	})
-	http.HandleFunc("/x/c/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/x/c/", func(w http.ResponseWriter, r *http.Request) {
 		enames := strings.Split(r.URL.Path[5:], "/")
 		echoes := db.Echoes(enames, &ii.Query{})
 		for _, v := range echoes {
@@ -237,31 +460,30 @@ func main() {
 			}
 		}
 	})
-	http.HandleFunc("/u/m/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/u/m/", func(w http.ResponseWriter, r *http.Request) {
 		ids := strings.Split(r.URL.Path[5:], "/")
 		for _, i := range ids {
-			m, info := db.GetBundleInfo(i)
-			if m != "" && !ii.IsPrivate(info.Echo) {
+			if m := db.GetBundleAccess(i, nil); m != "" {
 				fmt.Fprintf(w, "%s\n", m)
 			}
 		}
 	})
-	http.HandleFunc("/u/e/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/u/e/", func(w http.ResponseWriter, r *http.Request) {
 		echoes := strings.Split(r.URL.Path[5:], "/")
 		get_ue(echoes, db, ii.User{}, w, r)
 	})
-	http.HandleFunc("/m/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/m/", func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Path[3:]
 		if !ii.IsMsgId(id) {
 			return
 		}
-		m := db.Get(id)
+		m := db.GetAccess(id, nil)
 		ii.Info.Printf("/m/%s %s", id, m)
-		if m != nil && !ii.IsPrivate(m.Echo) {
+		if m != nil {
 			fmt.Fprintf(w, "%s", m.String())
 		}
 	})
-	http.HandleFunc("/e/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/e/", func(w http.ResponseWriter, r *http.Request) {
 		e := r.URL.Path[3:]
 		if !ii.IsEcho(e) || ii.IsPrivate(e) {
 			return
@@ -271,9 +493,105 @@ func main() {
 			fmt.Fprintf(w, "%s\n", id)
 		}
 	})
-	http.HandleFunc("/x/features", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "list.txt\nblacklist.txt\nu/e\nx/c\n")
+	mux.HandleFunc("/u/push", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return
+		}
+		fmt.Fprint(w, PushMsgs(www, r.FormValue("nauth"), r.FormValue("upush"),
+			r.FormValue("echoarea")))
 	})
+	mux.HandleFunc("/x/features", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "list.txt\nblacklist.txt\nu/e\nx/c\nu/push\n")
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "User-agent: *\nCrawl-delay: 3\n")
+	})
+}
+
+func main() {
+	var www WWW
+	ii.OpenLog(ioutil.Discard, os.Stdout, os.Stderr)
+
+	flag.Parse()
+
+	db := open_db(*db_opt)
+	edb := ii.LoadEcholist(*echo_opt)
+	edb.LoadBlockwords(*blackwords_opt)
+	edb.DryRun = *dryrun_opt
+	edb.LoadPolicy(*echo_policy_opt)
+	ii.MaxMsgSize = *msgsize_opt
+	udb := ii.OpenUsers(*users_opt, *policy_opt)
+	if *verbose_opt {
+		ii.OpenLog(os.Stdout, os.Stdout, os.Stderr)
+	}
+
+	db.Name = *sysname_opt
+	db.Acl = edb
+	www.db = db
+	www.edb = edb
+	www.udb = udb
+	www.kdb = ii.OpenKillfiles(*kill_opt)
+	www.rdb = ii.OpenReadState(*read_opt)
+	www.bdb = ii.OpenBookmarks(*bookmarks_opt)
+	www.ndb = ii.OpenNotifications(*notify_opt)
+	www.adb = ii.OpenAudit(*audit_opt)
+	www.Host = *host_opt
+	www.nfy = &ii.Notifier{DB: db, UDB: udb, NDB: www.ndb,
+		SMTP: *smtp_opt, MailFrom: *smtp_from_opt, Host: www.Host}
+	db.Stored = www.nfy.Notify
+	if *pending_opt != "" {
+		www.pdb = open_db(*pending_opt)
+	}
+	if *spam_opt != "" {
+		www.spam = ii.OpenSpamFilter(*spam_opt)
+		www.spam.Threshold = *spam_score_opt
+	}
+	geo, err := NewCountryResolver(*geoip_opt, *whois_opt)
+	if err != nil {
+		ii.Error.Printf("Can not load GeoIP: %s", err)
+		os.Exit(1)
+	}
+	www.geo = geo
+	if www.cap, err = NewCaptcha(*captcha_opt); err != nil {
+		ii.Error.Printf("%s", err)
+		os.Exit(1)
+	}
+	www.rlim = &RateLimit{PerIP: *reglim_ip_opt, Global: *reglim_opt,
+		Period: time.Hour}
+	www.slim = &RateLimit{PerIP: *searchlim_opt, Period: time.Minute}
+	if www.prx, err = parse_proxies(*proxies_opt); err != nil {
+		ii.Error.Printf("Wrong trusted proxies: %s", err)
+		os.Exit(1)
+	}
+	WebInit(&www)
+
+	fs := http.FileServer(http.Dir("lib"))
+	http.Handle("/lib/", http.StripPrefix("/lib/", fs))
+
+	Handle(&www, http.DefaultServeMux)
+	go WatchConfig(&www, time.Duration(*reload_opt)*time.Second)
+	if *expire_opt > 0 {
+		go ExpireTask(&www, time.Duration(*expire_opt)*time.Hour)
+	}
+	if *peers_opt != "" {
+		peers, err := ii.LoadPeers(*peers_opt)
+		if err != nil {
+			ii.Error.Printf("Can not load peers: %s", err)
+		}
+		if len(peers) > 0 {
+			var counts *ii.CDB
+			if *counts_opt != "" {
+				counts = ii.OpenCounts(*counts_opt)
+			}
+			www.sync = NewSyncer(&www, peers, counts)
+			www.sync.Start()
+		}
+	}
 	ii.Info.Printf("Listening on %s", *listen_opt)
 
 	//	http.HandleFunc("hugeping.ru/", func(w http.ResponseWriter, r *http.Request) {
@@ -281,9 +599,6 @@ func main() {
 	//	})
 
 	// http.Handle("hugeping.ru/", http.FileServer(http.Dir("/home/peter/Devel/server/gemini/www")))
-	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "User-agent: *\nCrawl-delay: 3\n")
-	})
 
 	if err := http.ListenAndServe(*listen_opt, nil); err != nil {
 		ii.Error.Printf("Error running web server: %s", err)
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/hugeping/ii-go/ii"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test node with users:
+// 1 admin, 2 alice, 3 bob, 4 carol.
+// Echoes: std.test (public), std.closed (readable only by alice),
+// .private (private area).
+type testNode struct {
+	dir string
+	www *WWW
+	mux *http.ServeMux
+	ids map[string]string // secret marker -> msgid
+}
+
+func testMsg(db *ii.DB, t *testing.T, echo string, from string, addr string,
+	to string, text string) string {
+	m := &ii.Msg{
+		Tags: ii.NewTags("ii/ok"),
+		Echo: echo,
+		From: from,
+		Addr: addr,
+		To:   to,
+		Subj: "subj " + text,
+		Text: text,
+	}
+	m.Encode()
+	if err := db.Store(m); err != nil {
+		t.Fatal("Can not store msg", err)
+	}
+	return m.MsgId
+}
+
+func newTestNode(t *testing.T) *testNode {
+	ii.OpenLog(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	dir, err := ioutil.TempDir(os.TempDir(), "ii-node.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	list := "std.test:0:Public\nstd.closed?test,2:0:Closed\n.private:0:Private\n" +
+		"std.blog!test,3:0:Blog of bob\n"
+	if err := ioutil.WriteFile(dir+"/list.txt", []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var www WWW
+	db := ii.OpenDB(dir + "/db")
+	db.Name = "test"
+	www.edb = ii.LoadEcholist(dir + "/list.txt")
+	www.edb.LoadPolicy(dir + "/echopolicy.txt")
+	db.Acl = www.edb
+	www.db = db
+	www.udb = ii.OpenUsers(dir+"/points.txt", "")
+	www.kdb = ii.OpenKillfiles(dir + "/killfile.txt")
+	www.rdb = ii.OpenReadState(dir + "/read.txt")
+	www.bdb = ii.OpenBookmarks(dir + "/bookmarks.txt")
+	www.ndb = ii.OpenNotifications(dir + "/notify.txt")
+	www.nfy = &ii.Notifier{DB: db, UDB: www.udb, NDB: www.ndb}
+	db.Stored = www.nfy.Notify
+	www.pdb = ii.OpenDB(dir + "/pending")
+	www.adb = ii.OpenAudit(dir + "/audit.log")
+	for _, u := range []string{"admin", "alice", "bob", "carol"} {
+		if err := www.udb.Add(u, u+"@example.com", u, "status/verified"); err != nil {
+			t.Fatal("Can not add user", err)
+		}
+		www.udb.LoadUsers()
+	}
+	www.Host = "http://127.0.0.1:8080"
+	WebInit(&www)
+
+	n := &testNode{dir: dir, www: &www, mux: http.NewServeMux(),
+		ids: make(map[string]string)}
+	Handle(&www, n.mux)
+
+	attach := base64.StdEncoding.EncodeToString([]byte("PRIVATEATTACH"))
+	n.ids["PUBLICTEXT"] = testMsg(db, t, "std.test", "alice", "test,2", "All",
+		"PUBLICTEXT")
+	n.ids["PRIVATETEXT"] = testMsg(db, t, ".private", "alice", "test,2", "bob",
+		"PRIVATETEXT\n@base64: file.txt\n"+attach)
+	n.ids["CLOSEDTEXT"] = testMsg(db, t, "std.closed", "alice", "test,2", "All",
+		"CLOSEDTEXT")
+	n.ids["BLACKTEXT"] = testMsg(db, t, "std.test", "bob", "test,3", "All",
+		"BLACKTEXT")
+	if err := db.Blacklist(db.Get(n.ids["BLACKTEXT"])); err != nil {
+		t.Fatal("Can not blacklist", err)
+	}
+	return n
+}
+
+func (n *testNode) get(path string, user string, cookies ...*http.Cookie) string {
+	return n.do(path, user, cookies...).Body.String()
+}
+
+func (n *testNode) do(path string, user string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if user != "" {
+		req.AddCookie(&http.Cookie{Name: "pauth", Value: n.www.udb.Secret(user)})
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	n.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func (n *testNode) post(path string, user string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		req.AddCookie(&http.Cookie{Name: "pauth", Value: n.www.udb.Secret(user)})
+	}
+	rec := httptest.NewRecorder()
+	n.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// All read endpoints of node.
+func (n *testNode) paths(user string) []string {
+	pauth := n.www.udb.Secret(user)
+	if pauth == "" {
+		pauth = "nosuchsecret"
+	}
+	var ids []string
+	for _, id := range n.ids {
+		ids = append(ids, id)
+	}
+	all := strings.Join(ids, "/")
+	paths := []string{
+		"/list.txt",
+		"/x/c/std.test/std.closed/.private",
+		"/u/m/" + all,
+		"/u/e/std.test/std.closed/.private",
+		"/e/std.test", "/e/std.closed", "/e/.private",
+		"/u/point/" + pauth + "/u/e/std.test/std.closed/.private",
+		"/u/point/" + pauth + "/u/m/" + all,
+		"/",
+		"/forum/",
+		"/std.test", "/std.closed", "/.private",
+		"/echo/all", "/echo/all/rss",
+		"/echo/std.closed", "/echo/std.closed/rss",
+		"/echo/.private", "/echo+topics/std.closed",
+		"/from/alice", "/from/alice/rss", "/to/bob", "/to/bob/rss",
+		"/user/alice", "/user/bob",
+		"/search/TEXT", "/search/subj", "/search/from:alice", "/search/echo:std.closed",
+		"/search/echo:.private", "/search/TEXT/rss?token=wrong",
+		"/bookmarks", "/bookmarks/export",
+		"/inbox", "/outbox", "/notifications", "/moderation",
+		"/audit", "/audit?who=admin", "/echoes", "/peers",
+	}
+	for _, id := range ids {
+		paths = append(paths, "/m/"+id, "/"+id, "/"+id+"/base64",
+			"/"+id+"/reply", "/"+id+"/edit", "/echo/"+id,
+			"/forum/"+id, "/blog/"+id)
+	}
+	return paths
+}
+
+// Check that only allowed messages are readable by user.
+// Message is leaked if its text, bundle or id (not requested
+// by path itself) are found in response.
+func (n *testNode) check(t *testing.T, user string, allowed map[string]bool) {
+	for _, path := range n.paths(user) {
+		body := n.get(path, user)
+		for marker, id := range n.ids {
+			if allowed[marker] {
+				continue
+			}
+			if strings.Contains(body, marker) || strings.Contains(body, id+":") ||
+				(strings.Contains(body, id) && !strings.Contains(path, id)) {
+				t.Errorf("%s: %s leaked to %q", path, marker, user)
+			}
+		}
+		if strings.Contains(body, "PRIVATEATTACH") && !allowed["PRIVATETEXT"] {
+			t.Errorf("%s: private attachment leaked to %q", path, user)
+		}
+	}
+}
+
+func TestReadAccess(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+
+	n.check(t, "", map[string]bool{"PUBLICTEXT": true})
+	n.check(t, "carol", map[string]bool{"PUBLICTEXT": true})
+	n.check(t, "bob", map[string]bool{"PUBLICTEXT": true, "PRIVATETEXT": true})
+	n.check(t, "alice", map[string]bool{"PUBLICTEXT": true, "PRIVATETEXT": true,
+		"CLOSEDTEXT": true})
+
+	// allowed readers really get messages
+	for _, v := range []struct {
+		path   string
+		user   string
+		marker string
+	}{
+		{"/" + n.ids["PRIVATETEXT"], "bob", "PRIVATETEXT"},
+		{"/" + n.ids["PRIVATETEXT"] + "/base64", "bob", "PRIVATEATTACH"},
+		{"/" + n.ids["CLOSEDTEXT"], "alice", "CLOSEDTEXT"},
+		{"/m/" + n.ids["PUBLICTEXT"], "", "PUBLICTEXT"},
+		{"/u/m/" + n.ids["PUBLICTEXT"], "", n.ids["PUBLICTEXT"]},
+		{fmt.Sprintf("/u/point/%s/u/m/%s", n.www.udb.Secret("bob"),
+			n.ids["PRIVATETEXT"]), "", n.ids["PRIVATETEXT"]},
+	} {
+		if !strings.Contains(n.get(v.path, v.user), v.marker) {
+			t.Errorf("%s: %s is not readable by %q", v.path, v.marker, v.user)
+		}
+	}
+}
+
+func TestUserProfile(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+
+	body := n.get("/user/alice", "carol")
+	if !strings.Contains(body, "subj PUBLICTEXT") {
+		t.Error("Public topic is not shown in profile")
+	}
+	if strings.Contains(body, "std.closed") {
+		t.Error("Closed echo is shown in profile")
+	}
+	if !strings.Contains(n.get("/user/alice", "alice"), "std.closed") {
+		t.Error("Closed echo is not shown to owner")
+	}
+	if err := n.www.udb.SetTag("alice", "public", "none"); err != nil {
+		t.Fatal(err)
+	}
+	n.www.udb.LoadUsers()
+	if body := n.get("/user/alice", "carol"); strings.Contains(body, "PUBLICTEXT") ||
+		strings.Contains(body, "Posts:") {
+		t.Error("Hidden fields are shown in profile")
+	}
+	if !strings.Contains(n.get("/user/alice", "admin"), "PUBLICTEXT") {
+		t.Error("Hidden fields are not shown to admin")
+	}
+	if !strings.Contains(n.get("/user/nosuchuser", ""), "No such user") {
+		t.Error("Profile of unknown user")
+	}
+}
+
+func TestKillfile(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	bob := n.www.udb.UserInfoName("bob")
+	if err := n.www.kdb.Add(bob.Id, "from", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	show := &http.Cookie{Name: "killfile", Value: "show"}
+	token := "?token=" + ii.FeedToken(bob)
+	for _, path := range []string{"/", "/forum/", "/echo/all", "/std.test",
+		"/forum/std.test", "/from/alice", "/echo/all/rss" + token} {
+		if body := n.get(path, "bob"); strings.Contains(body, "PUBLICTEXT") {
+			t.Errorf("%s: killed message is shown", path)
+		}
+		if body := n.get(path, "carol"); !strings.Contains(body, "PUBLICTEXT") {
+			t.Errorf("%s: message is hidden by killfile of other user", path)
+		}
+		if body := n.get(path, "bob", show); !strings.Contains(body, "PUBLICTEXT") {
+			t.Errorf("%s: killed message is not shown with show hidden", path)
+		}
+	}
+	// PUBLICTEXT and PRIVATETEXT, CLOSEDTEXT is not readable by bob
+	if body := n.get("/echo/all", "bob"); !strings.Contains(body,
+		"<span class=\"info\">2 <a href=\"/killfile/show\">hidden</a>") {
+		t.Error("Hidden messages are not counted")
+	}
+	// requested message is shown
+	if !strings.Contains(n.get("/"+n.ids["PUBLICTEXT"], "bob"), "PUBLICTEXT") {
+		t.Error("Requested killed message is not shown")
+	}
+	if err := n.www.kdb.Add(bob.Id, "subj", "PUBLIC"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.www.kdb.Del(bob.Id, "from", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(n.get("/echo/all", "bob"), "PUBLICTEXT") {
+		t.Error("Message is not killed by subject")
+	}
+	// rss token gives access to private messages of user
+	if !strings.Contains(n.get("/to/bob/rss"+token, ""), "PRIVATETEXT") {
+		t.Error("RSS token does not work")
+	}
+	if strings.Contains(n.get("/to/bob/rss?token=wrong", ""), "PRIVATETEXT") ||
+		strings.Contains(n.get("/to/bob"+token, ""), "PRIVATETEXT") {
+		t.Error("RSS token leaks private messages")
+	}
+}
+
+func TestReader(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	pub := n.ids["PUBLICTEXT"]
+	priv := n.ids["PRIVATETEXT"]
+
+	body := n.get("/", "bob")
+	if !strings.Contains(body, "/unread/std.test\">+1") ||
+		!strings.Contains(body, "/unread/.private\">+1") {
+		t.Error("No unread counts on index")
+	}
+	n.do("/subscribe/std.test", "bob")
+	body = n.get("/", "bob")
+	if !strings.Contains(body, "PUBLICTEXT") || strings.Contains(body, "PRIVATETEXT") {
+		t.Error("Index does not show subscribed echoes only")
+	}
+	if !strings.Contains(n.get("/?all=1", "bob"), "PRIVATETEXT") {
+		t.Error("All echoes are not shown")
+	}
+	if loc := n.do("/unread", "bob").Header().Get("Location"); loc != "/"+pub+"#"+pub {
+		t.Errorf("Wrong next unread: %s", loc)
+	}
+	if loc := n.do("/unread", "bob").Header().Get("Location"); loc != "/" {
+		t.Errorf("Wrong next unread when all read: %s", loc)
+	}
+	if strings.Contains(n.get("/?all=1", "bob"), "/unread/std.test\">+") {
+		t.Error("Read echo has unread messages")
+	}
+	if loc := n.do("/unread/.private", "bob").Header().Get("Location"); loc != "/"+priv+"#"+priv {
+		t.Errorf("Wrong next unread in echo: %s", loc)
+	}
+	n.do("/markread/std.closed", "alice")
+	if strings.Contains(n.get("/", "alice"), "/unread/std.closed\">+") ||
+		!strings.Contains(n.get("/", "alice"), "/unread/std.test\">+1") {
+		t.Error("Mark read does not work")
+	}
+	n.do("/unsubscribe/std.test", "bob")
+	if !strings.Contains(n.get("/", "bob"), "PRIVATETEXT") {
+		t.Error("Unsubscribe does not work")
+	}
+	if n.do("/subscribe/std.test", "").Code != http.StatusOK ||
+		len(n.www.rdb.Get(0)) != 0 {
+		t.Error("Anonymous subscribe")
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	pub := n.ids["PUBLICTEXT"]
+	closed := n.ids["CLOSEDTEXT"]
+
+	n.do("/bookmark/"+pub, "bob")
+	n.do("/bookmark/"+closed, "bob") // no access
+	body := n.get("/bookmarks", "bob")
+	if !strings.Contains(body, "subj PUBLICTEXT") || strings.Contains(body, closed) {
+		t.Error("Wrong bookmarks list")
+	}
+	if !strings.Contains(n.get("/"+pub, "bob"), "/unbookmark/"+pub) {
+		t.Error("Bookmarked message is not marked")
+	}
+	if loc := n.do("/search?q=from:alice+TEXT", "").Header().Get("Location"); loc != "/search/from:alice%20TEXT" {
+		t.Errorf("Wrong search redirect: %s", loc)
+	}
+	body = n.get("/search/from:alice%20TEXT", "bob")
+	if !strings.Contains(body, "PUBLICTEXT") || !strings.Contains(body, "PRIVATETEXT") ||
+		strings.Contains(body, "CLOSEDTEXT") {
+		t.Error("Wrong search results")
+	}
+	n.www.slim = &RateLimit{PerIP: 1, Period: time.Minute}
+	if !strings.Contains(n.get("/search/TEXT", ""), "PUBLICTEXT") ||
+		!strings.Contains(n.get("/search/TEXT", ""), "Too many requests") ||
+		!strings.Contains(n.get("/search/TEXT", "bob"), "PUBLICTEXT") {
+		t.Error("Anonymous searches are not limited")
+	}
+	n.www.slim = nil
+	bob := n.www.udb.UserInfoName("bob")
+	if err := n.www.bdb.AddSearch(bob.Id, "private", "echo:.private"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(n.get("/bookmarks/search/private/rss?token="+ii.FeedToken(bob), ""),
+		"PRIVATETEXT") {
+		t.Error("Saved search RSS does not work")
+	}
+	if strings.Contains(n.get("/bookmarks/search/private/rss", "alice"), "PRIVATETEXT") {
+		t.Error("Saved search of other user")
+	}
+	body = n.get("/bookmarks/export", "bob")
+	if !strings.Contains(body, "\"id\": \""+pub+"\"") ||
+		!strings.Contains(body, "\"query\": \"echo:.private\"") {
+		t.Errorf("Wrong export: %s", body)
+	}
+	n.do("/unbookmark/"+pub, "bob")
+	if len(n.www.bdb.Get(bob.Id).Msgs) != 0 {
+		t.Error("Bookmark is not removed")
+	}
+}
+
+func TestPrivateMessages(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	db := n.www.db
+	priv := n.ids["PRIVATETEXT"]
+
+	body := n.get("/inbox", "bob")
+	if !strings.Contains(body, "subj PRIVATETEXT") ||
+		!strings.Contains(body, "class=\"unread\" href=\"/inbox\">+1") {
+		t.Error("No unread message in inbox")
+	}
+	bob := n.www.udb.UserInfoName("bob")
+	c := n.www.pms.users[bob.Id]
+	n.www.pms.users[bob.Id] = pmCount{key: c.key, count: 7}
+	if !strings.Contains(n.get("/", "bob"), "/inbox\">+7") {
+		t.Error("Count of unread messages is not cached")
+	}
+	n.www.pms.users[bob.Id] = c
+	if strings.Contains(n.get("/inbox", "alice"), "PRIVATETEXT") ||
+		!strings.Contains(n.get("/outbox", "alice"), "subj PRIVATETEXT") {
+		t.Error("Wrong inbox or outbox of sender")
+	}
+	body = n.get("/pm/alice", "bob")
+	if !strings.Contains(body, "action=\"/.private/new\"") ||
+		!strings.Contains(body, "value=\"alice\"") {
+		t.Error("Wrong private message form")
+	}
+	if !strings.Contains(n.get("/user/alice", "bob"), "/pm/alice") ||
+		!strings.Contains(n.get("/"+n.ids["PUBLICTEXT"], "bob"), "/pm/alice") {
+		t.Error("No send private message links")
+	}
+	// reply is in the same conversation
+	m := &ii.Msg{Tags: ii.NewTags("ii/ok/repto/" + priv), Echo: ".private",
+		From: "bob", Addr: "test,3", To: "alice", Subj: "Re: subj", Text: "ANSWER"}
+	m.Encode()
+	if err := db.Store(m); err != nil {
+		t.Fatal(err)
+	}
+	body = n.get("/inbox", "alice")
+	if !strings.Contains(body, "subj PRIVATETEXT") || !strings.Contains(body, "+1") ||
+		!strings.Contains(body, "<td class=\"posts extra\">1</td>") {
+		t.Error("Reply is not threaded in conversation")
+	}
+	// second conversation to bob
+	other := testMsg(db, t, ".private", "carol", "test,4", "bob", "OTHERTEXT")
+	n.get("/"+other, "bob")
+	body = n.get("/inbox", "bob")
+	if !strings.Contains(body, "/inbox\">+1") {
+		t.Error("Unread message of other conversation is marked read")
+	}
+	n.get("/"+priv, "bob")
+	if strings.Contains(n.get("/inbox", "bob"), "+1") {
+		t.Error("Read messages are unread")
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	db := n.www.db
+
+	if !strings.Contains(n.get("/", "bob"), "/notifications\">+1") {
+		t.Error("No unread notification in header")
+	}
+	body := n.get("/notifications", "bob")
+	if !strings.Contains(body, "<span class=\"unread\">to</span>") ||
+		!strings.Contains(body, "subj PRIVATETEXT") {
+		t.Error("Wrong notifications")
+	}
+	if strings.Contains(n.get("/", "bob"), "/notifications\">+") {
+		t.Error("Notifications are not marked read")
+	}
+	hook := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		hook <- string(b)
+	}))
+	defer srv.Close()
+	n.www.nfy.Client = srv.Client() /* allow local address */
+	carol := n.www.udb.UserInfoName("carol")
+	if err := n.www.ndb.SetPrefs(carol.Id, ii.NotifyPrefs{Kinds: []string{"mention"},
+		Webhook: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	// carol can not read closed echo
+	testMsg(db, t, "std.closed", "alice", "test,2", "All", "@carol CLOSED")
+	id := testMsg(db, t, "std.test", "alice", "test,2", "All", "@carol MENTION")
+	select {
+	case b := <-hook:
+		if !strings.Contains(b, id) || !strings.Contains(b, "\"kind\":\"mention\"") {
+			t.Errorf("Wrong webhook request: %s", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Webhook is not called")
+	}
+	if l := n.www.ndb.Get(carol.Id).List; len(l) != 1 || l[0].MsgId != id {
+		t.Errorf("Wrong notifications: %v", l)
+	}
+	testMsg(db, t, "std.test", "bob", "test,3", "carol", "TO")
+	if len(n.www.ndb.Get(carol.Id).List) != 1 {
+		t.Error("Disabled notification is added")
+	}
+}
+
+func TestModeration(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	db := n.www.db
+	if err := n.www.udb.SetTag("carol", "status", "new"); err != nil {
+		t.Fatal(err)
+	}
+	n.www.udb.LoadUsers()
+	post := func(echo string, repto string, text string) string {
+		return n.post("/"+echo+"/new", "carol", url.Values{"to": {"All"},
+			"subj": {"pending"}, "msg": {text}, "repto": {repto},
+			"action": {"Submit"}}).Body.String()
+	}
+	topic := testMsg(db, t, "std.blog", "bob", "test,3", "All", "BLOG")
+	if !strings.Contains(post("std.test", "", "PENDINGTEXT"), "waiting for moderation") ||
+		!strings.Contains(post("std.blog", topic, "BLOGTEXT"), "waiting for moderation") {
+		t.Fatal("Message is not premoderated")
+	}
+	tmsg := base64.StdEncoding.EncodeToString([]byte("std.test\nAll\npoint\n\nPOINTTEXT"))
+	if body := n.post("/u/point", "", url.Values{"pauth": {n.www.udb.Secret("carol")},
+		"tmsg": {tmsg}}).Body.String(); body != "msg ok (premoderation)" {
+		t.Errorf("Point message is not premoderated: %s", body)
+	}
+	for _, path := range []string{"/echo/all", "/u/e/std.test", "/e/std.test",
+		"/list.txt", "/search/from:carol", "/moderation"} {
+		if strings.Contains(n.get(path, "carol"), "PENDINGTEXT") {
+			t.Errorf("%s: pending message is shown", path)
+		}
+	}
+	body := n.get("/moderation", "bob") // moderator of std.blog
+	if !strings.Contains(body, "BLOGTEXT") || strings.Contains(body, "PENDINGTEXT") {
+		t.Error("Wrong moderation queue of echo moderator")
+	}
+	if !strings.Contains(n.get("/", "admin"), "+3 <a href=\"/moderation\">") {
+		t.Error("No pending messages in header")
+	}
+	ids := pending_ids(n.www, n.www.udb.UserInfoName("admin"))
+	if len(ids) != 3 {
+		t.Fatalf("Wrong queue: %v", ids)
+	}
+	pub, blog := ids[0], ids[1]
+	date := n.www.pdb.Get(pub).Date
+	form := url.Values{"id": {pub}, "to": {"All"}, "subj": {"edited"},
+		"msg": {"PENDINGTEXT"}, "action": {"approve"}}
+	n.post("/moderation", "bob", form) // not moderator
+	if db.Lookup(pub) != nil {
+		t.Fatal("Message is approved by not moderator")
+	}
+	n.post("/moderation", "admin", form)
+	if m := db.Get(pub); m == nil || m.Subj != "edited" || m.Date != date {
+		t.Errorf("Message is not approved: %v", m)
+	}
+	if l := n.www.ndb.Get(4).List; len(l) != 1 || l[0].Kind != "approved" {
+		t.Errorf("Author is not notified: %v", l)
+	}
+	n.post("/moderation", "bob", url.Values{"id": {blog}, "action": {"reject"}})
+	if db.Lookup(blog) != nil || len(pending_ids(n.www, n.www.udb.UserInfoName("admin"))) != 1 {
+		t.Error("Message is not rejected")
+	}
+	if n.post("/moderation", "admin", form).Code != http.StatusOK ||
+		db.Get(pub).Subj != "edited" {
+		t.Error("Message is approved twice")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	db := n.www.db
+	id := n.ids["PUBLICTEXT"]
+	n.post("/"+id+"/edit", "admin", url.Values{"id": {id}, "echo": {"std.test"},
+		"to": {"All"}, "subj": {"edited"}, "msg": {"EDITEDTEXT"},
+		"action": {"Submit"}})
+	if db.Get(id).Text != "EDITEDTEXT" {
+		t.Fatal("Message is not edited by admin")
+	}
+	own := testMsg(db, t, "std.test", "admin", "test,1", "All", "OWNTEXT")
+	n.post("/"+own+"/edit", "admin", url.Values{"id": {own}, "echo": {"std.test"},
+		"to": {"All"}, "subj": {"edited"}, "msg": {"OWNEDITED"},
+		"action": {"Submit"}})
+	n.get("/"+id+"/blacklist", "admin")
+	n.get("/points/block/carol", "admin")
+	n.get("/points/block/bob", "alice") // not admin
+	list, err := n.www.adb.Select(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("Wrong audit log: %v", list)
+	}
+	if e := list[0]; e.Who != "admin" || e.Action != "edit" || e.Target != id ||
+		!strings.Contains(e.Before, "PUBLICTEXT") || !strings.Contains(e.After, "EDITEDTEXT") {
+		t.Errorf("Wrong edit entry: %v", e)
+	}
+	if e := list[1]; e.Action != "blacklist" || !strings.Contains(e.Before, "EDITEDTEXT") {
+		t.Errorf("Wrong blacklist entry: %v", e)
+	}
+	if e := list[2]; e.Action != "user/block" || e.Target != "carol" ||
+		strings.Contains(e.Before, "blocked") || !strings.Contains(e.After, "status/blocked") {
+		t.Errorf("Wrong user entry: %v", e)
+	}
+	body := n.get("/audit?action=user", "admin")
+	if !strings.Contains(body, "user/block: carol") || strings.Contains(body, "blacklist: ") {
+		t.Error("Wrong filtered audit log")
+	}
+	if strings.Contains(n.get("/audit", "alice"), "user/block") {
+		t.Error("Audit log is shown to not admin")
+	}
+}
+
+func TestEchoes(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	form := url.Values{"name": {"std.new"}, "desc": {"New echo"}, "action": {"add"}}
+	n.post("/echoes", "alice", form)
+	if strings.Contains(n.get("/echoes", "admin"), "std.new") {
+		t.Fatal("Echo is added by not admin")
+	}
+	n.post("/echoes", "admin", form)
+	n.post("/echoes", "admin", url.Values{"name": {"std.new"}, "action": {"up"}})
+	n.post("/echoes", "admin", url.Values{"name": {"std.new"}, "desc": {"Edited"},
+		"allow": {"test,1 test,2"}, "action": {"save"}})
+	b, _ := ioutil.ReadFile(n.dir + "/list.txt")
+	if !strings.Contains(string(b), "\n-std.new!test,1!test,2:0:Edited\nstd.blog") {
+		t.Errorf("Wrong echolist: %s", string(b))
+	}
+	if n.www.edb.Access(&ii.Msg{Echo: "std.new", Addr: "test,1"}, nil, nil) != nil ||
+		n.www.edb.Access(&ii.Msg{Echo: "std.new", Addr: "test,3"}, nil, nil) == nil {
+		t.Error("Echolist is not reloaded")
+	}
+	if l, _ := n.www.adb.Select(&ii.AuditFilter{Action: "echo"}); len(l) != 3 ||
+		l[2].Before != "std.new:0:New echo" || l[2].After != "-std.new!test,1!test,2:0:Edited" {
+		t.Errorf("Wrong audit log: %v", l)
+	}
+}
+
+func TestEchoPolicy(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	policy := "std.test:replies/1\n"
+	if err := ioutil.WriteFile(n.dir+"/echopolicy.txt", []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ReloadConfig(n.www, true)
+	body := n.post("/std.test/new", "alice", url.Values{"to": {"All"},
+		"subj": {"topic"}, "msg": {"TOPIC"}, "action": {"Submit"}}).Body.String()
+	if !strings.Contains(body, "Only replies are allowed in std.test") {
+		t.Errorf("Reason is not reported: %s", body)
+	}
+	tmsg := base64.StdEncoding.EncodeToString([]byte("std.test\nAll\ntopic\n\nTOPIC"))
+	if body := n.post("/u/point", "", url.Values{"pauth": {n.www.udb.Secret("alice")},
+		"tmsg": {tmsg}}).Body.String(); body != "Access denied: Only replies are allowed in std.test" {
+		t.Errorf("Wrong point reply: %s", body)
+	}
+	body = n.post("/std.test/new", "alice", url.Values{"to": {"alice"},
+		"subj": {"re"}, "msg": {"REPLY"}, "repto": {n.ids["PUBLICTEXT"]},
+		"action": {"Submit"}}).Body.String()
+	if len(n.www.db.SelectIDS(&ii.Query{Echo: "std.test", Repto: n.ids["PUBLICTEXT"]})) != 1 {
+		t.Errorf("Reply is not allowed: %s", body)
+	}
+}
+
+func TestSpam(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	db := n.www.db
+	n.www.spam = ii.OpenSpamFilter(n.dir + "/spam.txt")
+	for i := 0; i < 5; i++ {
+		testMsg(db, t, "std.test", "bob", "test,3", "All",
+			fmt.Sprintf("nice weather, see you at the meeting %d", i))
+		id := testMsg(db, t, "std.test", "bob", "test,3", "All",
+			fmt.Sprintf("buy cheap pills in our casino %d", i))
+		db.Blacklist(db.Get(id))
+	}
+	retrain := url.Values{"action": {"retrain"}}
+	n.post("/moderation", "bob", retrain)
+	if _, err := os.Stat(n.dir + "/spam.txt"); err == nil {
+		t.Fatal("Spam filter is trained by not admin")
+	}
+	n.post("/moderation", "admin", retrain)
+	if n.www.spam.Spam == 0 || n.www.spam.Ham == 0 {
+		t.Fatal("Spam filter is not trained")
+	}
+	tmsg := base64.StdEncoding.EncodeToString([]byte("std.test\nAll\noffer\n\ncheap pills casino"))
+	if body := n.post("/u/point", "", url.Values{"pauth": {n.www.udb.Secret("alice")},
+		"tmsg": {tmsg}}).Body.String(); body != "msg ok (premoderation)" {
+		t.Errorf("Spam is not premoderated: %s", body)
+	}
+	n.post("/std.test/new", "alice", url.Values{"to": {"All"},
+		"subj": {"meeting"}, "msg": {"see you at the meeting"}, "action": {"Submit"}})
+	if len(db.SelectIDS(&ii.Query{Echo: "std.test", From: "alice"})) != 2 {
+		t.Error("Message is not published")
+	}
+	ids := pending_ids(n.www, n.www.udb.UserInfoName("admin"))
+	if len(ids) != 1 {
+		t.Fatalf("Wrong queue: %v", ids)
+	}
+	if !strings.Contains(n.get("/moderation", "admin"), "Spam score:") {
+		t.Error("Spam score is not shown")
+	}
+	n.post("/moderation", "admin", url.Values{"id": {ids[0]}, "to": {"All"},
+		"subj": {"offer"}, "msg": {"cheap pills casino"}, "action": {"approve"}})
+	if m := db.Get(ids[0]); m == nil {
+		t.Error("Message is not approved")
+	} else if _, ok := m.Tags.Get("spam"); ok {
+		t.Error("Spam tag is not removed")
+	}
+}
+
+func TestBlockRules(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	db := n.www.db
+	rules := "subj:reject:No advertising:(?i)casino\n" +
+		"body:quarantine:Links are checked:https?://\n" +
+		"addr:blacklist:Known spammer:^test,4$\n"
+	if err := ioutil.WriteFile(n.dir+"/blackwords.txt", []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n.www.edb.LoadBlockwords(n.dir + "/blackwords.txt")
+	point := func(user string, text string) string {
+		tmsg := base64.StdEncoding.EncodeToString([]byte(text))
+		return n.post("/u/point", "", url.Values{"pauth": {n.www.udb.Secret(user)},
+			"tmsg": {tmsg}}).Body.String()
+	}
+	if body := point("alice", "std.test\nAll\nCasino\n\ntext"); body != "Access denied: No advertising" {
+		t.Errorf("Wrong point reply: %s", body)
+	}
+	body := n.post("/std.test/new", "alice", url.Values{"to": {"All"},
+		"subj": {"best casino"}, "msg": {"text"}, "action": {"Submit"}}).Body.String()
+	if !strings.Contains(body, "No advertising") {
+		t.Errorf("Reason is not reported: %s", body)
+	}
+	if body := point("alice", "std.test\nAll\nlink\n\nhttp://example.com"); body != "msg ok (premoderation)" {
+		t.Errorf("Message is not quarantined: %s", body)
+	}
+	if !strings.Contains(n.get("/moderation", "admin"), "Rule: Links are checked") {
+		t.Error("Rule is not shown in moderation queue")
+	}
+	ioutil.WriteFile(n.dir+"/echopolicy.txt", []byte("*:size/20\n"), 0644)
+	n.www.edb.LoadPolicy(n.dir + "/echopolicy.txt")
+	if body := point("alice", "std.test\nAll\nlink\n\nhttp://example.com/long"); !strings.HasPrefix(body, "Access denied") {
+		t.Errorf("Policy is not checked for quarantined message: %s", body)
+	}
+	n.www.edb.LoadPolicy(n.dir + "/none.txt")
+	if body := point("carol", "std.test\nAll\nhello\n\nBLACKLISTED"); body != "msg ok" {
+		t.Errorf("Wrong point reply: %s", body)
+	}
+	ids := db.SelectIDS(&ii.Query{From: "carol", NoAccess: true})
+	if len(ids) != 1 || db.Lookup(ids[0]) != nil {
+		t.Error("Message is not blacklisted")
+	}
+	if body := point("admin", "std.test\nAll\ncasino\n\ntext"); body != "msg ok" {
+		t.Errorf("Admin is checked: %s", body)
+	}
+	n.www.edb.DryRun = true
+	if body := point("alice", "std.test\nAll\ncasino\n\ntext"); body != "msg ok" {
+		t.Errorf("Message is rejected in dry run mode: %s", body)
+	}
+}
+
+func TestPush(t *testing.T) {
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	srv := httptest.NewServer(n.mux)
+	defer srv.Close()
+	if err := n.www.udb.Add("hub", "hub@example.com", "hub", "push/std.test"); err != nil {
+		t.Fatal(err)
+	}
+	n.www.udb.LoadUsers()
+
+	db := ii.OpenDB(n.dir + "/remote")
+	db.Name = "remote"
+	local := testMsg(db, t, "std.test", "dave", "remote,1", "All", "PUSHED")
+	closed := testMsg(db, t, "std.closed", "dave", "remote,1", "All", "NOTPUSHED")
+	fetched := testMsg(db, t, "std.test", "eve", "other,1", "All", "FETCHED")
+
+	node, err := ii.Connect(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.IsFeature("u/push") {
+		t.Fatal("u/push is not advertised")
+	}
+	node.Auth = "wrong"
+	if _, _, err := node.Push(context.Background(), db, []string{"std.test"}, 0, 0); err == nil {
+		t.Error("Push with wrong auth")
+	}
+	node.Auth = n.www.udb.Secret("hub")
+	nr, pos, err := node.Push(context.Background(), db, []string{"std.test", "std.closed"}, 0, 0)
+	if err != nil || nr != 1 || pos != db.Position() {
+		t.Errorf("Wrong push: %d %v", nr, err)
+	}
+	if m := n.www.db.Get(local); m == nil || m.Text != "PUSHED" {
+		t.Error("Message is not pushed")
+	}
+	if n.www.db.Exists(closed) != nil || n.www.db.Exists(fetched) != nil {
+		t.Error("Not allowed or not local message is pushed")
+	}
+	if nr, _, _ := node.Push(context.Background(), db, []string{"std.test"}, 0, 0); nr != 0 {
+		t.Error("Duplicate is accepted")
+	}
+	fake := testMsg(db, t, "std.test", "dave", "test,1", "All", "FAKE")
+	db.Name = "test" /* messages with address of hub */
+	if nr, _, _ := node.Push(context.Background(), db, []string{"std.test"}, 0, 0); nr != 0 ||
+		n.www.db.Exists(fake) != nil {
+		t.Error("Message with local address of hub is accepted")
+	}
+	db.Name = "remote"
+	old := testMsg(db, t, "std.test", "dave", "remote,1", "All", "OLD")
+	since := time.Now().Unix() + 3600
+	if nr, _, _ := node.Push(context.Background(), db, []string{"std.test"}, since, 0); nr != 0 {
+		t.Error("Old message is pushed")
+	}
+	if nr, _, _ := node.Push(context.Background(), db, []string{"std.test"}, 0, 0); nr != 1 ||
+		n.www.db.Exists(old) == nil {
+		t.Error("Message is not pushed")
+	}
+	approved := &ii.Msg{Echo: "std.test", From: "dave", Addr: "remote,1", To: "All",
+		Subj: "approved", Text: "APPROVED", Date: time.Now().Unix() - 7*24*60*60,
+		Tags: ii.NewTags("ii/ok")}
+	approved.Encode()
+	if err := db.Store(approved); err != nil {
+		t.Fatal(err)
+	}
+	if nr, next, err := node.Push(context.Background(), db, []string{"std.test"}, 0, pos); err != nil ||
+		nr != 1 || n.www.db.Exists(approved.MsgId) == nil || next <= pos {
+		t.Errorf("Message stored with old date is not pushed: %d %v", nr, err)
+	}
+	bundle := db.GetBundle(local)
+	body := n.post("/u/push", "", url.Values{"nauth": {n.www.udb.Secret("alice")},
+		"upush": {bundle}}).Body.String()
+	if !strings.HasPrefix(body, "error:") {
+		t.Errorf("Push from point without push tag: %s", body)
+	}
+	if n.do("/u/push", "").Code != http.StatusMethodNotAllowed {
+		t.Error("GET /u/push is allowed")
+	}
+}
+
+func TestPeerSync(t *testing.T) {
+	hub := newTestNode(t)
+	defer os.RemoveAll(hub.dir)
+	srv := httptest.NewServer(hub.mux)
+	defer srv.Close()
+	if err := hub.www.udb.Add("down", "down@example.com", "down", "push/std.test"); err != nil {
+		t.Fatal(err)
+	}
+	hub.www.udb.LoadUsers()
+	fetched := testMsg(hub.www.db, t, "std.test", "bob", "test,3", "All", "HUBTEXT")
+
+	n := newTestNode(t)
+	defer os.RemoveAll(n.dir)
+	n.www.db.Name = "down"
+	pushed := testMsg(n.www.db, t, "std.test", "alice", "down,2", "All", "DOWNTEXT")
+	n.www.sync = NewSyncer(n.www, []*ii.Peer{
+		{URL: srv.URL, Echoes: []string{"std.test"}, Interval: time.Hour,
+			Auth: hub.www.udb.Secret("down")},
+		{URL: "http://127.0.0.1:1", Interval: time.Hour}},
+		ii.OpenCounts(n.dir+"/counts.txt"))
+	ok, bad := n.www.sync.peers[0], n.www.sync.peers[1]
+	if err := n.www.sync.SyncPeer(ok); err != nil {
+		t.Fatal(err)
+	}
+	if n.www.db.Lookup(fetched) == nil || hub.www.db.Lookup(pushed) == nil {
+		t.Error("Messages are not synced")
+	}
+	if ok.LastImported < 1 || ok.Pushed != 1 || ok.LastSuccess == 0 || ok.Errors != 0 {
+		t.Errorf("Wrong status: %v", ok)
+	}
+	n.www.sync.SyncPeer(ok) /* count is changed by push */
+	if err := n.www.sync.SyncPeer(ok); err != nil || ok.LastImported != 0 ||
+		ok.Report.Echoes[0].Mode != ii.FETCH_UNCHANGED {
+		t.Errorf("Unchanged echo is fetched: %s %v", ok.Report.Summary(true), err)
+	}
+	if c := ii.OpenCounts(n.dir + "/counts.txt").Get(srv.URL); c["std.test"].Count < 2 {
+		t.Errorf("Counts are not saved: %v", c)
+	}
+	cdb := ii.OpenCounts(n.dir + "/counts.txt")
+	if ok.PushPos == 0 || cdb.GetPushed(srv.URL) != ok.PushPos {
+		t.Errorf("Push position is not saved: %d", cdb.GetPushed(srv.URL))
+	}
+	if s := NewSyncer(n.www, []*ii.Peer{ok.Peer}, cdb); s.peers[0].PushPos != ok.PushPos ||
+		s.peers[0].PushSince != 0 {
+		t.Errorf("Push position is not restored: %d", s.peers[0].PushPos)
+	}
+	if n.www.sync.begin(ok) != nil || n.www.sync.SyncPeer(ok) == nil {
+		t.Error("Sync is started twice")
+	}
+	ok.Running = false
+	if n.www.sync.SyncPeer(bad) == nil || bad.Errors != 1 || bad.LastError == "" {
+		t.Errorf("Error is not reported: %v", bad)
+	}
+	if d := sync_delay(time.Hour, 3); d < 8*time.Hour || d > 9*time.Hour {
+		t.Errorf("Wrong backoff: %s", d)
+	}
+	if d := sync_delay(time.Hour, 100); d < MAX_BACKOFF || d > MAX_BACKOFF*11/10 {
+		t.Errorf("Wrong max backoff: %s", d)
+	}
+	body := n.get("/peers", "admin")
+	if !strings.Contains(body, srv.URL) || !strings.Contains(body, "1 in a row") {
+		t.Error("Peers are not shown")
+	}
+	if strings.Contains(n.get("/peers", "alice"), srv.URL) {
+		t.Error("Peers are shown to not admin")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/hugeping/ii-go/ii"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Max delay between syncs with failing peer.
+const MAX_BACKOFF = 24 * time.Hour
+
+// Max parallel requests of all syncs.
+const SYNC_CONNECTIONS = 16
+
+// Status of sync with peer. Times are unix times.
+// Errors: number of failed syncs in a row (used for backoff).
+// Imported, Pushed: messages since start of node.
+// PushPos: local messages stored in db since this position are pushed
+// (see DB.Position, saved in counts database). PushSince: for peers
+// without saved position, only messages of last 24 hours are pushed.
+// Report: report of last fetch.
+// Counts: counts and last messages of echoes of peer at last fetch.
+type PeerStatus struct {
+	Peer         *ii.Peer
+	LastTry      int64
+	LastSuccess  int64
+	LastError    string
+	Errors       int
+	Imported     int64
+	LastImported int64
+	Pushed       int64
+	Next         int64
+	PushSince    int64
+	PushPos      int64
+	Running      bool
+	Report       *ii.FetchReport
+	Counts       map[string]ii.EchoCount
+}
+
+// Peer sync scheduler. Fetches from peers (and pushes local
+// messages to peers with auth) in-process, so node db is not
+// locked by ii-tool running from cron. Peers share http client
+// with limits of parallel requests. Echo counts of peers are
+// saved in counts database (if it is not nil).
+type Syncer struct {
+	www    *WWW
+	peers  []*PeerStatus
+	client *ii.Client
+	counts *ii.CDB
+	Sync   sync.Mutex
+}
+
+// Create scheduler for peers.
+func NewSyncer(www *WWW, peers []*ii.Peer, counts *ii.CDB) *Syncer {
+	s := &Syncer{www: www, client: ii.NewClient(), counts: counts}
+	s.client.MaxRequests = SYNC_CONNECTIONS
+	s.client.MaxPerHost = ii.DEFAULT_CONNECTIONS
+	now := time.Now().Unix()
+	for _, p := range peers {
+		st := &PeerStatus{Peer: p, PushSince: now - 24*60*60}
+		if counts != nil {
+			st.Counts = counts.Get(p.URL)
+			if pos := counts.GetPushed(p.URL); pos > 0 {
+				st.PushSince, st.PushPos = 0, pos
+			}
+		}
+		s.peers = append(s.peers, st)
+	}
+	return s
+}
+
+// Delay before next sync: interval with jitter (up to 10%),
+// doubled for every error in a row (up to MAX_BACKOFF).
+func sync_delay(interval time.Duration, errors int) time.Duration {
+	d := interval
+	for i := 0; i < errors && d < MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > MAX_BACKOFF {
+		d = MAX_BACKOFF
+	}
+	if j := int64(d / 10); j > 0 {
+		d += time.Duration(rand.Int63n(j))
+	}
+	return d
+}
+
+// Filter for fetched messages: block rules and spam filter.
+// Quarantined messages go to premoderation queue.
+func fetch_filter(www *WWW) func(m *ii.Msg) error {
+	return func(m *ii.Msg) error {
+		r := ii.MatchedRule(www.edb.CheckRules(m))
+		if err := ii.ApplyRule(m, www.pdb, r); err != nil {
+			return err
+		}
+		if www.spam != nil && www.pdb != nil {
+			return www.spam.Filter(www.pdb)(m)
+		}
+		return nil
+	}
+}
+
+// Mark sync with peer as running. Returns error if it
+// is already running.
+func (s *Syncer) begin(st *PeerStatus) error {
+	s.Sync.Lock()
+	defer s.Sync.Unlock()
+	if st.Running {
+		return errors.New("Sync is running: " + st.Peer.URL)
+	}
+	st.Running = true
+	return nil
+}
+
+// Sync with peer once: fetch messages and push local ones
+// (if peer has auth). Sync is cancelled if it takes longer
+// than interval of peer. Returns error if sync is already running.
+func (s *Syncer) SyncPeer(st *PeerStatus) error {
+	if err := s.begin(st); err != nil {
+		return err
+	}
+	return s.sync(st)
+}
+
+// Internal function of SyncPeer, sync must be marked as running.
+func (s *Syncer) sync(st *PeerStatus) error {
+	s.Sync.Lock()
+	p := st.Peer
+	st.LastTry = time.Now().Unix()
+	since, pos := st.PushSince, st.PushPos
+	counts := make(map[string]ii.EchoCount)
+	for k, v := range st.Counts {
+		counts[k] = v
+	}
+	s.Sync.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Interval)
+	defer cancel()
+	var pushed int
+	var report *ii.FetchReport
+	n, err := ii.Connect(ctx, p.URL, s.client)
+	if err == nil {
+		n.Filter = fetch_filter(s.www)
+		n.Pending = s.www.pdb
+		n.Counts = counts
+		report, err = n.Fetch(ctx, s.www.db, p.Echoes, p.Limit)
+		if s.counts != nil {
+			if e := s.counts.Set(p.URL, n.Counts); e != nil {
+				ii.Error.Printf("Can not save counts of %s: %s", p.URL, e)
+			}
+		}
+	}
+	if err == nil && p.Auth != "" {
+		n.Auth = p.Auth
+		echoes := p.Echoes
+		if echoes == nil {
+			for _, e := range s.www.db.Echoes(nil, &ii.Query{}) {
+				echoes = append(echoes, e.Name)
+			}
+		}
+		pushed, pos, err = n.Push(ctx, s.www.db, echoes, since, pos)
+	}
+
+	s.Sync.Lock()
+	defer s.Sync.Unlock()
+	st.Running = false
+	st.Report = report
+	if n != nil {
+		st.Counts = n.Counts
+	}
+	if report != nil {
+		st.LastImported = int64(report.Total.New)
+		st.Imported += st.LastImported
+	}
+	st.Pushed += int64(pushed)
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+		ii.Error.Printf("Sync with %s: %s", p.URL, err)
+		return err
+	}
+	st.Errors = 0
+	st.LastError = ""
+	st.LastSuccess = time.Now().Unix()
+	if p.Auth != "" {
+		st.PushSince, st.PushPos = 0, pos
+		if s.counts != nil {
+			if e := s.counts.SetPushed(p.URL, pos); e != nil {
+				ii.Error.Printf("Can not save push position of %s: %s", p.URL, e)
+			}
+		}
+	}
+	ii.Info.Printf("Sync with %s: %d imported, %d pushed", p.URL,
+		st.LastImported, pushed)
+	return nil
+}
+
+func (s *Syncer) run(st *PeerStatus) {
+	/* do not start all peers at once */
+	delay := time.Duration(rand.Int63n(int64(time.Minute)))
+	for {
+		s.Sync.Lock()
+		st.Next = time.Now().Add(delay).Unix()
+		s.Sync.Unlock()
+		time.Sleep(delay)
+		s.SyncPeer(st) /* not if sync is started by admin */
+		s.Sync.Lock()
+		delay = sync_delay(st.Peer.Interval, st.Errors)
+		s.Sync.Unlock()
+	}
+}
+
+// Start sync goroutines for all peers.
+func (s *Syncer) Start() {
+	for _, st := range s.peers {
+		go s.run(st)
+	}
+}
+
+// Start sync with peer (url) now, if it is not running.
+func (s *Syncer) SyncNow(url string) error {
+	if s == nil {
+		return errors.New("No such peer: " + url)
+	}
+	s.Sync.Lock()
+	defer s.Sync.Unlock()
+	for _, st := range s.peers {
+		if st.Peer.URL != url {
+			continue
+		}
+		if st.Running {
+			return errors.New("Sync is running: " + url)
+		}
+		st.Running = true
+		go s.sync(st)
+		return nil
+	}
+	return errors.New("No such peer: " + url)
+}
+
+// Copy of peers status.
+func (s *Syncer) Status() []PeerStatus {
+	var list []PeerStatus
+	if s == nil {
+		return list
+	}
+	s.Sync.Lock()
+	defer s.Sync.Unlock()
+	for _, st := range s.peers {
+		list = append(list, *st)
+	}
+	return list
+}
@@ -0,0 +1,33 @@
+{{template "header.tpl" $}}
+<form method="get" enctype="application/x-www-form-urlencoded" action="{{.PfxPath}}/audit">
+<table id="profile" cellspacing=0 cellpadding=0>
+<tr class="odd"><td>Who:</td><td><input type="text" name="who" value="{{.AuditFilter.Who}}"></td></tr>
+<tr class="even"><td>Action:</td><td><input type="text" name="action" placeholder="blacklist, edit, avatar, user, moderation" value="{{.AuditFilter.Action}}"></td></tr>
+<tr class="odd"><td>Target:</td><td><input type="text" name="target" placeholder="msgid or user" value="{{.AuditFilter.Target}}"></td></tr>
+<tr class="even"><td class="links" colspan="2"><button class="form-button" type="submit">Filter</button></td></tr>
+</table>
+</form>
+
+<table id="topiclist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Action</th>
+<th>Who</th>
+<th>Date</th>
+</tr>
+{{range $k, $_ := .Audit }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="topic">{{.Action}}: {{.Target}}
+{{ with .Before }}<br><span class="info">before:</span><pre>{{.}}</pre>{{ end }}
+{{ with .After }}<br><span class="info">after:</span><pre>{{.}}</pre>{{ end }}
+</td>
+<td class="info"><a href="{{$.PfxPath}}/user/{{.Who}}">{{.Who}}</a></td>
+<td class="info">{{.Date | fdate}}</td>
+</tr>
+{{ end }}
+</table>
+{{template "pager.tpl" $}}
+{{template "footer.tpl"}}
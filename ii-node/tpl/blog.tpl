@@ -1,5 +1,6 @@
 {{template "header.tpl" $}}
-<a class="rss" href="{{.PfxPath}}/echo+topics/{{.Echo}}/rss">RSS</a>
+<a class="rss" href="{{.PfxPath}}/echo+topics/{{.Echo}}/rss{{feed_query .User}}">RSS</a>
+{{template "reader.tpl" $}}
 {{template "pager.tpl" $}}
 <div id="topic">
 {{range $k, $v := .Topics }}
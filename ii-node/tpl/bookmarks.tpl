@@ -0,0 +1,50 @@
+{{template "header.tpl" $}}
+{{template "search.tpl" $}}
+
+<table id="echolist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Saved searches</th>
+<th>Query</th>
+<th></th>
+</tr>
+{{range $k, $_ := .Bookmarks.Searches }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="echo"><a href="{{$.PfxPath}}/bookmarks/search/{{.Name}}">{{.Name}}</a></td>
+<td class="info">{{.Query}}</td>
+<td class="links">
+<a class="rss" href="{{$.PfxPath}}/bookmarks/search/{{.Name}}/rss{{feed_query $.User}}">RSS</a>
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{$.PfxPath}}/bookmarks">
+<input type="hidden" name="name" value="{{.Name}}">
+<button class="form-button" type="submit" name="action" value="delete">Delete</button>
+</form>
+</td>
+</tr>
+{{ end }}
+</table>
+
+<table id="topiclist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Bookmarks</th>
+<th class="extra">Echo</th>
+<th>Date</th>
+</tr>
+{{range $k, $_ := .Msg }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="topic"><a href="{{$.PfxPath}}/{{.MsgId}}#{{.MsgId}}">{{with .Subj}}{{.}}{{else}}No subject{{end}}</a><br>
+<span class="info">by {{.From}} :: <a href="{{$.PfxPath}}/unbookmark/{{.MsgId}}">Remove</a></span></td>
+<td class="info extra">{{.Echo}}</td>
+<td class="info">{{.Date | fdate}}</td>
+</tr>
+{{ end }}
+</table>
+<div class="reader"><a href="{{.PfxPath}}/bookmarks/export">Export</a></div>
+
+{{template "footer.tpl"}}
@@ -1,5 +1,6 @@
 {{template "header.tpl" $}}
-<a class="rss" href="{{.PfxPath}}/echo/{{.Echo}}">Echo</a> :: <a class="rss" href="{{.PfxPath}}/forum/{{.Echo}}">Forum</a> :: <a class="rss" href="{{.PfxPath}}/blog/{{.Echo}}">Blog</a>  :: <a class="rss" href="{{.PfxPath}}/echo/{{.Echo}}/rss">RSS</a>
+<a class="rss" href="{{.PfxPath}}/echo/{{.Echo}}">Echo</a> :: <a class="rss" href="{{.PfxPath}}/forum/{{.Echo}}">Forum</a> :: <a class="rss" href="{{.PfxPath}}/blog/{{.Echo}}">Blog</a>  :: <a class="rss" href="{{.PfxPath}}/echo/{{.Echo}}/rss{{feed_query .User}}">RSS</a>
+{{template "reader.tpl" $}}
 {{template "pager.tpl" $}}
 
 <div id="topic">
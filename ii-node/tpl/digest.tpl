@@ -1,5 +1,6 @@
 {{template "header.tpl" $}}
 <a class="rss" href="{{$.PfxPath}}/forum/">Forum</a> :: <a class="rss" href="{{$.PfxPath}}/echo/all/">Feed</a>
+{{template "reader.tpl" $}}
 {{template "pager.tpl" $}}
 
 <div id="topic">
@@ -8,7 +9,7 @@
 {{ with .Msg }}
 
 
-<span class="title"><a href="{{$.PfxPath}}/{{.Echo}}">{{.Echo}} :: {{ index $.Echolist.Info .Echo }} [{{ $count }}]</a></span><br>
+<span class="title"><a href="{{$.PfxPath}}/{{.Echo}}">{{.Echo}} :: {{ index $.Echolist.Info .Echo }} [{{ $count }}]</a>{{ if index $.Unread .Echo }} <a class="unread" href="{{$.PfxPath}}/unread/{{.Echo}}">+{{index $.Unread .Echo}}</a>{{ end }}</span><br>
 <div class="msg">
 {{ if and (msg_local .) (has_avatar .From)}}
 <img class="avatar" src="/avatar/{{.From}}">
@@ -0,0 +1,39 @@
+{{template "header.tpl" $}}
+<table id="profile" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Echo</th>
+<th>Settings</th>
+<th>Actions</th>
+</tr>
+{{range $k, $_ := .Areas }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{$.PfxPath}}/echoes">
+<td><input type="hidden" name="name" value="{{.Name}}">
+<a href="{{$.PfxPath}}/{{.Name}}">{{.Name}}</a><br>
+<label><input type="checkbox" name="write" value="1"{{ if .Write }} checked{{ end }}> writable</label></td>
+<td><input type="text" name="desc" placeholder="Description" value="{{.Desc}}"><br>
+<input type="text" name="allow" placeholder="Topics only by: node,1 node,2" value="{{range $i, $a := .Allow}}{{if $i}} {{end}}{{$a}}{{end}}"><br>
+<input type="text" name="read" placeholder="Readable only by: node,1 node,2" value="{{range $i, $a := .Read}}{{if $i}} {{end}}{{$a}}{{end}}"></td>
+<td class="links">
+<button class="form-button" type="submit" name="action" value="save">Save</button>
+<button class="form-button" type="submit" name="action" value="up">Up</button>
+<button class="form-button" type="submit" name="action" value="down">Down</button>
+<button class="form-button" type="submit" name="action" value="archive">Archive</button>
+<button class="form-button" type="submit" name="action" value="remove">Remove</button>
+</td>
+</form>
+</tr>
+{{ end }}
+<tr class="title">
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{$.PfxPath}}/echoes">
+<td><input type="text" name="name" placeholder="new.echo"></td>
+<td><input type="text" name="desc" placeholder="Description"></td>
+<td class="links"><button class="form-button" type="submit" name="action" value="add">Add</button></td>
+</form>
+</tr>
+</table>
+{{template "footer.tpl"}}
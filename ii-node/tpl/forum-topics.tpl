@@ -1,4 +1,5 @@
 {{template "header.tpl" $}}
+{{template "reader.tpl" $}}
 {{template "pager.tpl" $}}
 <table id="topiclist" cellspacing=0 cellpadding=0>
 <tr class="title">
@@ -12,7 +13,9 @@
 {{ else }}
 <tr class="odd">
 {{ end }}
-<td class="topic"><a href="{{$.PfxPath}}/{{.Head.MsgId}}/1">{{with .Head.Subj}}{{.}}{{else}}No subject{{end}}</a></td>
+<td class="topic"><a href="{{$.PfxPath}}/{{.Head.MsgId}}/1">{{with .Head.Subj}}{{.}}{{else}}No subject{{end}}</a>
+{{ if $.Bookmarks }}{{ if $.Bookmarks.Marked .Head.MsgId }}<a class="bookmark" href="{{$.PfxPath}}/unbookmark/{{.Head.MsgId}}" title="Unbookmark">&#9733;</a>{{ else }}<a class="bookmark" href="{{$.PfxPath}}/bookmark/{{.Head.MsgId}}" title="Bookmark">&#9734;</a>{{ end }}{{ end }}
+</td>
 <td class="posts extra">{{.Count}}</td>
 <td class="info"><span class="subj">{{.Tail.Subj}}</span><br><a href="{{$.PfxPath}}/{{.Tail.MsgId}}#{{.Tail.MsgId}}">{{.Tail.Date | fdate}}</a><br>by {{.Tail.From}}</td>
 </tr>
@@ -1,4 +1,5 @@
 {{template "header.tpl" $}}
+{{template "reader.tpl" $}}
 {{template "pager.tpl" $}}
 
 <table id="echolist" cellspacing=0 cellpadding=0>
@@ -18,7 +19,7 @@
 <span class="info">{{ index $.Echolist.Info .Name }}</span>
 </td>
 <td class="topics extra">{{.Topics}}</td>
-<td class="count extra">{{.Count}}</td>
+<td class="count extra">{{.Count}}{{ if index $.Unread .Name }} <a class="unread" href="{{$.PfxPath}}/unread/{{.Name}}">+{{index $.Unread .Name}}</a>{{ end }}</td>
 <td class="info">{{with .Msg}}<span class="subj">{{.Subj}}</span><br><a href="{{$.PfxPath}}/echo/{{.MsgId}}#{{.MsgId}}">{{.Date | fdate}}</a> by {{.From}}{{end}}</td>
 </tr>
 {{ end }}
@@ -8,13 +8,13 @@
 <link rel="stylesheet" type="text/css" href="/lib/style.css">
 
 {{ if eq .Template "query.tpl" }}
-<link href="{{.PfxPath}}/{{.BasePath}}/rss" type="application/rss+xml" rel="alternate" title="{{.Sysname}} {{.BasePath}} :: RSS feed" />
+<link href="{{.PfxPath}}/{{.BasePath}}/rss{{feed_query .User}}" type="application/rss+xml" rel="alternate" title="{{.Sysname}} {{.BasePath}} :: RSS feed" />
 {{ else if eq .Template "blog.tpl" }}
-<link href="{{.PfxPath}}/{{.BasePath}}+topics/rss" type="application/rss+xml" rel="alternate" title="{{.Sysname}} {{.BasePath}} :: RSS feed" />
+<link href="{{.PfxPath}}/{{.BasePath}}+topics/rss{{feed_query .User}}" type="application/rss+xml" rel="alternate" title="{{.Sysname}} {{.BasePath}} :: RSS feed" />
 {{ else if eq .Template "topics.tpl" }}
-<link href="{{.PfxPath}}/{{.Echo}}/rss" type="application/rss+xml" rel="alternate" title="{{.Sysname}} {{.Echo}} :: RSS feed" />
+<link href="{{.PfxPath}}/{{.Echo}}/rss{{feed_query .User}}" type="application/rss+xml" rel="alternate" title="{{.Sysname}} {{.Echo}} :: RSS feed" />
 {{ else if eq .Template "index.tpl" }}
-<link href="{{.PfxPath}}/echo/all/rss" type="application/rss+xml" rel="alternate" title="{{.Sysname}} Posts :: RSS feed" />
+<link href="{{.PfxPath}}/echo/all/rss{{feed_query .User}}" type="application/rss+xml" rel="alternate" title="{{.Sysname}} Posts :: RSS feed" />
 {{ end }}
 
 
@@ -80,7 +80,17 @@
       {{ if and (eq .User.Id 1) (gt .Users.NewUsers 0) }}
       <span class="info">+{{.Users.NewUsers}} <a href="{{$.PfxPath}}/points">users</a> :: </span>
       {{ end }}
+      {{ if .Pending }}
+      <span class="info">+{{.Pending}} <a href="{{$.PfxPath}}/moderation">moderation</a> :: </span>
+      {{ end }}
+      {{ if .Hidden }}
+      <span class="info">{{.Hidden}} {{ if .ShowHidden }}<a href="{{$.PfxPath}}/killfile/hide">killed</a>{{ else }}<a href="{{$.PfxPath}}/killfile/show">hidden</a>{{ end }} :: </span>
+      {{ end }}
+      <a href="{{$.PfxPath}}/search">Search</a> ::
       {{ if .User.Name }}
+      <a href="{{$.PfxPath}}/bookmarks">Bookmarks</a> ::
+      {{ if .Notifications }}<a href="{{$.PfxPath}}/notifications">Notifications</a>{{ if .Notify }} <a class="unread" href="{{$.PfxPath}}/notifications">+{{.Notify}}</a>{{ end }} ::{{ end }}
+      <a href="{{$.PfxPath}}/inbox">Inbox</a>{{ if .Inbox }} <a class="unread" href="{{$.PfxPath}}/inbox">+{{.Inbox}}</a>{{ end }} ::
       {{ if eq .BasePath "profile" }}
       <a href="/logout">Logout</a>
       {{ else }}
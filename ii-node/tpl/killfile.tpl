@@ -0,0 +1,32 @@
+{{template "header.tpl" $}}
+
+<table id="profile" cellspacing=0 cellpadding=0>
+<tr class="title"><th colspan="3">Killfile</th></tr>
+{{with .Killfile}}
+{{range $k, $_ := .Rules }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td>{{.Kind}}</td>
+<td>{{.Value}}</td>
+<td class="links"><a href="{{$.PfxPath}}/killfile/del?kind={{.Kind}}&value={{.Value}}">Remove</a></td>
+</tr>
+{{end}}
+{{end}}
+<tr><td class="even" colspan="3">
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{.PfxPath}}/killfile">
+<select name="kind">
+{{range kill_kinds}}<option value="{{.}}">{{.}}</option>{{end}}
+</select>
+<input type="text" name="value" class="login" placeholder="name, address, echo or regexp">
+<button class="form-button" type="submit">Add</button>
+</form>
+</td></tr>
+<tr class="odd"><td class="links" colspan="3">
+{{if .ShowHidden}}<a href="{{.PfxPath}}/killfile/hide">Hide killed messages</a>{{else}}<a href="{{.PfxPath}}/killfile/show">Show killed messages</a>{{end}}
+</td></tr>
+</table>
+
+{{template "footer.tpl"}}
@@ -0,0 +1,40 @@
+{{template "header.tpl" $}}
+<div id="topic">
+{{ range .Msg }}
+<div class="msg">
+<span class="echo">{{.Echo}}</span><br>
+<span class="subj">{{with .Subj}}{{.}}{{else}}No subject{{end}}</span><br>
+<span class="info"><a href="{{$.PfxPath}}/user/{{.From}}">{{.From}}</a>({{.Addr}}) &mdash; {{.To}}<br>{{.Date | fdate}}</span><br>
+{{with msg_tag . "spam"}}<span class="info">Spam score: {{.}}%</span><br>{{end}}
+{{with msg_tag . "rule"}}<span class="info">Rule: {{.}}</span><br>{{end}}
+<div class="text">
+<br>
+{{. | msg_text}}
+<br>
+</div>
+<table id="edit">
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{$.PfxPath}}/moderation">
+<tr><td class="odd">
+<input type="hidden" name="id" value="{{.MsgId}}">
+<input type="text" name="to" class="to" placeholder="{{.To}}" value="{{.To}}"><br>
+<input type="text" name="subj" class="subj" placeholder="{{.Subj}}" value="{{.Subj}}"><br>
+<textarea type="text" name="msg" class="message" cols=60 row=16>{{.Text}}</textarea>
+</td></tr>
+<tr><td class="odd center">
+<button class="form-button" type="submit" name="action" value="approve">Approve</button>
+<button class="form-button" type="submit" name="action" value="save">Save</button>
+<button class="form-button" type="submit" name="action" value="reject">Reject</button>
+</td></tr>
+</form>
+</table>
+</div>
+{{ else }}
+<div class="msg">No messages are waiting for moderation.</div>
+{{ end }}
+{{ if eq $.User.Id 1 }}
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{$.PfxPath}}/moderation">
+<button class="form-button" type="submit" name="action" value="retrain">Retrain spam filter</button>
+</form>
+{{ end }}
+</div>
+{{template "footer.tpl"}}
@@ -9,7 +9,7 @@
 {{ if eq .Echo "" }}
 <input type="text" name="echo" class="echo" placeholder="echo" value=""><br>
 {{ end }}
-<input type="text" name="to" class="to" placeholder="To" value="All"><br>
+<input type="text" name="to" class="to" placeholder="To" value="{{with .To}}{{.}}{{else}}All{{end}}"><br>
 <input type="text" name="subj" class="subj" placeholder="Subject"><br>
 <textarea type="text" name="msg" class="message" cols=60 row=16 placeholder="Hi, All!">
 </textarea>
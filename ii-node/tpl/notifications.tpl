@@ -0,0 +1,35 @@
+{{template "header.tpl" $}}
+<table id="topiclist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Notifications</th>
+<th class="extra">Echo</th>
+<th>Date</th>
+</tr>
+{{range $k, $_ := .Notices }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="topic">{{ if .New }}<span class="unread">{{.Kind}}</span>{{ else }}{{.Kind}}{{ end }}:
+<a href="{{$.PfxPath}}/{{.Msg.MsgId}}#{{.Msg.MsgId}}">{{with .Msg.Subj}}{{.}}{{else}}No subject{{end}}</a><br>
+<span class="info">by <a href="{{$.PfxPath}}/user/{{.Msg.From}}">{{.Msg.From}}</a></span></td>
+<td class="info extra">{{.Msg.Echo}}</td>
+<td class="info">{{.Msg.Date | fdate}}</td>
+</tr>
+{{ end }}
+</table>
+
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{.PfxPath}}/notifications">
+<table id="profile" cellspacing=0 cellpadding=0>
+<tr class="odd"><td>Notify about:</td><td>
+{{ range notify_kinds }}
+<label><input type="checkbox" name="{{.}}" value="1"{{ if $.Notifications.Prefs.Enabled . }} checked{{ end }}> {{.}}</label>
+{{ end }}
+</td></tr>
+<tr class="even"><td>E-mail:</td><td><label><input type="checkbox" name="email" value="1"{{ if .Notifications.Prefs.Email }} checked{{ end }}> {{.User.Mail}}</label></td></tr>
+<tr class="odd"><td>Webhook:</td><td><input type="text" name="webhook" placeholder="https://" value="{{.Notifications.Prefs.Webhook}}"></td></tr>
+<tr class="even"><td class="links" colspan="2"><button class="form-button" type="submit">Save</button></td></tr>
+</table>
+</form>
+{{template "footer.tpl"}}
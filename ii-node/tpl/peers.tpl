@@ -0,0 +1,31 @@
+{{template "header.tpl" $}}
+<table id="topiclist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Peer</th>
+<th>Last success</th>
+<th>Imported</th>
+<th>Next sync</th>
+</tr>
+{{range $k, $_ := .Peers }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="topic">{{.Peer.URL}}
+<br><span class="info">{{with .Peer.Echoes}}{{range .}}{{.}} {{end}}{{else}}all echoes{{end}}</span>
+{{ if .LastError }}<br><span class="info">error ({{.Errors}} in a row): {{.LastError}}</span>{{ end }}
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{$.PfxPath}}/peers">
+<input type="hidden" name="url" value="{{.Peer.URL}}">
+<button class="form-button" type="submit"{{if .Running}} disabled{{end}}>Sync now</button>
+</form>
+</td>
+<td class="info">{{if .LastSuccess}}{{.LastSuccess | fdate}}{{else}}never{{end}}</td>
+<td class="info">{{.LastImported}} / {{.Imported}}{{with .Report}}<br>skipped: {{.Total.Skipped}}, failed echoes: {{.Failed}}{{end}}{{if .Peer.Auth}}<br>pushed: {{.Pushed}}{{end}}</td>
+<td class="info">{{if .Running}}running{{else}}{{.Next | fdate}}{{end}}</td>
+</tr>
+{{ else }}
+<tr class="odd"><td class="topic" colspan="4">No peers (see peers.txt).</td></tr>
+{{ end }}
+</table>
+{{template "footer.tpl"}}
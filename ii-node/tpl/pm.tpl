@@ -0,0 +1,28 @@
+{{template "header.tpl" $}}
+<div class="reader">
+{{ if eq .BasePath "inbox" }}<span class="unread">Inbox</span>{{ else }}<a href="{{.PfxPath}}/inbox">Inbox</a>{{ end }} ::
+{{ if eq .BasePath "outbox" }}<span class="unread">Outbox</span>{{ else }}<a href="{{.PfxPath}}/outbox">Outbox</a>{{ end }}
+</div>
+{{template "pager.tpl" $}}
+<table id="topiclist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Conversations</th>
+<th class="extra">Replies</th>
+<th>Last message</th>
+</tr>
+{{range $k, $v := .Conversations }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="topic"><a href="{{$.PfxPath}}/{{.Head.MsgId}}/1">{{with .Head.Subj}}{{.}}{{else}}No subject{{end}}</a>
+{{ if .Unread }}<a class="unread" href="{{$.PfxPath}}/{{.Tail.MsgId}}#{{.Tail.MsgId}}">+{{.Unread}}</a>{{ end }}<br>
+<span class="info">with <a href="{{$.PfxPath}}/user/{{.With}}">{{.With}}</a> :: {{.Head.Echo}}</span></td>
+<td class="posts extra">{{.Count}}</td>
+<td class="info"><span class="subj">{{.Tail.Subj}}</span><br><a href="{{$.PfxPath}}/{{.Tail.MsgId}}#{{.Tail.MsgId}}">{{.Tail.Date | fdate}}</a><br>by {{.Tail.From}}</td>
+</tr>
+{{ end }}
+</table>
+{{template "pager.tpl" $}}
+{{template "footer.tpl"}}
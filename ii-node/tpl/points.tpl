@@ -1,4 +1,5 @@
 {{template "header.tpl" $}}
+<div class="links"><a href="{{$.PfxPath}}/echoes">Echo areas</a> :: <a href="{{$.PfxPath}}/audit">Audit log</a> :: <a href="{{$.PfxPath}}/peers">Peers</a></div>
 
 <table id="profile" cellspacing=0 cellpadding=0>
 {{range $k, $_ := .Users.List }}
@@ -8,7 +9,7 @@
 <tr class="odd">
 {{ end }}
 {{ with index $.Users.Names . }}
-<td>{{.Name}}</td>
+<td><a href="{{$.PfxPath}}/user/{{.Name}}">{{.Name}}</a></td>
 <td>{{.Mail}}</td>
 <td>{{user_tag .Name "info"}}
 {{if user_tag .Name "status"}}
@@ -0,0 +1,13 @@
+{{template "header.tpl" $}}
+
+<div id="topic">
+<div class="msg">
+<div class="text">
+Ваше сообщение будет опубликовано после проверки модератором.<br>
+<hr/>
+Your message is waiting for moderation. It will be published after approval.<br>
+</div>
+</div>
+</div>
+
+{{template "footer.tpl"}}
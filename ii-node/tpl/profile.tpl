@@ -6,7 +6,17 @@
 <tr class="even"><td>Auth:</td><td>{{.User.Secret}}</td></tr>
 <tr class="odd"><td>e-mail:</td><td>{{.User.Mail}}</td></tr>
 <tr class="even"><td>Addr:</td><td>{{.Selected}}</td></tr>
-<tr class="odd"><td class="links" colspan="2"><a href="{{.PfxPath}}/from/{{.User.Name}}">/from/{{.User.Name}}</a> :: <a href="{{.PfxPath}}/to/{{.User.Name}}">/to/{{.User.Name}}</a>
+<tr class="odd"><td class="links" colspan="2"><a href="{{.PfxPath}}/from/{{.User.Name}}">/from/{{.User.Name}}</a> :: <a href="{{.PfxPath}}/to/{{.User.Name}}">/to/{{.User.Name}}</a> :: <a href="{{.PfxPath}}/user/{{.User.Name}}">/user/{{.User.Name}}</a> :: <a href="{{.PfxPath}}/killfile">killfile</a>
+</td></tr>
+
+<tr><td class="even" colspan="2">
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{.PfxPath}}/profile">
+Public profile:
+{{range profile_fields}}
+<label><input type="checkbox" name="{{.}}" value="on"{{if index $.Profile.Show .}} checked{{end}}>{{.}}</label>
+{{end}}
+<button class="form-button" type="submit">Save</button>
+</form>
 </td></tr>
 
 <tr><td class="even" colspan="2">
@@ -1,5 +1,6 @@
 {{template "header.tpl" $}}
-<a class="rss" href="{{.PfxPath}}/{{.BasePath}}/rss">RSS</a>
+{{if .SearchForm}}{{template "search.tpl" $}}{{end}}
+{{if or .Search (not .SearchForm)}}<a class="rss" href="{{.PfxPath}}/{{.BasePath}}/rss{{feed_query .User}}">RSS</a>{{end}}
 {{template "pager.tpl" $}}
 <div id="topic">
 {{ range .Msg }}
@@ -36,6 +37,9 @@
 {{if $.User.Name}}
 <span class="reply"><a href="{{$.PfxPath}}/{{.MsgId}}/reply/new">Reply</a> :: </span>
 <span class="reply"><a href="{{$.PfxPath}}/{{.MsgId}}/reply">Quote</a></span>
+{{ if $.Bookmarks }}
+ :: <span class="reply">{{ if $.Bookmarks.Marked .MsgId }}<a href="{{$.PfxPath}}/unbookmark/{{.MsgId}}">Unbookmark</a>{{ else }}<a href="{{$.PfxPath}}/bookmark/{{.MsgId}}">Bookmark</a>{{ end }}</span>
+{{ end }}
 {{end}}
 {{ if msg_access . $.User }}
  :: <span class="reply"><a href="{{$.PfxPath}}/{{.MsgId}}/edit">Edit</a></span>
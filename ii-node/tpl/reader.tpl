@@ -0,0 +1,15 @@
+{{if .User.Name}}
+<div class="reader">
+{{if .Echo}}
+<a href="{{.PfxPath}}/unread/{{.Echo}}">Next unread</a> ::
+<a href="{{.PfxPath}}/markread/{{.Echo}}">Mark read</a> ::
+{{if (index .Reads .Echo).Sub}}<a href="{{.PfxPath}}/unsubscribe/{{.Echo}}">Unsubscribe</a>{{else}}<a href="{{.PfxPath}}/subscribe/{{.Echo}}">Subscribe</a>{{end}}
+{{else}}
+<a href="{{.PfxPath}}/unread">Next unread</a> ::
+<a href="{{.PfxPath}}/markread{{if and .Subs .AllEchoes}}?all=1{{end}}">Mark all read</a>
+{{if .Subs}} ::
+{{if .AllEchoes}}<a href="{{.PfxPath}}/">Subscribed</a>{{else}}<a href="{{.PfxPath}}/?all=1">All echoes</a>{{end}}
+{{end}}
+{{end}}
+</div>
+{{end}}
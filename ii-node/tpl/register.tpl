@@ -14,7 +14,15 @@
 <input type="text" name="email" class="email" placeholder="email">
 </td></tr>
 
-<tr class="even"><td class="links">
+{{with .Captcha}}
+<tr class="even"><td>
+<input type="hidden" name="captcha_id" value="{{.Id}}">
+{{if .Image}}<img src="/captcha/{{.Id}}" alt="captcha"><br>{{else}}{{.Question}}<br>{{end}}
+<input type="text" name="captcha" class="login" placeholder="captcha" autocomplete="off"><br>
+</td></tr>
+{{end}}
+
+<tr class="odd"><td class="links">
 <button class="form-button">Register</button>
 </td></tr>
 
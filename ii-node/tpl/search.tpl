@@ -0,0 +1,13 @@
+<div class="search">
+<form method="get" action="{{.PfxPath}}/search">
+<input type="text" name="q" class="search" value="{{.Search}}" placeholder="echo:name from:name to:name topics subj:word -word &quot;some words&quot;">
+<button class="form-button" type="submit">Search</button>
+</form>
+{{if and .Search .Bookmarks}}
+<form method="post" enctype="application/x-www-form-urlencoded" action="{{.PfxPath}}/bookmarks">
+<input type="hidden" name="q" value="{{.Search}}">
+<input type="text" name="name" class="login" placeholder="name">
+<button class="form-button" type="submit">Save search</button>
+</form>
+{{end}}
+</div>
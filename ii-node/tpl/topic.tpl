@@ -1,4 +1,5 @@
 {{template "header.tpl" $}}
+{{template "reader.tpl" $}}
 {{template "pager.tpl" $}}
 <div id="topic">
 {{ range .Msg }}
@@ -34,6 +35,12 @@
 {{if $.User.Name}}
 <span class="reply"><a href="{{$.PfxPath}}/{{.MsgId}}/reply/new">Reply</a> :: </span>
 <span class="reply"><a href="{{$.PfxPath}}/{{.MsgId}}/reply">Quote</a></span>
+{{ if ne .From $.User.Name }}
+ :: <span class="reply"><a href="{{$.PfxPath}}/pm/{{.From}}">PM</a></span>
+{{ end }}
+{{ if $.Bookmarks }}
+ :: <span class="reply">{{ if $.Bookmarks.Marked .MsgId }}<a href="{{$.PfxPath}}/unbookmark/{{.MsgId}}">Unbookmark</a>{{ else }}<a href="{{$.PfxPath}}/bookmark/{{.MsgId}}">Bookmark</a>{{ end }}</span>
+{{ end }}
 {{end}}
 {{ if msg_access . $.User }}
  :: <span class="reply"><a href="{{$.PfxPath}}/{{.MsgId}}/edit">Edit</a></span>
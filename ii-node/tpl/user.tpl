@@ -0,0 +1,71 @@
+{{template "header.tpl" $}}
+{{with .Profile}}
+{{if and (index .Show "avatar") (has_avatar .User.Name)}}<img class="avatar" src="/avatar/{{.User.Name}}">{{end}}
+<table id="profile" cellspacing=0 cellpadding=0>
+<tr class="odd"><td>Login:</td><td>{{.User.Name}}</td></tr>
+<tr class="even"><td>Addr:</td><td>{{.Addr}}</td></tr>
+{{if index .Show "joined"}}{{if .Joined}}
+<tr class="odd"><td>Joined:</td><td>{{.Joined | fdate}}</td></tr>
+{{end}}{{end}}
+{{if index .Show "country"}}{{if .Country}}
+<tr class="even"><td>Country:</td><td>{{.Country}}</td></tr>
+{{end}}{{end}}
+{{if index .Show "status"}}{{if .Status}}
+<tr class="odd"><td>Status:</td><td>{{.Status}}</td></tr>
+{{end}}{{end}}
+{{if index .Show "posts"}}
+<tr class="even"><td>Posts:</td><td>{{.Posts}}</td></tr>
+{{with .First}}
+<tr class="odd"><td>First post:</td><td><a href="{{$.PfxPath}}/{{.MsgId}}#{{.MsgId}}">{{.Date | fdate}}</a> in {{.Echo}}</td></tr>
+{{end}}
+{{with .Last}}
+<tr class="even"><td>Last post:</td><td><a href="{{$.PfxPath}}/{{.MsgId}}#{{.MsgId}}">{{.Date | fdate}}</a> in {{.Echo}}</td></tr>
+{{end}}
+{{end}}
+<tr class="odd"><td class="links" colspan="2"><a href="{{$.PfxPath}}/from/{{.User.Name}}">/from/{{.User.Name}}</a>
+{{if and $.User.Name (ne $.User.Name .User.Name)}} :: <a href="{{$.PfxPath}}/pm/{{.User.Name}}">Send private message</a>{{end}}
+</td></tr>
+</table>
+
+{{if index .Show "posts"}}{{if .Echoes}}
+<table id="echolist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Echo</th>
+<th class="extra">Topics</th>
+<th>Posts</th>
+</tr>
+{{range $k, $_ := .Echoes }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="echo"><a href="{{$.PfxPath}}/{{.Name}}/">{{.Name}}</a></td>
+<td class="topics extra">{{.Topics}}</td>
+<td class="count">{{.Count}}</td>
+</tr>
+{{ end }}
+</table>
+{{end}}{{end}}
+
+{{if index .Show "topics"}}{{if .Topics}}
+<table id="echolist" cellspacing=0 cellpadding=0>
+<tr class="title">
+<th>Recent topics</th>
+<th>Date</th>
+</tr>
+{{range $k, $_ := .Topics }}
+{{ if is_even $k }}
+<tr class="even">
+{{ else }}
+<tr class="odd">
+{{ end }}
+<td class="echo"><a href="{{$.PfxPath}}/{{.MsgId}}">{{.Subj}}</a><br>
+<span class="info">{{.Echo}}</span></td>
+<td class="info">{{.Date | fdate}}</td>
+</tr>
+{{ end }}
+</table>
+{{end}}{{end}}
+{{end}}
+{{template "footer.tpl"}}
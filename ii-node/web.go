@@ -1,23 +1,24 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hugeping/ii-go/ii"
 	"html/template"
 	"image"
 	"image/png"
-	"io/ioutil"
 	"math"
-	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,29 +26,52 @@ const PAGE_SIZE = 50
 const PAGER_RANGE = 10
 
 type WebContext struct {
-	Echoes   []*ii.Echo
-	Topics   []*Topic
-	Topic    string
-	Msg      []*ii.Msg
-	Error    string
-	Echo     string
-	PfxPath  string
-	Page     int
-	Pages    int
-	Pager    []int
-	BasePath string
-	User     *ii.User
-	Admin    *ii.User
-	Echolist *ii.EDB
-	Users    *ii.UDB
-	Selected string
-	Template string
-	Ref      string
-	Info     string
-	Sysname  string
-	Host     string
-	www      *WWW
-	Ip       string
+	Echoes        []*ii.Echo
+	Topics        []*Topic
+	Topic         string
+	Msg           []*ii.Msg
+	Error         string
+	Echo          string
+	PfxPath       string
+	Page          int
+	Pages         int
+	Pager         []int
+	BasePath      string
+	User          *ii.User
+	Admin         *ii.User
+	Echolist      *ii.EDB
+	Users         *ii.UDB
+	Selected      string
+	Template      string
+	Ref           string
+	Info          string
+	Sysname       string
+	Host          string
+	www           *WWW
+	Ip            string
+	Captcha       *Challenge
+	Profile       *UserProfile
+	Killfile      *ii.Killfile
+	Hidden        int
+	ShowHidden    bool
+	Reads         map[string]ii.ReadPos
+	Unread        map[string]int
+	Subs          []string
+	AllEchoes     bool
+	Bookmarks     *ii.Bookmarks
+	Search        string
+	SearchForm    bool
+	To            string
+	Inbox         int
+	Conversations []*Conversation
+	Notifications *ii.Notifications
+	Notify        int
+	Notices       []*Notice
+	Pending       int
+	Audit         []ii.AuditEntry
+	Areas         []*ii.EchoArea
+	AuditFilter   *ii.AuditFilter
+	Peers         []PeerStatus
 }
 
 func www_register_locked(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
@@ -60,7 +84,6 @@ func www_register_locked(ctx *WebContext, w http.ResponseWriter, r *http.Request
 	default:
 		return nil
 	}
-	return nil
 }
 
 func www_register_verify(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
@@ -73,87 +96,6 @@ func www_register_verify(ctx *WebContext, w http.ResponseWriter, r *http.Request
 	default:
 		return nil
 	}
-	return nil
-}
-
-func Whois(domain string) (result string) {
-	var server string
-	result, err := whois_query(domain, "whois.iana.org:43")
-	if err != nil {
-		return ""
-	}
-	server = getServer(result)
-	if server == "" {
-		return ""
-	}
-	result, err = whois_query(domain, server+":43")
-	if err != nil {
-		return
-	}
-	refServer := getServer(result)
-	if refServer == "" || refServer == server {
-		return
-	}
-	data, err := whois_query(domain, refServer)
-	if err == nil {
-		result += data
-	}
-	return
-}
-
-// getServer returns server from whois data
-func getServer(data string) string {
-	tokens := []string{
-		"Registrar WHOIS Server: ",
-		"whois: ",
-	}
-
-	for _, token := range tokens {
-		start := strings.Index(data, token)
-		if start != -1 {
-			start += len(token)
-			end := strings.Index(data[start:], "\n")
-			return strings.TrimSpace(data[start : start+end])
-		}
-	}
-
-	return ""
-}
-
-func whois_query(domain, server string) (string, error) {
-	conn, err := net.DialTimeout("tcp", server, time.Second*10)
-	if err != nil {
-		return "", fmt.Errorf("whois: connect to whois server failed: %v", err)
-	}
-	defer conn.Close()
-	_, err = conn.Write([]byte(domain + "\r\n"))
-	if err != nil {
-		return "", fmt.Errorf("whois: send to whois server failed: %v", err)
-	}
-	buffer, err := ioutil.ReadAll(conn)
-	if err != nil {
-		return "", fmt.Errorf("whois: read from whois server failed: %v", err)
-	}
-	return string(buffer), nil
-}
-
-func getHostCountry(ip string) string {
-	if strings.TrimSpace(ip) == "" {
-		return "us"
-	}
-	pos := strings.Index(ip, "_")
-	if pos != -1 {
-		ip = ip[:pos]
-	}
-	text := Whois(ip)
-	scanner := bufio.NewScanner(strings.NewReader(text))
-	for scanner.Scan() {
-		a := strings.Split(scanner.Text(), ":")
-		if a[0] == "country" {
-			return strings.ToLower(strings.TrimSpace(a[1]))
-		}
-	}
-	return "us"
 }
 
 func www_register(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
@@ -161,6 +103,7 @@ func www_register(ctx *WebContext, w http.ResponseWriter, r *http.Request) error
 	switch r.Method {
 	case "GET":
 		ctx.Template = "register.tpl"
+		ctx.Captcha = ctx.www.cap.New(ctx.Ip)
 		err := ctx.www.tpl.ExecuteTemplate(w, "register.tpl", ctx)
 		return err
 	case "POST":
@@ -178,18 +121,25 @@ func www_register(ctx *WebContext, w http.ResponseWriter, r *http.Request) error
 				return errors.New("Access denied")
 			}
 			password := r.FormValue("password")
-			u.Secret = ii.MakeSecret(u.Name + password)
-			if err := udb.Edit(u); err != nil {
+			if err := udb.Passwd(u.Name, password); err != nil {
 				ii.Info.Printf("Can not edit user %s: %s", ctx.User.Name, err)
 				return err
 			}
 			http.Redirect(w, r, ctx.PfxPath+"/login", http.StatusSeeOther)
 			return nil
 		}
+		if !ctx.www.cap.Check(r.FormValue("captcha_id"), r.FormValue("captcha")) {
+			ii.Info.Printf("Wrong captcha from %s", ctx.Ip)
+			return errors.New("Wrong captcha")
+		}
+		if err := ctx.www.rlim.Hit(ctx.Ip); err != nil {
+			ii.Info.Printf("Registration from %s: %s", ctx.Ip, err)
+			return err
+		}
 		user := r.FormValue("username")
 		password := r.FormValue("password")
 		email := r.FormValue("email")
-		country := getHostCountry(ctx.Ip)
+		country := getHostCountry(ctx.www.geo, remote_ip(r, ctx.www.prx))
 		info := udb.UserStatus(user, email, country)
 		if info == "honeypot" {
 			return www_register_verify(ctx, w, r)
@@ -254,12 +204,135 @@ func www_points(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	return err
 }
 
+// Public profile of user.
+// Show: fields visible for current reader (see ProfileFields).
+// Echoes: number of posts per echo.
+// First, Last: first and last posts.
+// Topics: recent topics started by user.
+type UserProfile struct {
+	User    *ii.User
+	Addr    string
+	Country string
+	Status  string
+	Joined  int64
+	Show    map[string]bool
+	Posts   int
+	Echoes  []*ii.Echo
+	First   *ii.Msg
+	Last    *ii.Msg
+	Topics  []*ii.Msg
+}
+
+// Fields of public profile, user can hide them with "public" tag.
+// The value of tag is comma separated list of visible fields
+// or "none".
+var ProfileFields = []string{"avatar", "country", "status", "joined", "posts", "topics"}
+
+const PROFILE_PUBLIC = "avatar,joined,posts,topics"
+const PROFILE_TOPICS = 10
+
+func profile_public(u *ii.User) map[string]bool {
+	show := make(map[string]bool)
+	public, ok := u.Tags.Get("public")
+	if !ok {
+		public = PROFILE_PUBLIC
+	}
+	for _, f := range strings.Split(public, ",") {
+		show[f] = true
+	}
+	return show
+}
+
+func user_profile(ctx *WebContext, u *ii.User) *UserProfile {
+	db := ctx.www.db
+	p := &UserProfile{User: u, Addr: db.Addr(u)}
+	p.Show = profile_public(u)
+	if ctx.User.Id == u.Id || ctx.User.Id == 1 {
+		for _, f := range ProfileFields {
+			p.Show[f] = true
+		}
+	}
+	info, _ := u.Tags.Get("info")
+	if i := strings.LastIndex(info, ","); i >= 0 {
+		p.Country = info[i+1:]
+	}
+	p.Status, _ = u.Tags.Get("status")
+	if reg, ok := u.Tags.Get("reg"); ok {
+		p.Joined, _ = strconv.ParseInt(reg, 10, 64)
+	}
+	mis := db.LookupIDS(Select(ctx, &ii.Query{From: u.Name}))
+	p.Posts = len(mis)
+	echoes := make(map[string]*ii.Echo)
+	for _, mi := range mis {
+		e, ok := echoes[mi.Echo]
+		if !ok {
+			e = &ii.Echo{Name: mi.Echo}
+			echoes[mi.Echo] = e
+			p.Echoes = append(p.Echoes, e)
+		}
+		e.Count++
+		if mi.Repto == "" {
+			e.Topics++
+		}
+	}
+	sort.SliceStable(p.Echoes, func(i, j int) bool {
+		return p.Echoes[i].Count > p.Echoes[j].Count
+	})
+	if len(mis) > 0 {
+		p.First = db.GetFast(mis[0].Id)
+		p.Last = db.GetFast(mis[len(mis)-1].Id)
+	}
+	for i := len(mis) - 1; i >= 0 && len(p.Topics) < PROFILE_TOPICS; i-- {
+		if mis[i].Repto != "" {
+			continue
+		}
+		if m := db.GetFast(mis[i].Id); m != nil {
+			p.Topics = append(p.Topics, m)
+		}
+	}
+	return p
+}
+
+func www_user(ctx *WebContext, w http.ResponseWriter, r *http.Request, name string) error {
+	ii.Trace.Printf("www user: %s", name)
+	u := ctx.www.udb.UserInfoName(name)
+	if u == nil {
+		return errors.New("No such user")
+	}
+	ctx.Profile = user_profile(ctx, u)
+	ctx.Template = "user.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "user.tpl", ctx)
+}
+
 func www_profile(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	ii.Trace.Printf("www profile")
 	if ctx.User.Name == "" {
 		ii.Error.Printf("Access denied")
 		return errors.New("Access denied")
 	}
+	if r.Method == "POST" { /* public fields */
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		var public []string
+		for _, f := range ProfileFields {
+			if r.FormValue(f) != "" {
+				public = append(public, f)
+			}
+		}
+		if len(public) == 0 {
+			public = append(public, "none")
+		}
+		if err := ctx.www.udb.SetTag(ctx.User.Name, "public",
+			strings.Join(public, ",")); err != nil {
+			ii.Error.Printf("Can not save profile %s: %s", ctx.User.Name, err)
+			return err
+		}
+		http.Redirect(w, r, ctx.PfxPath+"/profile", http.StatusSeeOther)
+		return nil
+	}
+	ctx.Profile = &UserProfile{User: ctx.User, Show: profile_public(ctx.User)}
 	ctx.Selected = fmt.Sprintf("%s,%d", ctx.www.db.Name, ctx.User.Id)
 	ava, _ := ctx.User.Tags.Get("avatar")
 	if ava != "" {
@@ -272,6 +345,858 @@ func www_profile(ctx *WebContext, w http.ResponseWriter, r *http.Request) error
 	return err
 }
 
+// Killfile editor.
+// /killfile: list of rules and form to add new one (POST);
+// /killfile/del?kind=...&value=...: remove rule;
+// /killfile/show, /killfile/hide: show or hide killed messages.
+func www_killfile(ctx *WebContext, w http.ResponseWriter, r *http.Request, args []string) error {
+	ii.Trace.Printf("www killfile")
+	if ctx.User.Name == "" || ctx.www.kdb == nil {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	kdb := ctx.www.kdb
+	action := ""
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "show", "hide":
+		http.SetCookie(w, &http.Cookie{Name: "killfile", Value: action, Path: "/"})
+		ref := ctx.Ref
+		if ref == "" {
+			ref = ctx.PfxPath + "/"
+		}
+		http.Redirect(w, r, ref, http.StatusSeeOther)
+		return nil
+	case "del":
+		q := r.URL.Query()
+		if err := kdb.Del(ctx.User.Id, q.Get("kind"), q.Get("value")); err != nil {
+			return err
+		}
+		http.Redirect(w, r, ctx.PfxPath+"/killfile", http.StatusSeeOther)
+		return nil
+	case "":
+	default:
+		return errors.New("Wrong request")
+	}
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		kind := r.FormValue("kind")
+		value := strings.TrimSpace(r.FormValue("value"))
+		if err := kdb.Add(ctx.User.Id, kind, value); err != nil {
+			ii.Info.Printf("Can not add killfile rule for %s: %s", ctx.User.Name, err)
+			return err
+		}
+		http.Redirect(w, r, ctx.PfxPath+"/killfile", http.StatusSeeOther)
+		return nil
+	}
+	ctx.Killfile = kdb.Get(ctx.User.Id)
+	ctx.Template = "killfile.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "killfile.tpl", ctx)
+}
+
+// Reading of echoes by logged in user.
+// /unread[/echo]: go to next unread message (in echo or subscribed echoes);
+// /markread[/echo]: mark echo (or echoes on index page) as read;
+// /subscribe/echo, /unsubscribe/echo: change subscription.
+func www_reader(ctx *WebContext, w http.ResponseWriter, r *http.Request, action string, echo string) error {
+	ii.Trace.Printf("www %s: %s", action, echo)
+	if ctx.User.Name == "" || ctx.www.rdb == nil {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	if echo != "" && !ii.IsEcho(echo) {
+		return errors.New("Wrong echo name")
+	}
+	db := ctx.www.db
+	rdb := ctx.www.rdb
+	id := ctx.User.Id
+	back := ctx.Ref
+	if back == "" {
+		back = ctx.PfxPath + "/"
+	}
+	switch action {
+	case "subscribe", "unsubscribe":
+		if echo == "" {
+			return errors.New("Wrong request")
+		}
+		if err := rdb.Subscribe(id, echo, action == "subscribe"); err != nil {
+			return err
+		}
+	case "markread":
+		var echoes []*ii.Echo
+		if echo != "" {
+			echoes = db.Echoes([]string{echo}, &ii.Query{User: *ctx.User})
+		} else {
+			echoes = index_echoes(ctx, r)
+		}
+		for _, e := range echoes {
+			if err := rdb.MarkRead(id, e.Name, e.Last.Num); err != nil {
+				return err
+			}
+		}
+	case "unread":
+		echoes := make(map[string]bool)
+		if echo != "" {
+			echoes[echo] = true
+		} else {
+			for _, e := range ctx.Subs {
+				echoes[e] = true
+			}
+		}
+		all := len(echoes) == 0
+		ids := Select(ctx, &ii.Query{Lim: 1, Match: func(mi *ii.MsgInfo, q *ii.Query) bool {
+			return (all || echoes[mi.Echo]) && ctx.Reads[mi.Echo].Unread(mi)
+		}})
+		if len(ids) == 0 {
+			break
+		}
+		mi := db.Lookup(ids[0])
+		if mi == nil {
+			break
+		}
+		if err := rdb.MarkRead(id, mi.Echo, mi.Num); err != nil {
+			return err
+		}
+		back = ctx.PfxPath + "/" + mi.Id + "#" + mi.Id
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+	return nil
+}
+
+// Search messages with search language (see ii.ParseSearch).
+// /search?q=query redirects to /search/<escaped query>.
+// Searches of anonymous users are limited by ip.
+func www_search(ctx *WebContext, w http.ResponseWriter, r *http.Request, args []string) error {
+	ctx.SearchForm = true
+	if q := strings.TrimSpace(r.FormValue("q")); q != "" {
+		http.Redirect(w, r, ctx.PfxPath+"/search/"+url.PathEscape(q), http.StatusSeeOther)
+		return nil
+	}
+	if len(args) < 2 || args[1] == "" {
+		ctx.BasePath = "search"
+		ctx.Template = "query.tpl"
+		return ctx.www.tpl.ExecuteTemplate(w, "query.tpl", ctx)
+	}
+	query, err := url.PathUnescape(args[1])
+	if err != nil {
+		return err
+	}
+	rss := false
+	page := 0
+	if err := parseQueryArgs(args, ctx, &page, &rss); err != nil {
+		return err
+	}
+	q, err := ctx.www.db.ParseSearch(query)
+	if err != nil {
+		return err
+	}
+	if ctx.User.Id == 0 {
+		if err := ctx.www.slim.Hit(ctx.Ip); err != nil {
+			ii.Info.Printf("Search from %s: %s", ctx.Ip, err)
+			return err
+		}
+	}
+	ctx.Search = query
+	ctx.BasePath = "search/" + url.PathEscape(query)
+	return www_query(ctx, w, r, q, page, rss)
+}
+
+// Bookmarks and saved searches of user.
+// /bookmark/<msgid>, /unbookmark/<msgid>: change bookmark;
+// /bookmarks: list (POST: save or delete search);
+// /bookmarks/search/<name>[/page|rss]: results of saved search;
+// /bookmarks/export: all bookmarks in JSON.
+func www_bookmarks(ctx *WebContext, w http.ResponseWriter, r *http.Request, args []string) error {
+	ii.Trace.Printf("www bookmarks: %s", args)
+	if ctx.User.Name == "" || ctx.www.bdb == nil {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	bdb := ctx.www.bdb
+	id := ctx.User.Id
+	switch args[0] {
+	case "bookmark", "unbookmark":
+		if len(args) < 2 || ctx.www.db.GetAccess(args[1], ctx.User) == nil {
+			return errors.New("No such message")
+		}
+		var err error
+		if args[0] == "bookmark" {
+			err = bdb.AddMsg(id, args[1])
+		} else {
+			err = bdb.DelMsg(id, args[1])
+		}
+		if err != nil {
+			return err
+		}
+		back := ctx.Ref
+		if back == "" {
+			back = ctx.PfxPath + "/bookmarks"
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return nil
+	}
+	ctx.BasePath = "bookmarks"
+	if len(args) > 1 && args[1] == "export" {
+		return www_bookmarks_export(ctx, w)
+	}
+	if len(args) > 2 && args[1] == "search" {
+		s := ctx.Bookmarks.Search(args[2])
+		if s == nil {
+			return errors.New("No such search")
+		}
+		rss := false
+		page := 0
+		if err := parseQueryArgs(args[1:], ctx, &page, &rss); err != nil {
+			return err
+		}
+		q, err := ctx.www.db.ParseSearch(s.Query)
+		if err != nil {
+			return err
+		}
+		ctx.Search = s.Query
+		ctx.BasePath = "bookmarks/search/" + args[2]
+		return www_query(ctx, w, r, q, page, rss)
+	}
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		var err error
+		name := strings.TrimSpace(r.FormValue("name"))
+		if r.FormValue("action") == "delete" {
+			err = bdb.DelSearch(id, name)
+		} else if _, err = ctx.www.db.ParseSearch(r.FormValue("q")); err == nil {
+			err = bdb.AddSearch(id, name, r.FormValue("q"))
+		}
+		if err != nil {
+			ii.Info.Printf("Can not change search for %s: %s", ctx.User.Name, err)
+			return err
+		}
+		http.Redirect(w, r, ctx.PfxPath+"/bookmarks", http.StatusSeeOther)
+		return nil
+	}
+	for _, v := range ctx.Bookmarks.Msgs {
+		if m := ctx.www.db.GetAccess(v, ctx.User); m != nil {
+			ctx.Msg = append(ctx.Msg, m)
+		}
+	}
+	ctx.Template = "bookmarks.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "bookmarks.tpl", ctx)
+}
+
+func www_bookmarks_export(ctx *WebContext, w http.ResponseWriter) error {
+	type bookmark struct {
+		Id   string `json:"id"`
+		Echo string `json:"echo"`
+		Subj string `json:"subj"`
+		From string `json:"from"`
+		Date int64  `json:"date"`
+	}
+	type search struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	var export struct {
+		Bookmarks []bookmark `json:"bookmarks"`
+		Searches  []search   `json:"searches"`
+	}
+	export.Bookmarks = []bookmark{}
+	export.Searches = []search{}
+	for _, v := range ctx.Bookmarks.Msgs {
+		b := bookmark{Id: v}
+		if m := ctx.www.db.GetAccess(v, ctx.User); m != nil {
+			b.Echo, b.Subj, b.From, b.Date = m.Echo, m.Subj, m.From, m.Date
+		}
+		export.Bookmarks = append(export.Bookmarks, b)
+	}
+	for _, v := range ctx.Bookmarks.Searches {
+		export.Searches = append(export.Searches, search{Name: v.Name, Query: v.Query})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=bookmarks.json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+// Private conversation of user: thread in private area.
+// With: other side of conversation (by last message).
+// Unread: number of unread messages to user.
+type Conversation struct {
+	Ids    []string
+	Count  int
+	With   string
+	Unread int
+	Last   *ii.MsgInfo
+	Head   *ii.Msg
+	Tail   *ii.Msg
+}
+
+// Private area for new private messages: first
+// writable private area in echolist.
+func pm_echo(edb *ii.EDB) string {
+	for _, e := range edb.List {
+		if ii.IsPrivate(e) && edb.Perm[e] != nil && edb.Perm[e].Write {
+			return e
+		}
+	}
+	return ""
+}
+
+// Check if private message is addressed to user and is not read.
+func pm_unread(ctx *WebContext, mi *ii.MsgInfo) bool {
+	return ii.IsPrivate(mi.Echo) && mi.To == ctx.User.Name &&
+		mi.From != ctx.User.Name && ctx.Reads[mi.Echo].Unread(mi)
+}
+
+// Cached counts of unread private messages by user id.
+// Count is valid while key (size of index, read positions
+// in private areas and killfile of user) is the same.
+type pmCache struct {
+	sync.Mutex
+	users map[int32]pmCount
+}
+
+type pmCount struct {
+	key   string
+	count int
+}
+
+// Key of cached count of unread private messages of user.
+func pm_key(ctx *WebContext) string {
+	var size int64
+	if fi, err := os.Stat(ctx.www.db.IndexPath()); err == nil {
+		size = fi.Size()
+	}
+	key := fmt.Sprint(size)
+	var echoes []string
+	for e := range ctx.Reads {
+		if ii.IsPrivate(e) {
+			echoes = append(echoes, e)
+		}
+	}
+	sort.Strings(echoes)
+	for _, e := range echoes {
+		key += fmt.Sprintf(" %s:%v", e, ctx.Reads[e])
+	}
+	if ctx.Killfile != nil {
+		for _, r := range ctx.Killfile.Rules {
+			key += fmt.Sprintf(" %s:%s", r.Kind, r.Value)
+		}
+	}
+	return key
+}
+
+// Count unread private messages of user (ctx.Inbox).
+// Killed messages are not counted. Count is cached until new
+// messages are stored or read state or killfile is changed.
+func pm_count(ctx *WebContext) {
+	db := ctx.www.db
+	cache := &ctx.www.pms
+	key := pm_key(ctx)
+	cache.Lock()
+	c, ok := cache.users[ctx.User.Id]
+	cache.Unlock()
+	if ok && c.key == key {
+		ctx.Inbox = c.count
+		return
+	}
+	ctx.Inbox = len(db.SelectIDS(&ii.Query{User: *ctx.User,
+		Match: func(mi *ii.MsgInfo, q *ii.Query) bool {
+			return pm_unread(ctx, mi) && (ctx.Killfile == nil ||
+				!ctx.Killfile.Killed(db, mi))
+		}}))
+	cache.Lock()
+	if cache.users == nil {
+		cache.users = make(map[int32]pmCount)
+	}
+	cache.users[ctx.User.Id] = pmCount{key: key, count: ctx.Inbox}
+	cache.Unlock()
+}
+
+// Mark private messages to user in echo as read after they were shown.
+// Messages are marked as read out of order, then read position is moved
+// to the first unread message of user in echo.
+func pm_markread(ctx *WebContext, echo string, shown []*ii.Msg) error {
+	db := ctx.www.db
+	rdb := ctx.www.rdb
+	var nums []int
+	for _, m := range shown {
+		if mi := db.Lookup(m.MsgId); mi != nil && pm_unread(ctx, mi) {
+			nums = append(nums, mi.Num)
+		}
+	}
+	if len(nums) == 0 {
+		return nil
+	}
+	if err := rdb.MarkSeen(ctx.User.Id, echo, nums); err != nil {
+		return err
+	}
+	ctx.Reads = rdb.Get(ctx.User.Id)
+	num := -1
+	ids := db.SelectIDS(&ii.Query{Echo: echo, User: *ctx.User, Lim: 1,
+		Match: func(mi *ii.MsgInfo, q *ii.Query) bool {
+			if mi.Num > num {
+				num = mi.Num
+			}
+			return pm_unread(ctx, mi)
+		}})
+	if len(ids) > 0 {
+		if mi := db.Lookup(ids[0]); mi != nil {
+			num = mi.Num - 1
+		}
+	}
+	if err := rdb.MarkRead(ctx.User.Id, echo, num); err != nil {
+		return err
+	}
+	ctx.Reads = rdb.Get(ctx.User.Id)
+	pm_count(ctx)
+	return nil
+}
+
+// Private messages of user.
+// /inbox[/page]: conversations with messages to user;
+// /outbox[/page]: conversations with messages from user;
+// /pm/<name>: new private message to user.
+func www_pm(ctx *WebContext, w http.ResponseWriter, r *http.Request, args []string) error {
+	ii.Trace.Printf("www pm: %s", args)
+	if ctx.User.Name == "" {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	db := ctx.www.db
+	name := ctx.User.Name
+	if args[0] == "pm" {
+		if len(args) < 2 || args[1] == "" || args[1] == "All" {
+			return errors.New("Wrong request")
+		}
+		ctx.Echo = pm_echo(ctx.Echolist)
+		if ctx.Echo == "" {
+			return errors.New("No private areas")
+		}
+		ctx.To = args[1]
+		ctx.Template = "new.tpl"
+		return ctx.www.tpl.ExecuteTemplate(w, "new.tpl", ctx)
+	}
+	page := 1
+	if len(args) > 1 {
+		fmt.Sscanf(args[1], "%d", &page)
+	}
+	ctx.BasePath = args[0]
+	inbox := args[0] == "inbox"
+	mis := db.LookupIDS(Select(ctx, &ii.Query{Match: func(mi *ii.MsgInfo, q *ii.Query) bool {
+		return ii.IsPrivate(mi.Echo) && (mi.To == name || mi.From == name)
+	}}))
+	visible := make(map[string]*ii.MsgInfo)
+	for _, mi := range mis {
+		visible[mi.Id] = mi
+	}
+	var list []*Conversation
+	for _, t := range db.GetTopics(mis) {
+		c := Conversation{}
+		mine := false
+		for _, id := range t {
+			mi := visible[id]
+			if mi == nil { /* parent without access */
+				continue
+			}
+			if (inbox && mi.To == name && mi.From != name) ||
+				(!inbox && mi.From == name) {
+				mine = true
+			}
+			if pm_unread(ctx, mi) {
+				c.Unread++
+			}
+			c.Ids = append(c.Ids, id)
+			c.Last = mi
+		}
+		if !mine {
+			continue
+		}
+		c.Count = len(c.Ids) - 1
+		c.With = c.Last.From
+		if c.With == name {
+			c.With = c.Last.To
+		}
+		list = append(list, &c)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Last.Num > list[j].Last.Num
+	})
+	start := makePager(ctx, len(list), page)
+	for i := start; i < len(list) && i < start+PAGE_SIZE; i++ {
+		c := list[i]
+		c.Head = db.GetFast(c.Ids[0])
+		c.Tail = db.GetFast(c.Ids[c.Count])
+		if c.Head == nil || c.Tail == nil {
+			ii.Error.Printf("Skip wrong message: %s\n", c.Ids[0])
+			continue
+		}
+		ctx.Conversations = append(ctx.Conversations, c)
+	}
+	ctx.Template = "pm.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "pm.tpl", ctx)
+}
+
+// Notification in web view.
+type Notice struct {
+	Kind string
+	Msg  *ii.Msg
+	New  bool
+}
+
+// Notifications of user.
+// /notifications: list of notifications, all are marked as read;
+// POST /notifications: change preferences.
+func www_notifications(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
+	ii.Trace.Printf("www notifications")
+	if ctx.User.Name == "" || ctx.www.ndb == nil {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	db := ctx.www.db
+	ndb := ctx.www.ndb
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		prefs := ii.NotifyPrefs{Email: r.FormValue("email") != "",
+			Webhook: strings.TrimSpace(r.FormValue("webhook"))}
+		for _, k := range ii.NotifyKinds {
+			if r.FormValue(k) != "" {
+				prefs.Kinds = append(prefs.Kinds, k)
+			}
+		}
+		if err := ndb.SetPrefs(ctx.User.Id, prefs); err != nil {
+			ii.Info.Printf("Can not change notifications for %s: %s", ctx.User.Name, err)
+			return err
+		}
+		http.Redirect(w, r, ctx.PfxPath+"/notifications", http.StatusSeeOther)
+		return nil
+	}
+	n := ctx.Notifications
+	for i := len(n.List) - 1; i >= 0; i-- {
+		v := n.List[i]
+		mi := db.Lookup(v.MsgId)
+		if mi == nil || !db.Access(mi, ctx.User) ||
+			(ctx.Killfile != nil && killed(ctx, mi)) {
+			continue
+		}
+		if m := db.GetAccess(v.MsgId, ctx.User); m != nil {
+			ctx.Notices = append(ctx.Notices, &Notice{Kind: v.Kind, Msg: m,
+				New: v.Date > n.Read})
+		}
+	}
+	if n.Unread() > 0 {
+		if err := ndb.MarkRead(ctx.User.Id); err != nil {
+			return err
+		}
+		ctx.Notify = 0
+	}
+	ctx.Template = "notifications.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "notifications.tpl", ctx)
+}
+
+// Check if user can moderate messages in echo: admin or point
+// allowed to create topics in echo (! in echolist).
+func moderator(www *WWW, user *ii.User, echo string) bool {
+	if user.Id == 1 {
+		return true
+	}
+	perm := www.edb.Snapshot().Perm[echo]
+	if user.Id == 0 || perm == nil {
+		return false
+	}
+	addr := www.db.Addr(user)
+	for _, v := range perm.Allow {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Ids of messages in premoderation queue which user can moderate.
+func pending_ids(www *WWW, user *ii.User) []string {
+	var ids []string
+	if www.pdb == nil || user.Id == 0 {
+		return ids
+	}
+	for _, mi := range www.pdb.LookupIDS(www.pdb.SelectIDS(&ii.Query{})) {
+		if moderator(www, user, mi.Echo) {
+			ids = append(ids, mi.Id)
+		}
+	}
+	return ids
+}
+
+// Publish message from premoderation queue with original date
+// and notify author (if it is local point).
+func approve(www *WWW, m *ii.Msg) error {
+	var err error
+	m.Tags.Del("spam")
+	m.Tags.Del("rule")
+	if www.db.Lookup(m.MsgId) != nil { /* edit of published message */
+		err = www.db.Edit(m)
+	} else {
+		err = www.db.Store(m)
+	}
+	if err != nil {
+		return err
+	}
+	if u := www.udb.UserInfoName(m.From); u != nil && www.nfy != nil &&
+		www.db.Addr(u) == m.Addr {
+		if err := www.nfy.Send(u, "approved", m); err != nil {
+			ii.Error.Printf("Can not notify %s: %s", u.Name, err)
+		}
+	}
+	return nil
+}
+
+// Premoderation queue.
+// /moderation: messages waiting for moderation;
+// POST /moderation: approve, save (edit) or reject message with id.
+// Approved and rejected messages are removed from queue
+// (blacklisted in pending database).
+// POST /moderation with action retrain: admin retrains spam filter
+// (rejected messages are spam too).
+func www_moderation(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
+	ii.Trace.Printf("www moderation")
+	if ctx.User.Name == "" || ctx.www.pdb == nil {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	pdb := ctx.www.pdb
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		if r.FormValue("action") == "retrain" {
+			if ctx.User.Id != 1 || ctx.www.spam == nil {
+				ii.Error.Printf("Access denied")
+				return errors.New("Access denied")
+			}
+			if err := ctx.www.spam.Train(ctx.www.db, pdb); err != nil {
+				ii.Error.Printf("Can not train spam filter: %s", err)
+				return err
+			}
+			s := ctx.www.spam
+			audit(ctx, "spam/train", "", "", fmt.Sprintf("%d:%d", s.Spam, s.Ham))
+			http.Redirect(w, r, ctx.PfxPath+"/moderation", http.StatusSeeOther)
+			return nil
+		}
+		id := r.FormValue("id")
+		m := pdb.Get(id)
+		if m == nil || pdb.Lookup(id).Off < 0 {
+			return errors.New("No such message")
+		}
+		if !moderator(ctx.www, ctx.User, m.Echo) {
+			ii.Error.Printf("Access denied")
+			return errors.New("Access denied")
+		}
+		before := m.String()
+		action := r.FormValue("action")
+		if action != "reject" {
+			m.To = r.FormValue("to")
+			m.Subj = r.FormValue("subj")
+			m.Text = msg_clean(r.FormValue("msg"))
+		}
+		var err error
+		switch action {
+		case "save":
+			err = pdb.Edit(m)
+		case "approve":
+			if err = approve(ctx.www, m); err == nil {
+				m.Tags.Add("moderation/approved")
+				err = pdb.Blacklist(m)
+			}
+		case "reject":
+			m.Tags.Add("moderation/rejected")
+			err = pdb.Blacklist(m)
+		default:
+			err = errors.New("Wrong action")
+		}
+		if err != nil {
+			ii.Error.Printf("Can not %s %s: %s", action, id, err)
+			return err
+		}
+		ii.Info.Printf("Moderation: %s %s by %s", action, id, ctx.User.Name)
+		after := m.String()
+		if action == "reject" {
+			after = ""
+		}
+		audit(ctx, "moderation/"+action, id, before, after)
+		http.Redirect(w, r, ctx.PfxPath+"/moderation", http.StatusSeeOther)
+		return nil
+	}
+	for _, id := range pending_ids(ctx.www, ctx.User) {
+		if m := pdb.Get(id); m != nil {
+			ctx.Msg = append(ctx.Msg, m)
+		}
+	}
+	ctx.Template = "moderation.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "moderation.tpl", ctx)
+}
+
+// Audit log for admin (newest entries first).
+// /audit[/page]: all entries;
+// /audit?who=&action=&target=: entries matched by filter (not paged).
+func www_audit(ctx *WebContext, w http.ResponseWriter, r *http.Request, args []string) error {
+	ii.Trace.Printf("www audit: %s", args)
+	if ctx.User.Id != 1 || ctx.www.adb == nil {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	page := 1
+	if len(args) > 1 {
+		fmt.Sscanf(args[1], "%d", &page)
+	}
+	ctx.BasePath = "audit"
+	f := &ii.AuditFilter{Who: r.FormValue("who"),
+		Action: r.FormValue("action"), Target: r.FormValue("target")}
+	list, err := ctx.www.adb.Select(f)
+	if err != nil {
+		ii.Error.Printf("Can not read audit log: %s", err)
+		return err
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	if f.Who == "" && f.Action == "" && f.Target == "" {
+		start := makePager(ctx, len(list), page)
+		list = list[start:]
+		if len(list) > PAGE_SIZE {
+			list = list[:PAGE_SIZE]
+		}
+	}
+	ctx.Audit = list
+	ctx.AuditFilter = f
+	ctx.Template = "audit.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "audit.tpl", ctx)
+}
+
+// Status of sync with peers for admin.
+// /peers: status of peers;
+// POST /peers with url: sync with peer now.
+func www_peers(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
+	ii.Trace.Printf("www peers")
+	if ctx.User.Id != 1 {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		if err := ctx.www.sync.SyncNow(r.FormValue("url")); err != nil {
+			return err
+		}
+		audit(ctx, "peer/sync", "", "", r.FormValue("url"))
+		http.Redirect(w, r, ctx.PfxPath+"/peers", http.StatusSeeOther)
+		return nil
+	}
+	ctx.Peers = ctx.www.sync.Status()
+	ctx.Template = "peers.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "peers.tpl", ctx)
+}
+
+// Line of echolist for echo or "" if there is no such echo.
+func echo_line(edb *ii.EDB, name string) string {
+	for _, e := range edb.Areas() {
+		if e.Name == name {
+			return e.String()
+		}
+	}
+	return ""
+}
+
+// Administration of echo areas (echolist).
+// /echoes: echoes in order of echolist;
+// POST /echoes: save (desc, write, allow, read fields), add,
+// archive, move (to pos), up, down or remove echo with name.
+func www_echoes(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
+	ii.Trace.Printf("www echoes")
+	if ctx.User.Id != 1 {
+		ii.Error.Printf("Access denied")
+		return errors.New("Access denied")
+	}
+	edb := ctx.www.edb
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			ii.Error.Printf("Error in POST request: %s", err)
+			return err
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		action := r.FormValue("action")
+		before := echo_line(edb, name)
+		var err error
+		switch action {
+		case "save":
+			err = edb.Modify(func(list []*ii.EchoArea) ([]*ii.EchoArea, error) {
+				for _, e := range list {
+					if e.Name == name {
+						e.Desc = strings.TrimSpace(r.FormValue("desc"))
+						e.Write = r.FormValue("write") != ""
+						e.Allow = strings.Fields(r.FormValue("allow"))
+						e.Read = strings.Fields(r.FormValue("read"))
+						return list, nil
+					}
+				}
+				return nil, errors.New("No such echo: " + name)
+			})
+		case "add":
+			err = edb.Edit("add", name, strings.TrimSpace(r.FormValue("desc")))
+		case "up", "down":
+			pos := 0
+			for i, e := range edb.Areas() {
+				if e.Name == name {
+					pos = i + 1
+				}
+			}
+			if action == "up" && pos > 1 {
+				pos--
+			} else if action == "down" && pos > 0 {
+				pos++
+			}
+			err = edb.Edit("move", name, strconv.Itoa(pos))
+		case "move":
+			err = edb.Edit("move", name, r.FormValue("pos"))
+		case "archive", "remove":
+			err = edb.Edit(action, name)
+		default:
+			err = errors.New("Wrong action")
+		}
+		if err != nil {
+			ii.Error.Printf("Can not %s echo %s: %s", action, name, err)
+			return err
+		}
+		ii.Info.Printf("Echo %s: %s by %s", action, name, ctx.User.Name)
+		audit(ctx, "echo/"+action, name, before, echo_line(edb, name))
+		http.Redirect(w, r, ctx.PfxPath+"/echoes", http.StatusSeeOther)
+		return nil
+	}
+	ctx.Areas = edb.Areas()
+	ctx.Template = "echoes.tpl"
+	return ctx.www.tpl.ExecuteTemplate(w, "echoes.tpl", ctx)
+}
+
+// Write entry to audit log. Errors are only logged: action is
+// already done at this point.
+func audit(ctx *WebContext, action string, target string, before string, after string) {
+	if err := ctx.www.adb.Log(ctx.User.Name, action, target, before, after); err != nil {
+		ii.Error.Printf("Can not write audit log: %s", err)
+	}
+}
+
 func www_logout(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	ii.Trace.Printf("www logout: %s", ctx.User.Name)
 	if ctx.User.Name == "" {
@@ -284,9 +1209,40 @@ func www_logout(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// Add counting of unread messages (ctx.Unread) to query.
+func unreadQuery(ctx *WebContext, q *ii.Query) *ii.Query {
+	if ctx.Reads == nil {
+		return q
+	}
+	ctx.Unread = make(map[string]int)
+	match := q.Match
+	q.Match = func(mi *ii.MsgInfo, q *ii.Query) bool {
+		if match != nil && !match(mi, q) {
+			return false
+		}
+		if ctx.Reads[mi.Echo].Unread(mi) {
+			ctx.Unread[mi.Echo]++
+		}
+		return true
+	}
+	return q
+}
+
+// Echoes for index page: subscribed echoes of user
+// (unless ?all is requested) or all echoes.
+func index_echoes(ctx *WebContext, r *http.Request) []*ii.Echo {
+	var names []string
+	ctx.AllEchoes = r.FormValue("all") != "" || len(ctx.Subs) == 0
+	if !ctx.AllEchoes {
+		names = ctx.Subs
+	}
+	q := unreadQuery(ctx, killQuery(ctx, &ii.Query{User: *ctx.User}))
+	return ctx.www.db.Echoes(names, q)
+}
+
 func www_index(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	ii.Trace.Printf("www index")
-	ctx.Echoes = ctx.www.db.Echoes(nil, &ii.Query{User: *ctx.User})
+	ctx.Echoes = index_echoes(ctx, r)
 	ctx.Template = "index.tpl"
 	err := ctx.www.tpl.ExecuteTemplate(w, "index.tpl", ctx)
 	return err
@@ -294,7 +1250,7 @@ func www_index(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 
 func www_forum(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	ii.Trace.Printf("www forum index")
-	ctx.Echoes = ctx.www.db.Echoes(nil, &ii.Query{User: *ctx.User})
+	ctx.Echoes = ctx.www.db.Echoes(nil, killQuery(ctx, &ii.Query{User: *ctx.User}))
 	ctx.Template = "forum.tpl"
 	err := ctx.www.tpl.ExecuteTemplate(w, "forum.tpl", ctx)
 	return err
@@ -326,7 +1282,7 @@ func check_image(incipit []byte) string {
 
 func www_base64(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	id := ctx.BasePath
-	m := ctx.www.db.Get(id)
+	m := ctx.www.db.GetAccess(id, ctx.User)
 	if m == nil {
 		return errors.New("No such message")
 	}
@@ -387,6 +1343,18 @@ func www_base64(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	_, err = w.Write(b)
 	return err
 }
+func www_captcha(ctx *WebContext, w http.ResponseWriter, r *http.Request, id string) error {
+	b := ctx.www.cap.Image(id)
+	if b == nil {
+		return nil
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.Write(b)
+	return nil
+}
+
 func www_avatar(ctx *WebContext, w http.ResponseWriter, r *http.Request, user string) error {
 	if r.Method == "POST" { /* upload avatar */
 		if ctx.User.Name == "" || ctx.User.Name != user {
@@ -402,23 +1370,30 @@ func www_avatar(ctx *WebContext, w http.ResponseWriter, r *http.Request, user st
 			ii.Error.Printf("Avatar is too big.")
 			return errors.New("Avatar is too big (>2048 bytes)")
 		}
+		var b64 string
 		if ava == "" {
 			ii.Trace.Printf("Delete avatar for %s", ctx.User.Name)
-			ctx.User.Tags.Del("avatar")
 		} else {
 			img := parse_ava(ava)
 			if img == nil {
 				ii.Error.Printf("Wrong xpm format for avatar: " + user)
 				return errors.New("Wrong xpm format")
 			}
-			b64 := base64.URLEncoding.EncodeToString([]byte(ava))
+			b64 = base64.URLEncoding.EncodeToString([]byte(ava))
 			ii.Trace.Printf("New avatar for %s: %s", ctx.User.Name, b64)
-			ctx.User.Tags.Add("avatar/" + b64)
 		}
-		if err := ctx.www.udb.Edit(ctx.User); err != nil {
+		old, _ := ctx.User.Tags.Get("avatar")
+		if err := ctx.www.udb.Modify(ctx.User.Name, func(u *ii.User) error {
+			if b64 == "" {
+				u.Tags.Del("avatar")
+				return nil
+			}
+			return u.Tags.Add("avatar/" + b64)
+		}); err != nil {
 			ii.Error.Printf("Error saving avatar: " + user)
 			return errors.New("Error saving avatar")
 		}
+		audit(ctx, "avatar", user, old, b64)
 		http.Redirect(w, r, ctx.PfxPath+"/profile", http.StatusSeeOther)
 		return nil
 	}
@@ -502,11 +1477,40 @@ func makePager(ctx *WebContext, count int, page int) int {
 	return start
 }
 
+// Select ids for web views. Messages from killfile of user
+// are skipped (see killed).
 func Select(ctx *WebContext, q *ii.Query) []string {
 	q.User = *ctx.User
+	killQuery(ctx, q)
 	return ctx.www.db.SelectIDS(q)
 }
 
+// Add killfile of user to query.
+func killQuery(ctx *WebContext, q *ii.Query) *ii.Query {
+	if ctx.Killfile == nil {
+		return q
+	}
+	match := q.Match
+	q.Match = func(mi *ii.MsgInfo, q *ii.Query) bool {
+		if match != nil && !match(mi, q) {
+			return false
+		}
+		return !killed(ctx, mi)
+	}
+	return q
+}
+
+// Check if message should be hidden by killfile of user.
+// Hidden messages are counted in ctx.Hidden.
+// If ctx.ShowHidden is set, messages are counted, but not hidden.
+func killed(ctx *WebContext, mi *ii.MsgInfo) bool {
+	if !ctx.Killfile.Killed(ctx.www.db, mi) {
+		return false
+	}
+	ctx.Hidden++
+	return !ctx.ShowHidden
+}
+
 func trunc(str string, limit int) string {
 	result := []rune(str)
 	if len(result) > limit {
@@ -613,6 +1617,20 @@ func www_topics(ctx *WebContext, w http.ResponseWriter, r *http.Request, page in
 	defer db.Sync.RUnlock()
 	db.LoadIndex()
 	for _, t := range topicsIds {
+		if ctx.Killfile != nil && !ctx.ShowHidden {
+			/* parents of visible replies are added by GetTopics */
+			var ids []string
+			for _, id := range t {
+				if !ctx.Killfile.Killed(db, db.LookupFast(id, false)) {
+					ids = append(ids, id)
+				}
+			}
+			if len(ids) == 0 || ids[0] != t[0] {
+				ctx.Hidden += len(ids)
+				continue
+			}
+			t = ids
+		}
 		topic := Topic{}
 		topic.Ids = t
 		topic.Count = len(topic.Ids) - 1
@@ -677,13 +1695,22 @@ func www_topic(ctx *WebContext, w http.ResponseWriter, r *http.Request, page int
 		ctx.Selected = id
 	}
 	ctx.Echo = mi.Echo
-	mis := db.LookupIDS(Select(ctx, &ii.Query{Echo: mi.Echo}))
+	mis := db.LookupIDS(db.SelectIDS(&ii.Query{Echo: mi.Echo, User: *ctx.User}))
 
 	topics := db.GetTopics(mis)
 	topic := mi.Topic
 	ctx.Topic = topic
 	ids := topics[topic]
 
+	if ctx.Killfile != nil { /* requested message is always shown */
+		var visible []string
+		for _, v := range ids {
+			if v == id || !killed(ctx, db.Lookup(v)) {
+				visible = append(visible, v)
+			}
+		}
+		ids = visible
+	}
 	if len(ids) == 0 {
 		ids = append(ids, id)
 	} else if topic != mi.Id && page == 0 {
@@ -700,7 +1727,7 @@ func www_topic(ctx *WebContext, w http.ResponseWriter, r *http.Request, page int
 	nr := PAGE_SIZE
 	for i := start; i < len(ids) && nr > 0; i++ {
 		id := ids[i]
-		m := db.Get(id)
+		m := db.GetAccess(id, ctx.User)
 		if m == nil {
 			ii.Error.Printf("Skip wrong message: %s", id)
 			continue
@@ -708,6 +1735,11 @@ func www_topic(ctx *WebContext, w http.ResponseWriter, r *http.Request, page int
 		ctx.Msg = append(ctx.Msg, m)
 		nr--
 	}
+	if ii.IsPrivate(mi.Echo) && ctx.Reads != nil {
+		if err := pm_markread(ctx, mi.Echo, ctx.Msg); err != nil {
+			ii.Error.Printf("Can not mark read: %s", err)
+		}
+	}
 	ctx.Template = "topic.tpl"
 	err := ctx.www.tpl.ExecuteTemplate(w, "topic.tpl", ctx)
 	return err
@@ -725,11 +1757,13 @@ func www_blacklist(ctx *WebContext, w http.ResponseWriter, r *http.Request) erro
 		ii.Error.Printf("Access denied")
 		return errors.New("Access denied")
 	}
+	before := m.String()
 	err := ctx.www.db.Blacklist(m)
 	if err != nil {
 		ii.Error.Printf("Error blacklisting: %s", id)
 		return err
 	}
+	audit(ctx, "blacklist", id, before, "")
 	http.Redirect(w, r, ctx.PfxPath+"/", http.StatusSeeOther)
 	return nil
 }
@@ -738,7 +1772,7 @@ func www_edit(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	id := ctx.BasePath
 	switch r.Method {
 	case "GET":
-		m := ctx.www.db.Get(id)
+		m := ctx.www.db.GetAccess(id, ctx.User)
 		if m == nil {
 			ii.Error.Printf("No such msg: %s", id)
 			return errors.New("No such msg")
@@ -808,28 +1842,53 @@ func www_new(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 			m.Tags.Add("repto/" + repto)
 		}
 
+		var before string // old version of other's message edited by admin
 		if id != "" {
 			om := ctx.www.db.Get(id)
 			if (om == nil || m.Addr != om.Addr) && ctx.User.Id != 1 {
 				ii.Error.Printf("Access denied")
 				return errors.New("Access denied")
 			}
+			if om != nil && m.Addr != om.Addr {
+				before = om.String()
+			}
 			m.Date = om.Date
 			m.MsgId = id
 			m.From = om.From
 			m.Addr = om.Addr
 		}
 
-		if !PointPolicy(ctx.User, ctx.www.db, m) {
+		premod := !PointPolicy(ctx.User, ctx.www.db, m)
+		if premod && ctx.www.pdb == nil {
 			ii.Error.Printf("Not verified account! Wait for the administrator.")
 			ctx.Template = "register-verify.tpl"
 			err := ctx.www.tpl.ExecuteTemplate(w, "register-verify.tpl", ctx)
 			return err
 		}
 
-		if !ctx.www.edb.Access(m) && ctx.User.Id != 1 {
-			ii.Error.Printf("Access denied")
-			return errors.New("Access denied")
+		quarantine, err := PostAccess(ctx.www, ctx.User, m)
+		if err != nil {
+			ii.Error.Printf("Access denied: %s", err)
+			return err
+		}
+		premod = premod || quarantine
+
+		if action == "Submit" && !edit && SpamCheck(ctx.www, ctx.User, m) {
+			if ctx.www.pdb == nil {
+				return errors.New("Message looks like spam")
+			}
+			premod = true
+		}
+
+		if action == "Submit" && premod {
+			if err := Premoderate(ctx.www.pdb, m); err != nil {
+				ii.Error.Printf("Error while premoderating %s: %s", m.MsgId, err)
+				return err
+			}
+			ii.Info.Printf("Msg %s from %s is waiting for moderation", m.MsgId, m.From)
+			ctx.Msg = append(ctx.Msg, m)
+			ctx.Template = "premoderation.tpl"
+			return ctx.www.tpl.ExecuteTemplate(w, "premoderation.tpl", ctx)
 		}
 
 		if action == "Submit" { // submit
@@ -842,6 +1901,9 @@ func www_new(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 				ii.Error.Printf("Error while storig new topic %s: %s", m.MsgId, err)
 				return err
 			}
+			if before != "" {
+				audit(ctx, "edit", m.MsgId, before, m.String())
+			}
 			http.Redirect(w, r, ctx.PfxPath+"/echo/"+m.MsgId+"#"+m.MsgId, http.StatusSeeOther)
 			return nil
 		}
@@ -858,7 +1920,7 @@ func www_new(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 
 func www_reply(ctx *WebContext, w http.ResponseWriter, r *http.Request, quote bool) error {
 	id := ctx.BasePath
-	m := ctx.www.db.Get(id)
+	m := ctx.www.db.GetAccess(id, ctx.User)
 	if m == nil {
 		ii.Error.Printf("No such msg: %s", id)
 		return errors.New("No such msg")
@@ -1088,6 +2150,10 @@ func WebInit(www *WWW) {
 			return r
 		},
 		"msg_quote": msg_quote,
+		"msg_tag": func(m ii.Msg, t string) string {
+			v, _ := m.Tag(t)
+			return v
+		},
 		"msg_access": func(m ii.Msg, u ii.User) bool {
 			return msg_access(www, m, u)
 		},
@@ -1110,6 +2176,21 @@ func WebInit(www *WWW) {
 			}
 			return false
 		},
+		"kill_kinds": func() []string {
+			return ii.KillKinds
+		},
+		"notify_kinds": func() []string {
+			return ii.NotifyKinds
+		},
+		"feed_query": func(u *ii.User) string {
+			if u.Name == "" {
+				return ""
+			}
+			return "?token=" + ii.FeedToken(u)
+		},
+		"profile_fields": func() []string {
+			return ProfileFields
+		},
 		"user_tag": func(user string, t string) string {
 			ui := www.udb.UserInfoName(user)
 			if ui != nil {
@@ -1180,16 +2261,46 @@ func _handleWWW(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 			}
 		}
 	}
-	ipaddr := r.Header.Get("X-Forwarded-For")
-	if ipaddr == "" {
-		ipaddr = r.RemoteAddr
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	args := strings.Split(path, "/")
+	if token := r.URL.Query().Get("token"); token != "" &&
+		ctx.User.Name == "" && args[len(args)-1] == "rss" {
+		if user := ctx.www.udb.UserInfoFeed(token); user != nil {
+			ctx.User = user
+		}
+	}
+	if ctx.User.Id != 0 && ctx.www.kdb != nil {
+		ctx.Killfile = ctx.www.kdb.Get(ctx.User.Id)
+		if cookie, err := r.Cookie("killfile"); err == nil {
+			ctx.ShowHidden = cookie.Value == "show"
+		}
+	}
+	if ctx.User.Id != 0 && ctx.www.ndb != nil {
+		ctx.Notifications = ctx.www.ndb.Get(ctx.User.Id)
+		ctx.Notify = ctx.Notifications.Unread()
+	}
+	ctx.Pending = len(pending_ids(ctx.www, ctx.User))
+	if ctx.User.Id != 0 && ctx.www.bdb != nil {
+		ctx.Bookmarks = ctx.www.bdb.Get(ctx.User.Id)
+	}
+	if ctx.User.Id != 0 && ctx.www.rdb != nil {
+		ctx.Reads = ctx.www.rdb.Get(ctx.User.Id)
+		for e, p := range ctx.Reads {
+			if p.Sub {
+				ctx.Subs = append(ctx.Subs, e)
+			}
+		}
+		sort.Strings(ctx.Subs)
+		pm_count(ctx)
+	}
+	ipaddr := r.RemoteAddr
+	if ip := remote_ip(r, ctx.www.prx); ip != nil {
+		ipaddr = ip.String()
 	}
 	ctx.Ip = strings.Replace(ipaddr, ":", "_", -1)
 	ctx.Ip = strings.Replace(ctx.Ip, "/", "_", -1)
 	ii.Trace.Printf("%s [%s] GET %s", ipaddr, ctx.User.Name, r.URL.Path)
-	path := strings.TrimPrefix(r.URL.Path, "/")
-	args := strings.Split(path, "/")
-	ctx.Echolist = ctx.www.edb
+	ctx.Echolist = ctx.www.edb.Snapshot()
 	ctx.Ref = r.Header.Get("Referer")
 	if len(args) > 1 {
 		switch args[0] {
@@ -1217,31 +2328,55 @@ func _handleWWW(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 		}
 		ctx.BasePath = "points"
 		if len(args) > 2 {
-			udb := ctx.www.udb
-			u := udb.UserInfoName(args[2])
-			if u == nil {
-				return www_points(ctx, w, r)
-			}
-			switch args[1] {
-			case "moderate":
-				u.Tags.Add("limit/3")
-				u.Tags.Add("status/moderate")
-			case "unblock":
-				u.Tags.Add("status/verified")
-				u.Tags.Del("limit")
-			case "block":
-				u.Tags.Add("status/blocked")
-				u.Tags.Add("limit/0")
-			case "remove":
-				u.Tags.Add("status/remove")
-			case "approve":
-				u.Tags.Del("limit")
-				u.Tags.Add("status/verified")
+			if err := ctx.www.adb.LogUser(ctx.User.Name, "user/"+args[1], ctx.www.udb, args[2], func() error {
+				return ctx.www.udb.Moderate(args[2], args[1])
+			}); err != nil {
+				ii.Error.Printf("Can not %s user %s: %s", args[1], args[2], err)
+				return err
 			}
-			udb.Edit(u)
-			udb.LoadUsers()
 		}
 		return www_points(ctx, w, r)
+	} else if args[0] == "echoes" {
+		ctx.BasePath = "echoes"
+		return www_echoes(ctx, w, r)
+	} else if args[0] == "audit" {
+		return www_audit(ctx, w, r, args)
+	} else if args[0] == "peers" {
+		ctx.BasePath = "peers"
+		return www_peers(ctx, w, r)
+	} else if args[0] == "user" {
+		if len(args) < 2 {
+			return errors.New("Wrong request")
+		}
+		ctx.BasePath = "user/" + args[1]
+		return www_user(ctx, w, r, args[1])
+	} else if args[0] == "killfile" {
+		ctx.BasePath = "killfile"
+		return www_killfile(ctx, w, r, args[1:])
+	} else if args[0] == "unread" || args[0] == "markread" ||
+		args[0] == "subscribe" || args[0] == "unsubscribe" {
+		echo := ""
+		if len(args) > 1 {
+			echo = args[1]
+		}
+		return www_reader(ctx, w, r, args[0], echo)
+	} else if args[0] == "search" {
+		/* query can contain / */
+		eargs := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+		if ctx.PfxPath != "" {
+			eargs = eargs[1:]
+		}
+		return www_search(ctx, w, r, eargs)
+	} else if args[0] == "moderation" {
+		ctx.BasePath = "moderation"
+		return www_moderation(ctx, w, r)
+	} else if args[0] == "notifications" {
+		ctx.BasePath = "notifications"
+		return www_notifications(ctx, w, r)
+	} else if args[0] == "inbox" || args[0] == "outbox" || args[0] == "pm" {
+		return www_pm(ctx, w, r, args)
+	} else if args[0] == "bookmarks" || args[0] == "bookmark" || args[0] == "unbookmark" {
+		return www_bookmarks(ctx, w, r, args)
 	} else if args[0] == "profile" {
 		ctx.BasePath = "profile"
 		return www_profile(ctx, w, r)
@@ -1255,6 +2390,11 @@ func _handleWWW(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 	} else if args[0] == "reset" {
 		ctx.Template = "reset.tpl"
 		return ctx.www.tpl.ExecuteTemplate(w, "reset.tpl", ctx)
+	} else if args[0] == "captcha" {
+		if len(args) < 2 {
+			return errors.New("Wrong request")
+		}
+		return www_captcha(ctx, w, r, args[1])
 	} else if args[0] == "avatar" {
 		ctx.BasePath = "avatar"
 		if len(args) < 2 {
@@ -1313,7 +2453,7 @@ func _handleWWW(ctx *WebContext, w http.ResponseWriter, r *http.Request) error {
 			q.Echo = args[1]
 		} else if ii.IsMsgId(args[1]) {
 			mi := ctx.www.db.Lookup(args[1])
-			if mi != nil {
+			if mi != nil && ctx.www.db.Access(mi, ctx.User) {
 				q.Echo = mi.Echo
 			} else { /* all */
 				q.Start = -PAGE_SIZE
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/hugeping/ii-go/ii"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -26,6 +30,118 @@ func open_db(path string) *ii.DB {
 	return db
 }
 
+// Notify local users about new messages stored in db.
+// Echolist is used for read access of users. Returns function
+// which waits for delivery of notifications.
+func notify_db(db *ii.DB, path string, users string, echoes string,
+	smtp string, host string) func() {
+	if path == "" {
+		return func() {}
+	}
+	db.Acl = ii.LoadEcholist(echoes)
+	n := &ii.Notifier{DB: db, UDB: ii.OpenUsers(users, ""),
+		NDB: ii.OpenNotifications(path), SMTP: smtp,
+		MailFrom: "ii-go@localhost", Host: host}
+	db.Stored = n.Notify
+	return n.Close
+}
+
+// Client for node requests: timeout in seconds, number of
+// retries and proxy url (if not empty).
+func new_client(timeout int, retries int, proxy string) *ii.Client {
+	c := ii.NewClient()
+	if proxy != "" {
+		var err error
+		if c, err = ii.NewProxyClient(proxy); err != nil {
+			fmt.Printf("Wrong proxy: %s\n", proxy)
+			os.Exit(1)
+		}
+	}
+	c.Timeout = time.Duration(timeout) * time.Second
+	if c.HTTP != nil {
+		c.HTTP.Timeout = c.Timeout
+	}
+	c.Retries = retries
+	return c
+}
+
+// Filter messages fetched to db with block rules (if rules
+// file is set) and spam filter. Spam and quarantined messages
+// are stored in premoderation queue (pending database) instead of db.
+// Returns premoderation queue (nil if it is not set).
+func filter_db(db *ii.DB, rules string, dryrun bool, spam string,
+	pending string, score float64) *ii.DB {
+	var pdb *ii.DB
+	var filters []func(m *ii.Msg) error
+	if pending != "" {
+		pdb = open_db(pending)
+	}
+	if rules != "" {
+		edb := &ii.EDB{DryRun: dryrun}
+		edb.LoadBlockwords(rules)
+		filters = append(filters, edb.Filter(pdb))
+	}
+	if spam != "" && pdb != nil {
+		f := ii.OpenSpamFilter(spam)
+		f.Threshold = score
+		filters = append(filters, f.Filter(pdb))
+	}
+	if len(filters) == 0 {
+		return pdb
+	}
+	db.Filter = func(m *ii.Msg) error {
+		for _, f := range filters {
+			if err := f(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return pdb
+}
+
+// Open audit log for administrative commands.
+// Returns nil (no logging) if path is empty.
+func open_audit(path string) *ii.ADB {
+	if path == "" {
+		return nil
+	}
+	return ii.OpenAudit(path)
+}
+
+// Parse filter for audit command: who=, action=, target=,
+// since= and until= (dates in YYYY-MM-DD format).
+func audit_filter(args []string) (*ii.AuditFilter, error) {
+	f := &ii.AuditFilter{}
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Wrong filter: " + a)
+		}
+		switch kv[0] {
+		case "who":
+			f.Who = kv[1]
+		case "action":
+			f.Action = kv[1]
+		case "target":
+			f.Target = kv[1]
+		case "since", "until":
+			t, err := time.ParseInLocation("2006-01-02", kv[1], time.Local)
+			if err != nil {
+				return nil, err
+			}
+			if kv[0] == "since" {
+				f.Since = t.Unix()
+			} else {
+				f.Until = t.AddDate(0, 0, 1).Unix() - 1
+			}
+		default:
+			return nil, errors.New("Wrong filter: " + a)
+		}
+	}
+	return f, nil
+}
+
 func open_users_db(path string) *ii.UDB {
 	db := ii.OpenUsers(path, "")
 	if err := db.LoadUsers(); err != nil {
@@ -35,6 +151,22 @@ func open_users_db(path string) *ii.UDB {
 	return db
 }
 
+// Names of echoes from echolist file (format of list.txt): names
+// are cut at ACL marks (! and ?) as in echolist of node.
+func echolist_names(path string) []string {
+	var list []string
+	for _, v := range strings.Split(GetFile(path), "\n") {
+		e := strings.TrimPrefix(strings.Split(v, ":")[0], "-")
+		if i := strings.IndexAny(e, "!?"); i >= 0 {
+			e = e[:i]
+		}
+		if e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
 func GetFile(path string) string {
 	var file *os.File
 	var err error
@@ -185,17 +317,44 @@ func main() {
 	invert_opt := flag.Bool("i", false, "Invert select")
 	force_opt := flag.Bool("f", false, "Force full sync")
 	users_opt := flag.String("u", "points.txt", "Users database")
-	conns_opt := flag.Int("j", 6, "Maximum parallel jobs")
+	conns_opt := flag.Int("j", ii.DEFAULT_CONNECTIONS, "fetch: maximum parallel requests")
 	topics_opt := flag.Bool("t", false, "select, get: topics only")
 	from_opt := flag.String("from", "", "select: from")
 	to_opt := flag.String("to", "", "select: to")
 	count_opt := flag.Int("count", 0, "select: count <nr> messages")
 	skip_opt := flag.Int("skip", 0, "select: skip <nr> messages")
+	notify_opt := flag.String("notify", "", "fetch, store: users notifications")
+	echo_opt := flag.String("e", "list.txt", "echo: echoes list; fetch, store: for notifications")
+	smtp_opt := flag.String("smtp", "", "fetch, store: mail server for notifications")
+	host_opt := flag.String("host", "http://127.0.0.1:8080", "fetch, store: node address for notifications")
+	audit_opt := flag.String("audit", "audit.log", "Audit log of moderation actions")
+	spam_opt := flag.String("spam", "spam.txt", "Spam filter model")
+	rules_opt := flag.String("rules", "", "fetch, store, rules: block words rules file")
+	dryrun_opt := flag.Bool("dry-run", false, "fetch, store: only log messages matched by block rules; expire: only show messages")
+	sys_opt := flag.String("sys", "ii-go", "push: node name (address of local messages)")
+	auth_opt := flag.String("auth", "", "push: node auth (secret of account on uplink)")
+	since_opt := flag.String("since", "", "push: messages since date (YYYY-MM-DD)")
+	echo_policy_opt := flag.String("echo-policy", "echopolicy.txt", "expire: posting and retention policies of echoes")
+	spam_score_opt := flag.Float64("spam-score", ii.SPAM_THRESHOLD, "fetch, store: min spam score (0..1)")
+	pending_opt := flag.String("pending", "", "fetch, store: quarantine spam in premoderation queue; spam train: rejected messages")
+	timeout_opt := flag.Int("timeout", 60, "send, fetch, push: timeout of request in seconds")
+	retries_opt := flag.Int("retries", 2, "fetch, push: retries of failed requests")
+	proxy_opt := flag.String("proxy", "", "send, fetch, push: proxy url (http:// or socks5://)")
+	json_opt := flag.Bool("json", false, "fetch: print report in JSON")
+	counts_opt := flag.String("counts", "", "fetch: history of echo counts of nodes (skip unchanged echoes)")
 
 	flag.Parse()
-	ii.MaxConnections = *conns_opt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client := new_client(*timeout_opt, *retries_opt, *proxy_opt)
+	logs := io.Writer(os.Stdout)
+	if *json_opt { /* stdout is for report only */
+		logs = os.Stderr
+	}
 	if *verbose_opt {
-		ii.OpenLog(os.Stdout, os.Stdout, os.Stderr)
+		ii.OpenLog(logs, logs, os.Stderr)
+	} else {
+		ii.OpenLog(ioutil.Discard, logs, os.Stderr)
 	}
 
 	args := flag.Args()
@@ -213,8 +372,33 @@ Commands:
 	blacklist <msgid>             - blacklist msg
 	useradd <name> <e-mail> <password>
 	                              - adduser
+	userlist                      - list users
+	usermod <name> <action>       - approve|moderate|block|unblock user
+	usermod <name> set <tag> <val>
+	                              - set user tag (status, limit...)
+	usermod <name> del <tag>      - remove user tag
+	passwd <name> <password>      - change password
+	userdel <name>                - remove user
+	lock                          - lock registration
+	unlock                        - unlock registration
+	echo list                     - list echoes (-e list.txt)
+	echo add <echo> [desc]        - add echo
+	echo desc <echo> [desc]       - change description
+	echo readonly|writable <echo> - forbid or allow posting
+	echo allow <echo> [addr...]   - only these points can create topics
+	echo read <echo> [addr...]    - only these points can read echo
+	echo archive <echo>           - make read-only and move to the end
+	echo move <echo> <pos>        - move echo to position (1 - first)
+	echo remove <echo>            - remove echo from list
+	audit [who=<name>] [action=<action>] [target=<id>] [since=<date>] [until=<date>]
+	                              - show audit log (-v: with before/after)
+	spam train                    - train spam filter (-spam spam.txt)
+	spam score <msgid>            - show spam score of message
 	gemini <dir>                  - ids in stdin: export articles/files to dir in .gmi
+	push <url> [echolist]         - push local messages to uplink (-auth, -sys, -since)
+	expire                        - tombstone messages by retention policies (-echo-policy)
 	sort                          - ids in stdin: sort by date
+	rules                         - ids in stdin: show block rules (-rules) matched by messages
 	template <tpl>                - ids in stdin: do golang template over msgs
 Options:
 	-db=<path>                    - database path
@@ -228,6 +412,27 @@ Options:
 	-b                            - select: show bundles
 	-v                            - select, search: verbose show
 	-i                            - select, sort: invert
+	-notify=<path>                - fetch, store: notify users (notify.txt)
+	-e=<path>                     - echo: echoes list; fetch, store: for notifications
+	-smtp=<host:port>             - fetch, store: send notifications by e-mail
+	-host=<url>                   - fetch, store: node address for notifications
+	-audit=<path>                 - audit log of admin commands (audit.log)
+	-spam=<path>                  - spam filter model (spam.txt)
+	-spam-score=<score>           - fetch, store: min spam score (0.9)
+	-rules=<path>                 - fetch, store, rules: block words rules (blackwords.txt)
+	-dry-run                      - fetch, store: only log matches of block rules
+	                                expire: only show expired messages
+	-echo-policy=<path>           - expire: retention policies (echopolicy.txt)
+	-sys=<name>                   - push: node name, address of local messages (ii-go)
+	-auth=<secret>                - push: node auth on uplink
+	-since=<date>                 - push: messages since date (YYYY-MM-DD)
+	-pending=<path>               - fetch, store: quarantine spam in premoderation queue
+	                                spam train: learn rejected messages of queue
+	-timeout=<sec>                - send, fetch, push: timeout of request (60)
+	-retries=<nr>                 - fetch, push: retries of failed requests (2)
+	-proxy=<url>                  - send, fetch, push: http:// or socks5:// proxy
+	-json                         - fetch: print report in JSON (-v: all echoes in summary)
+	-counts=<path>                - fetch: history of echo counts, unchanged echoes are skipped
 `, os.Args[0])
 		os.Exit(1)
 	}
@@ -276,10 +481,14 @@ Options:
 		db := open_db(*db_opt)
 		m := db.Get(args[1])
 		if m != nil {
+			before := m.String()
 			if err := db.Blacklist(m); err != nil {
 				fmt.Printf("Can not blacklist: %s\n", err)
 				os.Exit(1)
 			}
+			if err := open_audit(*audit_opt).Log("ii-tool", "blacklist", args[1], before, ""); err != nil {
+				fmt.Printf("Can not write audit log: %s\n", err)
+			}
 		} else {
 			fmt.Printf("No such msg")
 		}
@@ -293,12 +502,12 @@ Options:
 			fmt.Printf("Wrong message format\n")
 			os.Exit(1)
 		}
-		n, err := ii.Connect(args[1])
+		n, err := ii.Connect(ctx, args[1], client)
 		if err != nil {
 			fmt.Printf("Can not connect to %s: %s\n", args[1], err)
 			os.Exit(1)
 		}
-		if err := n.Post(args[2], msg); err != nil {
+		if err := n.Post(ctx, args[2], msg); err != nil {
 			fmt.Printf("Can not send message: %s\n", err)
 			os.Exit(1)
 		}
@@ -312,6 +521,177 @@ Options:
 			fmt.Printf("Can not add user: %s\n", err)
 			os.Exit(1)
 		}
+	case "userlist":
+		db := open_users_db(*users_opt)
+		if db.Closed {
+			fmt.Printf("!lock\n")
+		}
+		for _, n := range db.List {
+			ui := db.Names[n]
+			fmt.Printf("%d:%s:%s:%s\n", ui.Id, ui.Name, ui.Mail, ui.Tags.String())
+		}
+	case "usermod":
+		if len(args) < 3 {
+			fmt.Printf("No argumnet(s) supplied\nShould be: name and action.\n")
+			os.Exit(1)
+		}
+		if args[2] == "set" && len(args) < 5 {
+			fmt.Printf("No argumnet(s) supplied\nShould be: tag and value.\n")
+			os.Exit(1)
+		}
+		if args[2] == "del" && len(args) < 4 {
+			fmt.Printf("No tag supplied\n")
+			os.Exit(1)
+		}
+		db := open_users_db(*users_opt)
+		err := open_audit(*audit_opt).LogUser("ii-tool", "user/"+args[2], db, args[1], func() error {
+			switch args[2] {
+			case "set":
+				return db.SetTag(args[1], args[3], args[4])
+			case "del":
+				return db.DelTag(args[1], args[3])
+			case "remove":
+				return errors.New("Use userdel to remove user")
+			}
+			return db.Moderate(args[1], args[2])
+		})
+		if err != nil {
+			fmt.Printf("Can not modify user: %s\n", err)
+			os.Exit(1)
+		}
+	case "passwd":
+		if len(args) < 3 {
+			fmt.Printf("No argumnet(s) supplied\nShould be: name and password.\n")
+			os.Exit(1)
+		}
+		db := open_users_db(*users_opt)
+		if err := open_audit(*audit_opt).LogUser("ii-tool", "user/passwd", db, args[1], func() error {
+			return db.Passwd(args[1], args[2])
+		}); err != nil {
+			fmt.Printf("Can not change password: %s\n", err)
+			os.Exit(1)
+		}
+	case "userdel":
+		if len(args) < 2 {
+			fmt.Printf("No user supplied\n")
+			os.Exit(1)
+		}
+		db := open_users_db(*users_opt)
+		if err := open_audit(*audit_opt).LogUser("ii-tool", "user/remove", db, args[1], func() error {
+			return db.Moderate(args[1], "remove")
+		}); err != nil {
+			fmt.Printf("Can not remove user: %s\n", err)
+			os.Exit(1)
+		}
+	case "lock", "unlock":
+		db := open_users_db(*users_opt)
+		if err := db.SetClosed(cmd == "lock"); err != nil {
+			fmt.Printf("Can not %s registration: %s\n", cmd, err)
+			os.Exit(1)
+		}
+		if err := open_audit(*audit_opt).Log("ii-tool", cmd, "registration", "", ""); err != nil {
+			fmt.Printf("Can not write audit log: %s\n", err)
+		}
+	case "echo":
+		if len(args) < 2 {
+			fmt.Printf("No action supplied\n")
+			os.Exit(1)
+		}
+		edb := ii.LoadEcholist(*echo_opt)
+		if edb == nil {
+			os.Exit(1)
+		}
+		if args[1] == "list" {
+			for _, e := range edb.Areas() {
+				fmt.Printf("%s\n", e)
+			}
+			break
+		}
+		if len(args) < 3 {
+			fmt.Printf("No echo supplied\n")
+			os.Exit(1)
+		}
+		line := func() string {
+			for _, e := range edb.Areas() {
+				if e.Name == args[2] {
+					return e.String()
+				}
+			}
+			return ""
+		}
+		before := line()
+		if err := edb.Edit(args[1], args[2], args[3:]...); err != nil {
+			fmt.Printf("Can not %s echo: %s\n", args[1], err)
+			os.Exit(1)
+		}
+		if err := open_audit(*audit_opt).Log("ii-tool", "echo/"+args[1], args[2], before, line()); err != nil {
+			fmt.Printf("Can not write audit log: %s\n", err)
+		}
+	case "audit":
+		f, err := audit_filter(args[1:])
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+		if *audit_opt == "" {
+			fmt.Printf("No audit log\n")
+			os.Exit(1)
+		}
+		list, err := ii.OpenAudit(*audit_opt).Select(f)
+		if err != nil {
+			fmt.Printf("Can not read audit log: %s\n", err)
+			os.Exit(1)
+		}
+		for _, e := range list {
+			d := time.Unix(e.Date, 0).Format("2006-01-02 15:04:05")
+			fmt.Printf("%s %s %s %s\n", d, e.Who, e.Action, e.Target)
+			if !*verbose_opt {
+				continue
+			}
+			if e.Before != "" {
+				fmt.Printf("before:\n%s\n", e.Before)
+			}
+			if e.After != "" {
+				fmt.Printf("after:\n%s\n", e.After)
+			}
+		}
+	case "spam":
+		if len(args) < 2 {
+			fmt.Printf("No spam command supplied\n")
+			os.Exit(1)
+		}
+		f := ii.OpenSpamFilter(*spam_opt)
+		db := open_db(*db_opt)
+		switch args[1] {
+		case "train":
+			var pdb *ii.DB
+			if *pending_opt != "" {
+				pdb = open_db(*pending_opt)
+			}
+			if err := f.Train(db, pdb); err != nil {
+				fmt.Printf("Can not train spam filter: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%d spam, %d ham messages, %d tokens\n", f.Spam, f.Ham, len(f.Tokens))
+			if err := open_audit(*audit_opt).Log("ii-tool", "spam/train", "", "",
+				fmt.Sprintf("%d:%d", f.Spam, f.Ham)); err != nil {
+				fmt.Printf("Can not write audit log: %s\n", err)
+			}
+		case "score":
+			if len(args) < 3 {
+				fmt.Printf("No msgid supplied\n")
+				os.Exit(1)
+			}
+			m, err := ii.DecodeBundle(db.GetBundleAll(args[2]))
+			if err != nil {
+				fmt.Printf("No such message: %s\n", args[2])
+				os.Exit(1)
+			}
+			fmt.Printf("%.2f\n", f.Score(m))
+		default:
+			fmt.Printf("Wrong spam command: %s\n", args[1])
+			os.Exit(1)
+		}
 	case "clean":
 		hash := make(map[string]int)
 		last := make(map[string]string)
@@ -390,7 +770,7 @@ Options:
 		})
 		f.Close()
 		if err != nil {
-			fmt.Printf("Error: %s\n")
+			fmt.Printf("Error: %s\n", err)
 			os.Exit(1)
 		}
 		for _, v := range hash {
@@ -407,7 +787,9 @@ Options:
 			os.Exit(1)
 		}
 		db := open_db(*db_opt)
-		n, err := ii.Connect(args[1])
+		notified := notify_db(db, *notify_opt, *users_opt, *echo_opt, *smtp_opt, *host_opt)
+		pdb := filter_db(db, *rules_opt, *dryrun_opt, *spam_opt, *pending_opt, *spam_score_opt)
+		n, err := ii.Connect(ctx, args[1], client)
 		if err != nil {
 			fmt.Printf("Can not connect to %s: %s\n", args[1], err)
 			os.Exit(1)
@@ -415,19 +797,67 @@ Options:
 		if *force_opt {
 			n.Force = true
 		}
+		n.Pending = pdb
+		n.MaxConnections = *conns_opt
+		var cdb *ii.CDB
+		if *counts_opt != "" {
+			cdb = ii.OpenCounts(*counts_opt)
+			n.Counts = cdb.Get(n.Host)
+		}
 		if len(args) > 2 {
-			str := GetFile(args[2])
-			for _, v := range strings.Split(str, "\n") {
-				if strings.HasPrefix(v, "-") {
-					v = v[1:]
-				}
-				e := strings.Split(strings.Split(v, ":")[0], "!")[0]
-				echolist = append(echolist, e)
+			echolist = echolist_names(args[2])
+		}
+		report, err := n.Fetch(ctx, db, echolist, *lim_opt)
+		notified()
+		if cdb != nil && n.Counts != nil {
+			if err := cdb.Set(n.Host, n.Counts); err != nil {
+				fmt.Fprintf(os.Stderr, "Can not save counts: %s\n", err)
+			}
+		}
+		if *json_opt {
+			out, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(out))
+		} else {
+			fmt.Println(report.Summary(*verbose_opt))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can not fetch from %s: %s\n", args[1], err)
+			os.Exit(1)
+		}
+	case "push":
+		var echolist []string
+		if len(args) < 2 {
+			fmt.Printf("No url supplied\n")
+			os.Exit(1)
+		}
+		var since int64
+		if *since_opt != "" {
+			t, err := time.ParseInLocation("2006-01-02", *since_opt, time.Local)
+			if err != nil {
+				fmt.Printf("Wrong date: %s\n", *since_opt)
+				os.Exit(1)
+			}
+			since = t.Unix()
+		}
+		db := open_db(*db_opt)
+		db.Name = *sys_opt
+		n, err := ii.Connect(ctx, args[1], client)
+		if err != nil {
+			fmt.Printf("Can not connect to %s: %s\n", args[1], err)
+			os.Exit(1)
+		}
+		n.Auth = *auth_opt
+		if len(args) > 2 {
+			echolist = echolist_names(args[2])
+		} else {
+			for _, e := range db.Echoes(nil, &ii.Query{}) {
+				echolist = append(echolist, e.Name)
 			}
 		}
-		err = n.Fetch(db, echolist, *lim_opt)
+		nr, _, err := n.Push(ctx, db, echolist, since, 0)
+		fmt.Printf("%d messages pushed\n", nr)
 		if err != nil {
-			fmt.Printf("Can not fetch from %s: %s\n", args[1], err)
+			fmt.Printf("Can not push to %s: %s\n", args[1], err)
 			os.Exit(1)
 		}
 	case "store":
@@ -436,6 +866,8 @@ Options:
 			os.Exit(1)
 		}
 		db := open_db(*db_opt)
+		notified := notify_db(db, *notify_opt, *users_opt, *echo_opt, *smtp_opt, *host_opt)
+		filter_db(db, *rules_opt, *dryrun_opt, *spam_opt, *pending_opt, *spam_score_opt)
 		var f *os.File
 		var err error
 		if args[1] == "-" {
@@ -465,12 +897,16 @@ Options:
 				continue
 			}
 			if db.Lookup(m.MsgId) == nil {
-				if err := db.Store(m); err != nil {
+				if err := db.Store(m); err == ii.ErrQuarantined {
+					continue
+				} else if err != nil {
 					fmt.Printf("Can not store message: %s\n", err)
+					notified()
 					os.Exit(1)
 				}
 			}
 		}
+		notified()
 	case "get":
 		if len(args) < 2 {
 			fmt.Printf("No msgid supplied\n")
@@ -563,6 +999,44 @@ Options:
 				fmt.Println(v.MsgId)
 			}
 		}
+	case "expire":
+		edb := &ii.EDB{}
+		edb.LoadPolicy(*echo_policy_opt)
+		db := open_db(*db_opt)
+		ids, err := db.Expire(edb, time.Now().Unix(), *dryrun_opt)
+		if *verbose_opt || *dryrun_opt {
+			for _, id := range ids {
+				fmt.Println(id)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Can not expire messages: %s\n", err)
+			os.Exit(1)
+		}
+		if !*dryrun_opt {
+			fmt.Printf("%d messages expired\n", len(ids))
+		}
+	case "rules":
+		if *rules_opt == "" {
+			fmt.Printf("No rules file supplied\n")
+			os.Exit(1)
+		}
+		edb := &ii.EDB{}
+		edb.LoadBlockwords(*rules_opt)
+		db := open_db(*db_opt)
+		db.LoadIndex()
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			m, err := ii.DecodeBundle(db.GetBundleAll(scanner.Text()))
+			if err != nil {
+				continue
+			}
+			for _, r := range edb.BlockRules {
+				if r.Match(m) {
+					fmt.Printf("%s %s %s\n", m.MsgId, r.Action, r.Reason)
+				}
+			}
+		}
 	case "index":
 		db := open_db(*db_opt)
 		if err := db.CreateIndex(); err != nil {
@@ -0,0 +1,143 @@
+// Audit log of moderation and administrative actions.
+// Log is append only file with lines:
+// <unix time>:<who>:<action>:<target>:<before>:<after>
+// Before and after are base64 encoded states of target.
+package ii
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Entry of audit log.
+// Who: name of user who made action.
+// Action: for example, blacklist, edit, user/block.
+// Target: message id or user name.
+// Before, After: state of target before and after action.
+type AuditEntry struct {
+	Date   int64
+	Who    string
+	Action string
+	Target string
+	Before string
+	After  string
+}
+
+// Filter for audit log. Empty fields match all entries.
+// Action matches entries with the same action or action prefix
+// (user matches user/block). Since and Until are unix times.
+type AuditFilter struct {
+	Who    string
+	Action string
+	Target string
+	Since  int64
+	Until  int64
+}
+
+// Audit log.
+type ADB struct {
+	FileDB
+}
+
+// Check if entry matches filter.
+func (f *AuditFilter) Match(e *AuditEntry) bool {
+	if f.Who != "" && f.Who != e.Who {
+		return false
+	}
+	if f.Action != "" && f.Action != e.Action &&
+		!strings.HasPrefix(e.Action, f.Action+"/") {
+		return false
+	}
+	if f.Target != "" && f.Target != e.Target {
+		return false
+	}
+	if f.Since != 0 && e.Date < f.Since {
+		return false
+	}
+	if f.Until != 0 && e.Date > f.Until {
+		return false
+	}
+	return true
+}
+
+// Open audit log.
+func OpenAudit(path string) *ADB {
+	return &ADB{FileDB: FileDB{Path: path, Name: "audit"}}
+}
+
+// Append entry to audit log. Does nothing if db is nil.
+func (db *ADB) Log(who string, action string, target string, before string, after string) error {
+	if db == nil {
+		return nil
+	}
+	if strings.ContainsAny(who+action+target, ":\r\n") {
+		return errors.New("Wrong audit entry")
+	}
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if !db.Lock() {
+		return errors.New("Can not lock audit log")
+	}
+	defer db.Unlock()
+	Info.Printf("Audit: %s %s %s", who, action, target)
+	return append_file(db.Path, fmt.Sprintf("%d:%s:%s:%s:%s:%s",
+		time.Now().Unix(), who, action, target,
+		base64.StdEncoding.EncodeToString([]byte(before)),
+		base64.StdEncoding.EncodeToString([]byte(after))))
+}
+
+// Make changes of user and log them with tags of user
+// before and after changes.
+func (db *ADB) LogUser(who string, action string, udb *UDB, name string, fn func() error) error {
+	var before, after string
+	udb.LoadUsers()
+	if u := udb.UserInfoName(name); u != nil {
+		before = u.Tags.String()
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if u := udb.UserInfoName(name); u != nil {
+		after = u.Tags.String()
+	}
+	return db.Log(who, action, name, before, after)
+}
+
+// Get entries of audit log matched by filter (in order of time).
+func (db *ADB) Select(f *AuditFilter) ([]AuditEntry, error) {
+	var list []AuditEntry
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	err := FileLines(db.Path, func(line string) bool {
+		a := strings.Split(line, ":")
+		var e AuditEntry
+		if len(a) != 6 {
+			Error.Printf("Wrong entry in audit log: %s", line)
+			return true
+		}
+		if _, err := fmt.Sscanf(a[0], "%d", &e.Date); err != nil {
+			Error.Printf("Wrong entry in audit log: %s", line)
+			return true
+		}
+		e.Who, e.Action, e.Target = a[1], a[2], a[3]
+		before, err1 := base64.StdEncoding.DecodeString(a[4])
+		after, err2 := base64.StdEncoding.DecodeString(a[5])
+		if err1 != nil || err2 != nil {
+			Error.Printf("Wrong entry in audit log: %s", line)
+			return true
+		}
+		e.Before, e.After = string(before), string(after)
+		if f == nil || f.Match(&e) {
+			list = append(list, e)
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return list, nil
+}
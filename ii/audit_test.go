@@ -0,0 +1,69 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	adb := OpenAudit(dir + "/audit.log")
+	if list, err := adb.Select(nil); err != nil || len(list) != 0 {
+		t.Error("Wrong empty audit log")
+	}
+	if adb.Log("admin", "edit:x", "id", "", "") == nil {
+		t.Error("Wrong entry is accepted")
+	}
+	if err := adb.Log("admin", "blacklist", "id", "text:\nwith lines", ""); err != nil {
+		t.Fatal(err)
+	}
+	udb := OpenUsers(dir+"/points.txt", "")
+	if err := udb.Add("alice", "alice@example.com", "alice", "status/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := adb.LogUser("ii-tool", "user/approve", udb, "alice", func() error {
+		return udb.Moderate("alice", "approve")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if adb.LogUser("ii-tool", "user/bad", udb, "alice", func() error {
+		return udb.Moderate("alice", "bad")
+	}) == nil {
+		t.Error("Error of action is lost")
+	}
+	list, err := OpenAudit(adb.Path).Select(nil)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("Wrong audit log: %v", list)
+	}
+	if e := list[0]; e.Who != "admin" || e.Before != "text:\nwith lines" || e.After != "" {
+		t.Errorf("Wrong entry: %v", e)
+	}
+	if e := list[1]; e.Target != "alice" || !strings.HasPrefix(e.Before, "status/new/") ||
+		!strings.HasPrefix(e.After, "status/verified/") || e.Date == 0 {
+		t.Errorf("Wrong user entry: %v", e)
+	}
+	for f, nr := range map[AuditFilter]int{
+		{Who: "admin"}:                  1,
+		{Action: "user"}:                1,
+		{Action: "use"}:                 0,
+		{Target: "alice"}:               1,
+		{Since: list[1].Date + 1}:       0,
+		{Until: list[0].Date}:           2,
+		{Who: "admin", Target: "alice"}: 0,
+	} {
+		if l, _ := adb.Select(&f); len(l) != nr {
+			t.Errorf("Wrong filter %v: %d", f, len(l))
+		}
+	}
+	var null *ADB
+	if null.Log("admin", "blacklist", "id", "", "") != nil {
+		t.Error("Nil audit log")
+	}
+}
@@ -0,0 +1,211 @@
+// Block words rules.
+// Rules file (blackwords.txt) has lines:
+// <targets>:<action>:<reason>:<regexp>
+// Targets are comma separated fields of message: subj, body, from,
+// addr, echo. Actions are:
+// reject: message is rejected with reason;
+// quarantine: message is put in premoderation queue;
+// blacklist: message is stored blacklisted (messages from other nodes
+// are rejected in premoderation queue, so bundles are not changed);
+// tag/<key>/<value>...: tags are added to local message.
+// For example:
+// subj,body:reject:No advertising here:(?i)casino
+// addr:blacklist:Known spammer:^spam,1$
+// Lines without targets are regexps for body with reject action
+// (old format of blackwords file). Lines started with # are comments.
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Fields of message which can be checked by block rules.
+var BlockTargets = []string{"subj", "body", "from", "addr", "echo"}
+
+// Block words rule. See description of rules file.
+// Tags: tags added by tag action.
+type BlockRule struct {
+	Targets []string
+	Action  string
+	Tags    string
+	Reason  string
+	Re      *regexp.Regexp
+}
+
+// Error returned for message matched by block rule.
+type RuleError struct {
+	Rule *BlockRule
+}
+
+func (e *RuleError) Error() string {
+	return e.Rule.Reason
+}
+
+// Get block rule from error returned by EDB.Access or rules filter.
+// Returns nil if error is not caused by rule.
+func MatchedRule(err error) *BlockRule {
+	var re *RuleError
+	if errors.As(err, &re) {
+		return re.Rule
+	}
+	return nil
+}
+
+func is_target(s string) bool {
+	for _, v := range BlockTargets {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse line of rules file.
+func parseBlockRule(line string) (*BlockRule, error) {
+	a := strings.SplitN(line, ":", 4)
+	targets := strings.Split(a[0], ",")
+	for _, v := range targets {
+		if len(a) < 4 || !is_target(v) { /* old format: regexp for body */
+			re, err := regexp.Compile(line)
+			if err != nil {
+				return nil, err
+			}
+			return &BlockRule{Targets: []string{"body"}, Action: "reject",
+				Reason: "Message contains blocked words", Re: re}, nil
+		}
+	}
+	r := &BlockRule{Targets: targets, Action: a[1], Reason: a[2]}
+	if strings.HasPrefix(r.Action, "tag/") {
+		r.Action, r.Tags = "tag", r.Action[4:]
+		if _, err := MakeTags(r.Tags); err != nil || r.Tags == "" {
+			return nil, errors.New("Wrong tags: " + r.Tags)
+		}
+	} else if r.Action != "reject" && r.Action != "quarantine" &&
+		r.Action != "blacklist" {
+		return nil, errors.New("Wrong action: " + r.Action)
+	}
+	if r.Reason == "" {
+		return nil, errors.New("No reason")
+	}
+	re, err := regexp.Compile(a[3])
+	if err != nil {
+		return nil, err
+	}
+	r.Re = re
+	return r, nil
+}
+
+// Check if rule matches message.
+func (r *BlockRule) Match(m *Msg) bool {
+	for _, t := range r.Targets {
+		var v string
+		switch t {
+		case "subj":
+			v = m.Subj
+		case "body":
+			v = m.Text
+		case "from":
+			v = m.From
+		case "addr":
+			v = m.Addr
+		case "echo":
+			v = m.Echo
+		}
+		if r.Re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Line of rules file for rule.
+func (r *BlockRule) String() string {
+	action := r.Action
+	if action == "tag" {
+		action += "/" + r.Tags
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", strings.Join(r.Targets, ","),
+		action, r.Reason, r.Re)
+}
+
+// Apply block rules to message from other node. The first matched
+// rule with action other than tag is returned as RuleError.
+// In dry run mode matches are only logged.
+func (db *EDB) CheckRules(m *Msg) error {
+	db.Sync.RLock()
+	defer db.Sync.RUnlock()
+	return db.checkRules(m, false)
+}
+
+// Internal function of CheckRules. Tags of matched tag rules
+// are added only to local messages.
+func (db *EDB) checkRules(m *Msg, local bool) error {
+	for _, r := range db.BlockRules {
+		if !r.Match(m) {
+			continue
+		}
+		if db.DryRun {
+			Info.Printf("Dry run: rule %s matches %s from %s (%s)",
+				r, m.MsgId, m.Addr, r.Reason)
+			continue
+		}
+		if r.Action == "tag" {
+			if local {
+				m.Tags.Add(r.Tags)
+			}
+			continue
+		}
+		return &RuleError{Rule: r}
+	}
+	return nil
+}
+
+// Filter for DB.Filter: applies block rules to fetched messages
+// (see ApplyRule).
+func (db *EDB) Filter(pdb *DB) func(m *Msg) error {
+	return func(m *Msg) error {
+		return ApplyRule(m, pdb, MatchedRule(db.CheckRules(m)))
+	}
+}
+
+// Do action of block rule r (can be nil) for message from other node.
+// Tags are not added to messages stored in db, so the same bundle
+// is kept by all nodes. Rejected messages get RuleError,
+// quarantined messages are put in premoderation queue pdb
+// (rejected if pdb is nil) and get ErrQuarantined. Messages
+// matched by blacklist rules are stored in pdb as rejected (so
+// they are not fetched again and spam filter is trained on them)
+// and get RuleError.
+func ApplyRule(m *Msg, pdb *DB, r *BlockRule) error {
+	if r == nil {
+		return nil
+	}
+	Info.Printf("Rule %s: %s from %s (%s)", r.Action, m.MsgId, m.Addr, r.Reason)
+	switch r.Action {
+	case "blacklist":
+		if pdb == nil || pdb.Exists(m.MsgId) != nil {
+			break
+		}
+		m.Tags.Add(r.Tag() + "/moderation/rejected")
+		if err := pdb.Blacklist(m); err != nil {
+			return err
+		}
+	case "quarantine":
+		if pdb == nil {
+			break
+		}
+		if err := Quarantine(pdb, m, r.Tag()); err != nil {
+			return err
+		}
+		return ErrQuarantined
+	}
+	return &RuleError{Rule: r}
+}
+
+// Tag for quarantined messages: rule/<reason>.
+func (r *BlockRule) Tag() string {
+	return "rule/" + strings.NewReplacer("/", " ", ":", " ").Replace(r.Reason)
+}
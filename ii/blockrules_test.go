@@ -0,0 +1,109 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlockRules(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/list.txt", []byte("std.test:0:Test\nstd.news:0:News\n"), 0644)
+	rules := "# comment\n" +
+		"subj,body:reject:No advertising:(?i)casino\n" +
+		"addr:blacklist:Known spammer:^spam,1$\n" +
+		"body:quarantine:Links are checked:https?://\n" +
+		"echo:tag/flag/news:News:^std\\.news$\n" +
+		"pills\n"
+	ioutil.WriteFile(dir+"/blackwords.txt", []byte(rules), 0644)
+	edb := LoadEcholist(dir + "/list.txt")
+	edb.LoadBlockwords(dir + "/blackwords.txt")
+	if len(edb.BlockRules) != 5 {
+		t.Fatalf("Wrong rules: %v", edb.BlockRules)
+	}
+	msg := func(echo string, addr string, subj string, text string) *Msg {
+		m := &Msg{Echo: echo, From: "user", Addr: addr, To: "All",
+			Subj: subj, Text: text, Tags: NewTags("ii/ok")}
+		m.Encode()
+		return m
+	}
+	for _, c := range []struct {
+		m      *Msg
+		action string
+	}{
+		{msg("std.test", "node,2", "CASINO", "text"), "reject"},
+		{msg("std.test", "node,2", "subj", "buy pills"), "reject"},
+		{msg("std.test", "spam,1", "subj", "text"), "blacklist"},
+		{msg("std.test", "node,2", "subj", "see http://example.com"), "quarantine"},
+		{msg("std.news", "node,2", "subj", "text"), ""},
+	} {
+		r := MatchedRule(edb.Access(c.m, nil, nil))
+		if (r == nil && c.action != "") || (r != nil && r.Action != c.action) {
+			t.Errorf("%s: wrong rule: %v", c.m.Subj+" "+c.m.Text, r)
+		}
+	}
+	if err := edb.Access(msg("std.test", "node,2", "casino", ""), nil, nil); err == nil ||
+		err.Error() != "No advertising" {
+		t.Errorf("Wrong reason: %v", err)
+	}
+	m := msg("std.news", "node,2", "subj", "text")
+	if edb.Access(m, &User{Name: "user"}, nil) != nil {
+		t.Error("Tag rule rejects message")
+	}
+	if v, _ := m.Tag("flag"); v != "news" {
+		t.Error("Tag is not added")
+	}
+	m = msg("std.news", "node,2", "subj", "text")
+	if edb.Access(m, nil, nil) != nil || m.Tags.String() != "ii/ok" {
+		t.Errorf("Tag is added to message of other node: %s", m.Tags)
+	}
+	ioutil.WriteFile(dir+"/policy.txt", []byte("*:size/10\n"), 0644)
+	edb.LoadPolicy(dir + "/policy.txt")
+	if err := edb.Access(msg("std.test", "spam,1", "subj", "long long text"),
+		nil, nil); err == nil || MatchedRule(err) != nil {
+		t.Errorf("Policy is not checked for blacklisted message: %v", err)
+	}
+	edb.LoadPolicy(dir + "/none.txt")
+	if _, err := parseBlockwords(dir + "/list.txt"); err != nil {
+		t.Error("Old format is not accepted")
+	}
+	ioutil.WriteFile(dir+"/wrong.txt", []byte("body:drop:Reason:x\nbody:reject::x\n"), 0644)
+	if words, err := parseBlockwords(dir + "/wrong.txt"); err == nil || len(words) != 0 {
+		t.Error("Wrong rules are accepted")
+	}
+
+	db := OpenDB(dir + "/db")
+	pdb := OpenDB(dir + "/pending")
+	db.Store(msg("std.test", "node,2", "first", "text"))
+	db.Filter = edb.Filter(pdb)
+	if err := db.Store(msg("std.test", "node,2", "casino", "")); MatchedRule(err) == nil {
+		t.Errorf("Fetched message is not rejected: %v", err)
+	}
+	q := msg("std.test", "node,2", "link", "http://example.com")
+	if err := db.Store(q); err != ErrQuarantined || pdb.Lookup(q.MsgId) == nil {
+		t.Errorf("Fetched message is not quarantined: %v", err)
+	}
+	if v, _ := pdb.Get(q.MsgId).Tag("rule"); v != "Links are checked" {
+		t.Errorf("Wrong rule tag: %s", v)
+	}
+	b := msg("std.test", "spam,1", "subj", "text")
+	if err := db.Store(b); MatchedRule(err) == nil || db.Exists(b.MsgId) != nil ||
+		pdb.Exists(b.MsgId) == nil || pdb.Lookup(b.MsgId) != nil {
+		t.Errorf("Fetched message is not blacklisted: %v", err)
+	}
+	n := msg("std.news", "node,2", "news", "text")
+	if err := db.Store(n); err != nil || db.Get(n.MsgId).Tags.String() != "ii/ok" {
+		t.Errorf("Fetched message is changed: %v", err)
+	}
+
+	edb.DryRun = true
+	d := msg("std.test", "node,2", "casino", "")
+	if err := db.Store(d); err != nil || db.Lookup(d.MsgId) == nil {
+		t.Errorf("Message is rejected in dry run mode: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Bookmarks and saved searches of users.
+// All bookmarks are stored in one file with lines:
+// <user id>:m:<msgid>
+// <user id>:s:<name>:<search query>
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Saved search. Query is in search language (see ParseSearch).
+type SavedSearch struct {
+	Name  string
+	Query string
+}
+
+// Bookmarks of one user.
+// Msgs: bookmarked message ids.
+// Searches: saved searches.
+type Bookmarks struct {
+	Msgs     []string
+	Searches []SavedSearch
+}
+
+// Bookmarks database.
+// Users: bookmarks by user id.
+type BDB struct {
+	FileDB
+	Users map[int32]*Bookmarks
+}
+
+// Returns true if message is bookmarked.
+func (b *Bookmarks) Marked(id string) bool {
+	for _, v := range b.Msgs {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns saved search by name or nil.
+func (b *Bookmarks) Search(name string) *SavedSearch {
+	for i := range b.Searches {
+		if b.Searches[i].Name == name {
+			return &b.Searches[i]
+		}
+	}
+	return nil
+}
+
+// Check name of saved search
+func IsSearchName(name string) bool {
+	return name != "" && len(name) <= 64 &&
+		!strings.ContainsAny(name, ":/\r\n\t")
+}
+
+// Open bookmarks database.
+func OpenBookmarks(path string) *BDB {
+	return &BDB{FileDB: FileDB{Path: path, Name: "bookmarks"}}
+}
+
+// Internal function. Load bookmarks if file was changed. Does not lock!
+func (db *BDB) _Load() error {
+	users := make(map[int32]*Bookmarks)
+	read, err := db._Read(db.Users != nil, func(line string) bool {
+		a := strings.SplitN(line, ":", 4)
+		var id int32
+		if len(a) < 3 {
+			Error.Printf("Wrong entry in bookmarks: %s", line)
+			return true
+		}
+		if _, err := fmt.Sscanf(a[0], "%d", &id); err != nil {
+			Error.Printf("Wrong ID in bookmarks: %s", a[0])
+			return true
+		}
+		b, ok := users[id]
+		if !ok {
+			b = &Bookmarks{}
+			users[id] = b
+		}
+		switch {
+		case a[1] == "m" && IsMsgId(a[2]):
+			b.Msgs = append(b.Msgs, a[2])
+		case a[1] == "s" && len(a) == 4 && IsSearchName(a[2]):
+			b.Searches = append(b.Searches, SavedSearch{Name: a[2], Query: a[3]})
+		default:
+			Error.Printf("Wrong entry in bookmarks: %s", line)
+		}
+		return true
+	})
+	if read {
+		db.Users = users
+	}
+	return err
+}
+
+// Get bookmarks of user (copy). Reloads bookmarks if needed.
+func (db *BDB) Get(id int32) *Bookmarks {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	b := &Bookmarks{}
+	if err := db._Load(); err != nil {
+		return b
+	}
+	if v, ok := db.Users[id]; ok {
+		b.Msgs = append(b.Msgs, v.Msgs...)
+		b.Searches = append(b.Searches, v.Searches...)
+	}
+	return b
+}
+
+// Internal function. Save all bookmarks atomically. Does not lock!
+func (db *BDB) _Save() error {
+	var text string
+	var ids []int32
+	for id := range db.Users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		b := db.Users[id]
+		for _, m := range b.Msgs {
+			text += fmt.Sprintf("%d:m:%s\n", id, m)
+		}
+		for _, s := range b.Searches {
+			text += fmt.Sprintf("%d:s:%s:%s\n", id, s.Name, s.Query)
+		}
+	}
+	return db._Write(text, db._Load)
+}
+
+// Modify bookmarks of user with id. Modifications are
+// done under lock with fresh copy of bookmarks.
+func (db *BDB) Modify(id int32, fn func(b *Bookmarks) error) error {
+	return db.modify(db._Load, func() error {
+		b, ok := db.Users[id]
+		if !ok {
+			b = &Bookmarks{}
+			db.Users[id] = b
+		}
+		return fn(b)
+	}, db._Save)
+}
+
+// Bookmark message.
+func (db *BDB) AddMsg(id int32, msgid string) error {
+	if !IsMsgId(msgid) {
+		return errors.New("Wrong message id")
+	}
+	return db.Modify(id, func(b *Bookmarks) error {
+		if b.Marked(msgid) {
+			return nil
+		}
+		b.Msgs = append(b.Msgs, msgid)
+		return nil
+	})
+}
+
+// Remove message from bookmarks.
+func (db *BDB) DelMsg(id int32, msgid string) error {
+	return db.Modify(id, func(b *Bookmarks) error {
+		for i, v := range b.Msgs {
+			if v == msgid {
+				b.Msgs = append(b.Msgs[:i], b.Msgs[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("No such bookmark")
+	})
+}
+
+// Save search. Search with the same name is replaced.
+func (db *BDB) AddSearch(id int32, name string, query string) error {
+	if !IsSearchName(name) {
+		return errors.New("Wrong search name")
+	}
+	query = strings.TrimSpace(query)
+	if query == "" || strings.ContainsAny(query, "\r\n") {
+		return errors.New("Wrong search query")
+	}
+	return db.Modify(id, func(b *Bookmarks) error {
+		if s := b.Search(name); s != nil {
+			s.Query = query
+			return nil
+		}
+		b.Searches = append(b.Searches, SavedSearch{Name: name, Query: query})
+		return nil
+	})
+}
+
+// Remove saved search.
+func (db *BDB) DelSearch(id int32, name string) error {
+	return db.Modify(id, func(b *Bookmarks) error {
+		for i, v := range b.Searches {
+			if v.Name == name {
+				b.Searches = append(b.Searches[:i], b.Searches[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("No such search")
+	})
+}
@@ -0,0 +1,52 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBookmarks(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	bdb := OpenBookmarks(dir + "/bookmarks.txt")
+	id := "a5OX4lC8uB8OIzzzGQ5B"
+	if err := bdb.AddMsg(1, id); err != nil {
+		t.Fatal(err)
+	}
+	bdb.AddMsg(1, id)
+	if bdb.AddMsg(1, "bad") == nil {
+		t.Error("Wrong msgid accepted")
+	}
+	if err := bdb.AddSearch(1, "mine", "from:alice echo:std.test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range [][2]string{{"", "q"}, {"a:b", "q"}, {"name", ""}, {"name", "a\nb"}} {
+		if bdb.AddSearch(1, v[0], v[1]) == nil {
+			t.Errorf("Wrong search accepted: %q", v)
+		}
+	}
+	bdb.AddSearch(1, "mine", "from:bob")
+	bdb2 := OpenBookmarks(bdb.Path) // other process
+	b := bdb2.Get(1)
+	if len(b.Msgs) != 1 || !b.Marked(id) || len(b.Searches) != 1 ||
+		b.Search("mine").Query != "from:bob" {
+		t.Errorf("Wrong bookmarks: %v", b)
+	}
+	if len(bdb2.Get(2).Msgs) != 0 {
+		t.Error("Bookmarks of other user")
+	}
+	if err := bdb2.DelMsg(1, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := bdb2.DelSearch(1, "mine"); err != nil {
+		t.Fatal(err)
+	}
+	if b := bdb.Get(1); len(b.Msgs) != 0 || len(b.Searches) != 0 {
+		t.Error("Bookmarks are not removed")
+	}
+}
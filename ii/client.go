@@ -0,0 +1,272 @@
+// HTTP client for IDEC requests.
+package ii
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when response is bigger than Client.MaxSize.
+var ErrTooLarge = errors.New("Response is too large")
+
+// Node replied with not 2xx HTTP status.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+// Node replied with IDEC error (for example, point message
+// or pushed messages are not accepted).
+type IDECError struct {
+	URL string
+	Msg string
+}
+
+func (e *IDECError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Msg)
+}
+
+// HTTP client of node.
+// HTTP: http client (transport, proxy), default one is used if nil;
+// Timeout: timeout of request (if HTTP is nil);
+// Retries: number of retries for network errors and 5xx statuses
+// (only for requests which can be repeated);
+// Backoff: delay before first retry, it is doubled for next ones;
+// UserAgent: User-Agent header;
+// MaxSize: max size of response in bytes (0 - unlimited);
+// MaxRequests: max parallel requests of client (0 - unlimited);
+// MaxPerHost: max parallel requests to one host (0 - unlimited).
+// Client with limits can be shared by nodes.
+type Client struct {
+	HTTP        *http.Client
+	Timeout     time.Duration
+	Retries     int
+	Backoff     time.Duration
+	UserAgent   string
+	MaxSize     int64
+	MaxRequests int
+	MaxPerHost  int
+
+	sync  sync.Mutex
+	slots chan struct{}
+	hosts map[string]chan struct{}
+}
+
+// Client with default settings.
+func NewClient() *Client {
+	return &Client{Timeout: 60 * time.Second, Retries: 2, Backoff: time.Second,
+		UserAgent: "ii-go", MaxSize: 64 * 1024 * 1024}
+}
+
+// Client with proxy (url, for example: http://proxy:3128 or
+// socks5://127.0.0.1:9050) and default settings.
+func NewProxyClient(proxy string) (*Client, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient()
+	c.HTTP = &http.Client{Timeout: c.Timeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	return c, nil
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return &http.Client{Timeout: c.Timeout}
+}
+
+// Wait for free slots of limits (global and host).
+// Returns function to free them.
+func (c *Client) acquire(ctx context.Context, host string) (func(), error) {
+	var sems []chan struct{}
+	c.sync.Lock()
+	if c.MaxRequests > 0 {
+		if c.slots == nil {
+			c.slots = make(chan struct{}, c.MaxRequests)
+		}
+		sems = append(sems, c.slots)
+	}
+	if c.MaxPerHost > 0 {
+		if c.hosts == nil {
+			c.hosts = make(map[string]chan struct{})
+		}
+		if c.hosts[host] == nil {
+			c.hosts[host] = make(chan struct{}, c.MaxPerHost)
+		}
+		sems = append(sems, c.hosts[host])
+	}
+	c.sync.Unlock()
+	release := func(sems []chan struct{}) {
+		for _, s := range sems {
+			<-s
+		}
+	}
+	for i, s := range sems {
+		select {
+		case s <- struct{}{}:
+		case <-ctx.Done():
+			release(sems[:i])
+			return nil, ctx.Err()
+		}
+	}
+	return func() { release(sems) }, nil
+}
+
+// Body of response which frees slots of request on close.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Do request and check status. Request is repeated if retry is true.
+// Caller must close body of response.
+func (c *Client) do(ctx context.Context, method string, u string,
+	form url.Values, retry bool) (*http.Response, error) {
+	delay := c.Backoff
+	for try := 0; ; try++ {
+		var body io.Reader
+		if form != nil {
+			body = strings.NewReader(form.Encode())
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if c.UserAgent != "" {
+			req.Header.Set("User-Agent", c.UserAgent)
+		}
+		release, err := c.acquire(ctx, req.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+		Trace.Printf("%s %s", method, u)
+		resp, err := c.http().Do(req)
+		if err == nil && resp.StatusCode/100 == 2 {
+			resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+		release()
+		if err == nil {
+			resp.Body.Close()
+			err = &HTTPError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+			if resp.StatusCode/100 != 5 {
+				return nil, err
+			}
+		}
+		if !retry || try >= c.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+		Info.Printf("Retry %s in %s: %s", u, delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Limit reader by MaxSize.
+func (c *Client) limit(r io.Reader) io.Reader {
+	if c.MaxSize <= 0 {
+		return r
+	}
+	return &limitReader{r: r, n: c.MaxSize}
+}
+
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			return 0, ErrTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// Make GET request and call fn for every line of response.
+// Stops on EOF or fn return false.
+func (c *Client) Lines(ctx context.Context, u string, fn func(string) bool) error {
+	resp, err := c.do(ctx, "GET", u, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(c.limit(resp.Body))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if err == io.EOF {
+			if line != "" { /* node do not send final \n */
+				fn(line)
+			}
+			break
+		}
+		if !fn(line) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *Client) read(ctx context.Context, method string, u string,
+	form url.Values, retry bool) ([]byte, error) {
+	resp, err := c.do(ctx, method, u, form, retry)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(c.limit(resp.Body))
+}
+
+// Make GET request and return response.
+func (c *Client) Get(ctx context.Context, u string) ([]byte, error) {
+	return c.read(ctx, "GET", u, nil, true)
+}
+
+// Make POST request with form and return response.
+// Request is repeated on errors only if retry is true.
+func (c *Client) Post(ctx context.Context, u string, form url.Values, retry bool) ([]byte, error) {
+	return c.read(ctx, "POST", u, form, retry)
+}
@@ -0,0 +1,98 @@
+package ii
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	var fails int32
+	var agent atomic.Value
+	mux := http.NewServeMux()
+	mux.HandleFunc("/x/features", func(w http.ResponseWriter, r *http.Request) {
+		agent.Store(r.Header.Get("User-Agent"))
+		w.Write([]byte("u/e\nlist.txt\n"))
+	})
+	mux.HandleFunc("/list.txt", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("std.test:1:test\n"))
+	})
+	mux.HandleFunc("/u/e/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<html>\n<body>Not found</body>\n</html>\n"))
+	})
+	mux.HandleFunc("/u/point", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("error: wrong pauth"))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1024)))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := &Client{Timeout: 5 * time.Second, Retries: 2, Backoff: time.Millisecond,
+		UserAgent: "ii-test", MaxSize: 512}
+	n, err := Connect(ctx, srv.URL, c)
+	if err != nil || !n.IsFeature("u/e") || agent.Load() != "ii-test" {
+		t.Fatalf("Can not connect: %v", err)
+	}
+	atomic.StoreInt32(&fails, 2)
+	if list, err := n.List(ctx); err != nil || len(list) != 1 || list[0] != "std.test" {
+		t.Errorf("Request is not retried: %v %v", list, err)
+	}
+	atomic.StoreInt32(&fails, 3)
+	_, err = n.List(ctx)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Wrong error after retries: %v", err)
+	}
+
+	db := OpenDB(dir + "/db")
+	n.Force = true
+	if _, err := n.Fetch(ctx, db, []string{"std.test"}, 0); !errors.As(err, &herr) {
+		t.Errorf("Wrong error for not found: %v", err)
+	}
+	if ids := db.SelectIDS(&Query{NoAccess: true}); len(ids) != 0 {
+		t.Errorf("Not found page is parsed as ids: %v", ids)
+	}
+	if _, err := n.get_id(ctx, srv.URL+"/u/e/std.test/-1:1"); !errors.As(err, &herr) ||
+		herr.StatusCode != http.StatusNotFound {
+		t.Errorf("Wrong error for not found: %v", err)
+	}
+
+	var ierr *IDECError
+	if err := n.Post(ctx, "secret", "std.test\nAll\nsubj\n\ntext"); !errors.As(err, &ierr) ||
+		ierr.Msg != "error: wrong pauth" {
+		t.Errorf("Wrong error of point message: %v", err)
+	}
+	if _, err := c.Get(ctx, srv.URL+"/big"); err != ErrTooLarge {
+		t.Errorf("Size of response is not limited: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := Connect(cctx, srv.URL, c); err == nil {
+		t.Error("Request with cancelled context")
+	}
+	if _, err := n.Fetch(cctx, db, []string{"std.test"}, 0); err != context.Canceled {
+		t.Errorf("Fetch is not cancelled: %v", err)
+	}
+}
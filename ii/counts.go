@@ -0,0 +1,219 @@
+// History of echo counts (x/c) and last messages of nodes. Fetch
+// does not fetch echoes which counts and last messages are not
+// changed since last fetch. Position of db (see DB.Position) at
+// last push to node is saved too.
+// File has lines:
+// <url> <echo>:<count>:<last msgid>
+// <url> push:<position>
+package ii
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Max number of echoes in one x/c request.
+const COUNTS_BATCH = 64
+
+// Count of messages and id of last message of echo on node.
+type EchoCount struct {
+	Count int
+	Last  string
+}
+
+// Echo counts database.
+// Nodes: counts of echoes by node url.
+// Pushed: position of db at last push by node url.
+type CDB struct {
+	FileDB
+	Nodes  map[string]map[string]EchoCount
+	Pushed map[string]int64
+}
+
+// Open echo counts database.
+func OpenCounts(path string) *CDB {
+	return &CDB{FileDB: FileDB{Path: path, Name: "counts"}}
+}
+
+// Internal function. Load counts if file was changed. Does not lock!
+func (db *CDB) _Load() error {
+	nodes := make(map[string]map[string]EchoCount)
+	pushed := make(map[string]int64)
+	read, err := db._Read(db.Nodes != nil, func(line string) bool {
+		a := strings.Fields(line)
+		var c []string
+		if len(a) == 2 {
+			c = strings.Split(a[1], ":")
+		}
+		if len(c) == 2 && c[0] == "push" {
+			t, err := strconv.ParseInt(c[1], 10, 64)
+			if err != nil {
+				Error.Printf("Wrong entry in counts: %s", line)
+				return true
+			}
+			pushed[a[0]] = t
+			return true
+		}
+		if len(c) != 3 || !IsEcho(c[0]) {
+			Error.Printf("Wrong entry in counts: %s", line)
+			return true
+		}
+		nr, err := strconv.Atoi(c[1])
+		if err != nil {
+			Error.Printf("Wrong entry in counts: %s", line)
+			return true
+		}
+		if nodes[a[0]] == nil {
+			nodes[a[0]] = make(map[string]EchoCount)
+		}
+		nodes[a[0]][c[0]] = EchoCount{Count: nr, Last: c[2]}
+		return true
+	})
+	if read {
+		db.Nodes = nodes
+		db.Pushed = pushed
+	}
+	return err
+}
+
+// Get counts of echoes of node (copy).
+func (db *CDB) Get(url string) map[string]EchoCount {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	counts := make(map[string]EchoCount)
+	if err := db._Load(); err != nil {
+		return counts
+	}
+	for k, v := range db.Nodes[url] {
+		counts[k] = v
+	}
+	return counts
+}
+
+// Internal function. Save all counts atomically. Does not lock!
+func (db *CDB) _Save() error {
+	var text string
+	var urls []string
+	seen := make(map[string]bool)
+	for u := range db.Nodes {
+		urls = append(urls, u)
+		seen[u] = true
+	}
+	for u := range db.Pushed {
+		if !seen[u] {
+			urls = append(urls, u)
+		}
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		if t, ok := db.Pushed[u]; ok {
+			text += fmt.Sprintf("%s push:%d\n", u, t)
+		}
+		var echoes []string
+		for e := range db.Nodes[u] {
+			echoes = append(echoes, e)
+		}
+		sort.Strings(echoes)
+		for _, e := range echoes {
+			c := db.Nodes[u][e]
+			text += fmt.Sprintf("%s %s:%d:%s\n", u, e, c.Count, c.Last)
+		}
+	}
+	return db._Write(text, db._Load)
+}
+
+// Modify counts under lock with fresh copy of them and save.
+func (db *CDB) Modify(fn func()) error {
+	return db.modify(db._Load, func() error {
+		fn()
+		return nil
+	}, db._Save)
+}
+
+// Set counts of echoes of node. File is rewritten under lock.
+func (db *CDB) Set(url string, counts map[string]EchoCount) error {
+	return db.Modify(func() {
+		db.Nodes[url] = make(map[string]EchoCount)
+		for k, v := range counts {
+			db.Nodes[url][k] = v
+		}
+	})
+}
+
+// Get position of db at last push to node (0 if unknown).
+func (db *CDB) GetPushed(url string) int64 {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if err := db._Load(); err != nil {
+		return 0
+	}
+	return db.Pushed[url]
+}
+
+// Set position of db at last push to node.
+func (db *CDB) SetPushed(url string, pos int64) error {
+	return db.Modify(func() {
+		db.Pushed[url] = pos
+	})
+}
+
+// Get counts of echoes with x/c requests (COUNTS_BATCH echoes
+// per request). Echoes which are absent on node have count 0.
+func (n *Node) EchoCounts(ctx context.Context, echoes []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	for len(echoes) > 0 {
+		nr := len(echoes)
+		if nr > COUNTS_BATCH {
+			nr = COUNTS_BATCH
+		}
+		for _, e := range echoes[:nr] {
+			counts[e] = 0
+		}
+		if err := n.client().Lines(ctx, n.Host+"/x/c/"+strings.Join(echoes[:nr], "/"),
+			func(line string) bool {
+				a := strings.Split(line, ":")
+				if len(a) < 2 || !IsEcho(a[0]) {
+					return true
+				}
+				if c, err := strconv.Atoi(a[1]); err == nil {
+					if _, ok := counts[a[0]]; ok {
+						counts[a[0]] = c
+					}
+				}
+				return true
+			}); err != nil {
+			return nil, err
+		}
+		echoes = echoes[nr:]
+	}
+	return counts, nil
+}
+
+// Get ids of last messages of echoes with batched u/e requests
+// (COUNTS_BATCH echoes per request). Empty echoes are absent.
+func (n *Node) LastIds(ctx context.Context, echoes []string) (map[string]string, error) {
+	last := make(map[string]string)
+	for len(echoes) > 0 {
+		nr := len(echoes)
+		if nr > COUNTS_BATCH {
+			nr = COUNTS_BATCH
+		}
+		echo := ""
+		if err := n.client().Lines(ctx, n.Host+"/u/e/"+strings.Join(echoes[:nr], "/")+"/-1:1",
+			func(line string) bool {
+				if IsEcho(line) {
+					echo = line
+				} else if echo != "" && IsMsgId(line) {
+					last[echo] = line
+				}
+				return true
+			}); err != nil {
+			return nil, err
+		}
+		echoes = echoes[nr:]
+	}
+	return last, nil
+}
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -55,6 +56,7 @@ type Index struct {
 // Sync: used to syncronize access to DB from goroutines (many readers, one writer).
 // IdxSync: same, but for Index.
 // LockDepth: used for recursive file lock, to avoid conflict between ii-tool and ii-node.
+// Acl: echo database with read access rights, optional (see Access).
 type DB struct {
 	Path      string
 	Idx       Index
@@ -62,6 +64,9 @@ type DB struct {
 	IdxSync   sync.RWMutex
 	Name      string
 	LockDepth int32
+	Acl       *EDB
+	Stored    func(m *Msg)       // called after new message is stored
+	Filter    func(m *Msg) error // called before new message is stored, error rejects it
 }
 
 // Utility function. Just append line (text) to file (fn)
@@ -77,6 +82,19 @@ func append_file(fn string, text string) error {
 	return nil
 }
 
+// Same as append_file, but syncs file after write.
+func append_file_sync(fn string, text string) error {
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text + "\n"); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
 func filesize(fn string) (int64, error) {
 	var fsize int64
 	file, err := os.Open(fn)
@@ -97,33 +115,99 @@ func filesize(fn string) (int64, error) {
 	return fsize, nil
 }
 
-// Recursive file lock. Used to avoid conflicts between ii-tool and ii-node.
-// Uses mkdir as atomic operation.
-// Note: dirs created as db.LockPath()
-// 16 sec is limit.
-func (db *DB) Lock() bool {
-	if atomic.AddInt32(&db.LockDepth, 1) > 1 {
+// Returns true if file fn was changed since info was taken:
+// size, modification time or file itself (rename) is different.
+// Also returns new information about file (nil if there is no file).
+func file_changed(fn string, info os.FileInfo) (bool, os.FileInfo, error) {
+	ninfo, err := os.Stat(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info != nil, nil, nil
+		}
+		Error.Printf("Can not stat %s file: %s", fn, err)
+		return false, info, err
+	}
+	if info == nil || !os.SameFile(info, ninfo) ||
+		info.Size() != ninfo.Size() || !info.ModTime().Equal(ninfo.ModTime()) {
+		return true, ninfo, nil
+	}
+	return false, info, nil
+}
+
+// Replace file fn with text atomically.
+// Text is written in unique temp file in the same directory,
+// then synced and renamed to fn.
+func replace_file(fn string, text string) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.WriteString(text); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		if fi, e := os.Stat(fn); e == nil {
+			err = os.Chmod(tmp, fi.Mode())
+		} else {
+			err = os.Chmod(tmp, 0644)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(fn)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Recursive file lock implementation. depth is a lock counter.
+// Uses mkdir as atomic operation. 16 sec is limit.
+func lock_path(path string, depth *int32) bool {
+	if atomic.AddInt32(depth, 1) > 1 {
 		return true
 	}
-	try := 16
+	try := 16 * 20
 	for try > 0 {
-		if err := os.Mkdir(db.LockPath(), 0777); err == nil {
+		if err := os.Mkdir(path, 0777); err == nil {
 			return true
 		}
-		time.Sleep(time.Second)
+		time.Sleep(time.Second / 20)
 		try -= 1
 	}
-	Error.Printf("Can not acquire lock for 16 seconds: %s", db.LockPath())
+	Error.Printf("Can not acquire lock for 16 seconds: %s", path)
 	return false
 }
 
+// Recursive file lock: unlock. See lock_path.
+func unlock_path(path string, depth *int32) {
+	if atomic.AddInt32(depth, -1) > 0 {
+		return
+	}
+	os.Remove(path)
+}
+
+// Recursive file lock. Used to avoid conflicts between ii-tool and ii-node.
+// Uses mkdir as atomic operation.
+// Note: dirs created as db.LockPath()
+// 16 sec is limit.
+func (db *DB) Lock() bool {
+	return lock_path(db.LockPath(), &db.LockDepth)
+}
+
 // Recursive file lock: unlock
 // See Lock comment.
 func (db *DB) Unlock() {
-	if atomic.AddInt32(&db.LockDepth, -1) > 0 {
-		return
-	}
-	os.Remove(db.LockPath())
+	unlock_path(db.LockPath(), &db.LockDepth)
 }
 
 // Returns path to index file.
@@ -385,6 +469,33 @@ func (db *DB) Exists(Id string) *MsgInfo {
 	return db._Lookup(Id, true, true)
 }
 
+// Position of db for incremental reading: offset after the last
+// record of db. Messages which are stored or edited later have
+// offsets (see MsgInfo.Off) not less than position.
+// Does lock!
+func (db *DB) Position() int64 {
+	db.Sync.RLock()
+	defer db.Sync.RUnlock()
+	db.Lock()
+	defer db.Unlock()
+	if err := db.LoadIndex(); err != nil {
+		return 0
+	}
+	db.IdxSync.RLock()
+	defer db.IdxSync.RUnlock()
+	var pos int64
+	for _, mi := range db.Idx.Hash {
+		off := mi.Off
+		if off < 0 {
+			off = -off
+		}
+		if off >= pos {
+			pos = off + 1
+		}
+	}
+	return pos
+}
+
 // Lookup messages in index.
 // Gets: slice of message ids to get.
 // Returns slice of MsgInfo pointers.
@@ -415,10 +526,20 @@ func (db *DB) _GetBundle(Id string, idx bool, bl bool) (string, *MsgInfo) {
 		Info.Printf("Can not find bundle: %s\n", Id)
 		return "", nil
 	}
+	bundle := db._ReadBundle(info)
+	if bundle == "" {
+		return "", nil
+	}
+	return bundle, info
+}
+
+// Internal function. Reads bundle by index entry.
+// Does not lock and does not touch index!
+func (db *DB) _ReadBundle(info *MsgInfo) string {
 	f, err := os.Open(db.BundlePath())
 	if err != nil {
 		Error.Printf("Can not open DB: %s\n", err)
-		return "", nil
+		return ""
 	}
 	defer f.Close()
 	off := info.Off
@@ -428,7 +549,7 @@ func (db *DB) _GetBundle(Id string, idx bool, bl bool) (string, *MsgInfo) {
 	_, err = f.Seek(off, 0)
 	if err != nil {
 		Error.Printf("Can not seek DB: %s\n", err)
-		return "", nil
+		return ""
 	}
 	var bundle string
 	err = f_lines(f, func(line string) bool {
@@ -436,10 +557,10 @@ func (db *DB) _GetBundle(Id string, idx bool, bl bool) (string, *MsgInfo) {
 		return false
 	})
 	if err != nil {
-		Error.Printf("Can not get %s from DB: %s\n", Id, err)
-		return "", nil
+		Error.Printf("Can not get %s from DB: %s\n", info.Id, err)
+		return ""
 	}
-	return bundle, info
+	return bundle
 }
 
 // Get bundle line by message id from db.
@@ -477,6 +598,32 @@ func (db *DB) GetBundleInfo(Id string) (string, *MsgInfo) {
 	return db._GetBundle(Id, true, false)
 }
 
+// Get bundle line by message id from db, if user can read it.
+// Returns "" if there is no such message or access is denied.
+// See Access. Does lock!
+func (db *DB) GetBundleAccess(Id string, user *User) string {
+	b, info := db.GetBundleInfo(Id)
+	if b == "" || !db.Access(info, user) {
+		return ""
+	}
+	return b
+}
+
+// Get decoded message from db by message id, if user can read it.
+// Returns nil if there is no such message or access is denied.
+// All read paths for users should use this function. See Access.
+func (db *DB) GetAccess(Id string, user *User) *Msg {
+	bundle := db.GetBundleAccess(Id, user)
+	if bundle == "" {
+		return nil
+	}
+	m, err := DecodeBundle(bundle)
+	if err != nil {
+		Error.Printf("Can not decode bundle on get: %s\n", Id)
+	}
+	return m
+}
+
 // Get decoded message from db by message id.
 // Does lock. Loads/create index if needed.
 func (db *DB) Get(Id string) *Msg {
@@ -506,6 +653,42 @@ func (db *DB) GetFast(Id string) *Msg {
 	return m
 }
 
+// Read bundles of messages by ids (not blacklisted) in order of
+// their offsets with one open file and pass them to fn.
+// Stops if fn returns false. Bundles are only appended to db file,
+// so it is read without lock of db. Locks only for lookup of ids.
+func (db *DB) ReadBundles(ids []string, fn func(string) bool) error {
+	info := db.LookupIDS(ids)
+	sort.Slice(info, func(i, j int) bool { return info[i].Off < info[j].Off })
+	f, err := os.Open(db.BundlePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var pos int64
+	for _, i := range info {
+		if i.Off != pos {
+			if _, err := f.Seek(i.Off, 0); err != nil {
+				return err
+			}
+			reader.Reset(f)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		pos = i.Off + int64(len(line))
+		if !fn(strings.TrimSuffix(line, "\n")) {
+			break
+		}
+	}
+	return nil
+}
+
 // Query used to make queries to Index
 // If some field of: Echo, Repto, From, To is not ""
 // fields will be matched with MsgInfo entry (logical AND).
@@ -517,6 +700,9 @@ func (db *DB) GetFast(Id string) *Msg {
 // Count: if non 0: dec by 1 and match until 0 -> -1
 // User: authorized access to private areas.
 // Start & Lim: slice of query. For example: -1, 1 -- get last message in db. 0, 1 -- first.
+// Filter: if not nil, messages selected by index are decoded and
+// filtered by this function (without lock of db, see ReadBundles),
+// Start & Lim are applied after it.
 type Query struct {
 	Echo        string
 	Repto       string
@@ -531,6 +717,7 @@ type Query struct {
 	User        User
 	Invert      bool
 	Match       func(mi *MsgInfo, q *Query) bool
+	Filter      func(m *Msg) bool
 }
 
 // utility function to add string in front of slice
@@ -541,8 +728,30 @@ func prependStr(x []string, y string) []string {
 	return x
 }
 
-// Check if message is private
+// Returns point address of user on this node.
+func (db *DB) Addr(user *User) string {
+	return fmt.Sprintf("%s,%d", db.Name, user.Id)
+}
+
+// Read access policy. Check if user can read message.
+// Blacklisted messages can not be read at all,
+// for other rules see AreaAccess.
+// user can be nil or empty User for anonymous access.
 func (db *DB) Access(info *MsgInfo, user *User) bool {
+	if info == nil || info.Off < 0 {
+		return false
+	}
+	return db.AreaAccess(info, user)
+}
+
+// Check if user can read message in its echoarea.
+// Private areas are readable only by sender and recipient
+// (or by all points if message is addressed to All).
+// Echoes with read ACL in Acl are readable only by listed points.
+func (db *DB) AreaAccess(info *MsgInfo, user *User) bool {
+	if user == nil {
+		user = &User{}
+	}
 	if IsPrivate(info.Echo) {
 		if user.Name == "" {
 			return false
@@ -551,6 +760,9 @@ func (db *DB) Access(info *MsgInfo, user *User) bool {
 			return false
 		}
 	}
+	if db.Acl != nil && !db.Acl.ReadAccess(info.Echo, user, db.Addr(user)) {
+		return false
+	}
 	return true
 }
 
@@ -582,7 +794,7 @@ func (db *DB) _Match(info *MsgInfo, r *Query) bool {
 	if r.From != "" && r.From != info.From {
 		return false
 	}
-	if !r.NoAccess && !db.Access(info, &r.User) {
+	if !r.NoAccess && !db.AreaAccess(info, &r.User) {
 		return false
 	}
 	ret := true
@@ -713,6 +925,9 @@ func (db *DB) Echoes(names []string, q *Query) []*Echo {
 // Does lock. Can create/load index if needed.
 // r: request, see Query
 func (db *DB) SelectIDS(r *Query) []string {
+	if r.Filter != nil {
+		return db.selectFilter(r)
+	}
 	var Resp []string
 	db.Sync.Lock()
 	defer db.Sync.Unlock()
@@ -763,6 +978,43 @@ func (db *DB) SelectIDS(r *Query) []string {
 	return Resp
 }
 
+// Internal function. SelectIDS with Filter: ids are selected by
+// index, then messages are read and filtered, then sliced.
+func (db *DB) selectFilter(r *Query) []string {
+	q := *r
+	q.Filter, q.Start, q.Lim = nil, 0, 0
+	ids := db.SelectIDS(&q)
+	found := make(map[string]bool)
+	if err := db.ReadBundles(ids, func(b string) bool {
+		if m, err := DecodeBundle(b); err == nil && r.Filter(m) {
+			found[m.MsgId] = true
+		}
+		return true
+	}); err != nil {
+		Error.Printf("Can not read messages: %s", err)
+		return nil
+	}
+	var Resp []string
+	for _, id := range ids {
+		if found[id] {
+			Resp = append(Resp, id)
+		}
+	}
+	if r.Start < 0 && len(Resp) > -r.Start {
+		Resp = Resp[len(Resp)+r.Start:]
+	} else if r.Start > 0 {
+		start := r.Start
+		if start > len(Resp) {
+			start = len(Resp)
+		}
+		Resp = Resp[start:]
+	}
+	if r.Lim > 0 && len(Resp) > r.Lim {
+		Resp = Resp[:r.Lim]
+	}
+	return Resp
+}
+
 // Internal function. Get slice of MsgInfo pointers
 // and create information about topics.
 // Information returns in form of: [topicid][]ids
@@ -834,7 +1086,18 @@ func (db *DB) GetTopics(mi []*MsgInfo) map[string][]string {
 // Store decoded message in database
 // If message exists, returns error
 func (db *DB) Store(m *Msg) error {
-	return db._Store(m, false)
+	if db.Filter != nil {
+		if err := db.Filter(m); err != nil {
+			return err
+		}
+	}
+	if err := db._Store(m, false); err != nil {
+		return err
+	}
+	if db.Stored != nil {
+		db.Stored(m)
+	}
+	return nil
 }
 
 // Store decoded message in database
@@ -942,25 +1205,33 @@ type UserPolicy struct {
 }
 
 // User database.
-// FileSize - size of points.txt to detect DB changes.
+// FileInfo - information about points.txt to detect DB changes
+// (size, modification time and file itself), see LoadUsers.
 // Names: holds User structure by user name
 // ById: holds user name by user id
 // Secrets: holds user name by user secret (pauth)
+// Feeds: holds user name by token of RSS feeds (see FeedToken)
 // List: holds user names as list
+// Locked: registration is locked (by !lock line or by NewUsersMax)
+// Closed: registration is locked by !lock line
+// LockDepth: used for recursive file lock, see DB.Lock.
 type UDB struct {
 	Path        string
 	PolicyPath  string
 	Names       map[string]User
 	ById        map[int32]string
 	Secrets     map[string]string
+	Feeds       map[string]string
 	List        []string
 	Sync        sync.RWMutex
-	FileSize    int64
+	FileInfo    os.FileInfo
 	Policy      []*UserPolicy
-	PolFileSize int64
+	PolicyInfo  os.FileInfo
 	NewUsersMax int
 	NewUsers    int
 	Locked      bool
+	Closed      bool
+	LockDepth   int32
 }
 
 // Check username if it is valid
@@ -1039,6 +1310,22 @@ func (db *UDB) UserInfo(Secret string) *User {
 	return nil
 }
 
+// Secret token for RSS feeds of user. Token does not reveal secret.
+func FeedToken(u *User) string {
+	return MakeSecret("feed:" + u.Secret)
+}
+
+// Return User pointer for RSS feed token (see FeedToken) or nil.
+func (db *UDB) UserInfoFeed(token string) *User {
+	db.Sync.RLock()
+	defer db.Sync.RUnlock()
+	if name, ok := db.Feeds[token]; ok {
+		v := db.Names[name]
+		return &v
+	}
+	return nil
+}
+
 // Return User pointer for user id
 func (db *UDB) UserInfoId(id int32) *User {
 	db.Sync.RLock()
@@ -1083,13 +1370,12 @@ var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z
 
 // Add (register) user in database
 // Mail is optional but someday it will be used in registration process
+// Does lock (file lock too), so it is safe to call it
+// from different processes.
 func (db *UDB) Add(Name string, Mail string, Passwd string, Info string) error {
 	db.Sync.Lock()
 	defer db.Sync.Unlock()
 
-	if _, ok := db.Names[Name]; ok {
-		return errors.New("User already exists")
-	}
 	if !IsUsername(Name) {
 		return errors.New("Wrong username")
 	}
@@ -1099,6 +1385,16 @@ func (db *UDB) Add(Name string, Mail string, Passwd string, Info string) error {
 	if !emailRegex.MatchString(Mail) {
 		return errors.New("Wrong email")
 	}
+	if !db.Lock() {
+		return errors.New("Can not lock user DB")
+	}
+	defer db.Unlock()
+	if err := db._LoadUsers(); err != nil {
+		return err
+	}
+	if _, ok := db.Names[Name]; ok {
+		return errors.New("User already exists")
+	}
 	if db.Locked {
 		return errors.New("Maximum new users reached")
 	}
@@ -1114,12 +1410,14 @@ func (db *UDB) Add(Name string, Mail string, Passwd string, Info string) error {
 	u.Mail = Mail
 	u.Secret = MakeSecret(Name + Passwd)
 	u.Tags = NewTags(Info)
-	db.List = append(db.List, u.Name)
-	if err := append_file(db.Path, fmt.Sprintf("%d:%s:%s:%s:%s",
+	if _, ok := u.Tags.Get("reg"); !ok {
+		u.Tags.Add(fmt.Sprintf("reg/%d", time.Now().Unix()))
+	}
+	if err := append_file_sync(db.Path, fmt.Sprintf("%d:%s:%s:%s:%s",
 		id, Name, Mail, u.Secret, u.Tags.String())); err != nil {
 		return err
 	}
-	return nil
+	return db._LoadUsers()
 }
 
 // Open user database and return pointer to UDB object
@@ -1130,72 +1428,233 @@ func OpenUsers(path string, policy string) *UDB {
 	return &db
 }
 
-// Change (replace) information about user.
-// Gets pointer to User object and write it in DB, replacing old information.
-// Works atomically using rename.
-func (db *UDB) Edit(u *User) error {
-	db.Sync.Lock()
-	defer db.Sync.Unlock()
-	if _, ok := db.Names[u.Name]; !ok {
-		return errors.New("No such user")
+// Recursive file lock of user database.
+// Used to avoid conflicts between ii-tool and ii-node.
+// See DB.Lock comment.
+// Unlike DB.Lock, Unlock should not be called if Lock fails.
+func (db *UDB) Lock() bool {
+	if !lock_path(db.LockPath(), &db.LockDepth) {
+		atomic.AddInt32(&db.LockDepth, -1)
+		return false
+	}
+	return true
+}
+
+// Recursive file lock of user database: unlock
+func (db *UDB) Unlock() {
+	unlock_path(db.LockPath(), &db.LockDepth)
+}
+
+// Returns path to lock.
+func (db *UDB) LockPath() string {
+	pat := strings.Replace(db.Path, "/", "_", -1)
+	return fmt.Sprintf("%s/%s-users.lock", os.TempDir(), pat)
+}
+
+// Internal function. Write all users in DB, replacing file.
+// Users with status/remove are dropped.
+// Works atomically using rename. Does not lock!
+func (db *UDB) _Save() error {
+	var text string
+	if db.Closed {
+		text += "!lock\n"
 	}
-	db.Names[u.Name] = *u // new version
-	os.Remove(db.Path + ".tmp")
 	for _, Name := range db.List {
 		ui := db.Names[Name]
 		status, _ := ui.Tags.Get("status")
 		if status != "remove" {
-			if err := append_file(db.Path+".tmp", fmt.Sprintf("%d:%s:%s:%s:%s",
-				ui.Id, Name, ui.Mail, ui.Secret, ui.Tags.String())); err != nil {
-				return err
-			}
+			text += fmt.Sprintf("%d:%s:%s:%s:%s\n",
+				ui.Id, Name, ui.Mail, ui.Secret, ui.Tags.String())
 		}
 	}
-	if err := os.Rename(db.Path+".tmp", db.Path); err != nil {
+	if err := replace_file(db.Path, text); err != nil {
 		return err
 	}
-	db.FileSize = 0 // force to reload
-	return nil
+	db.FileInfo = nil // force to reload
+	return db._LoadUsers()
 }
 
-// Load policy information in memory if it is needed (PolFileSize changed).
-// So, it is safe to call it on every request.
-func (db *UDB) loadPolicy() error {
-	var fsize int64
-	if db.PolicyPath == "" {
-		return nil
+// Change information about user.
+// Reloads DB, calls fn with user and writes DB back.
+// If fn returns error, nothing is written.
+// Does lock (file lock too), so it is safe to call it
+// from different processes.
+func (db *UDB) Modify(name string, fn func(u *User) error) error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if !db.Lock() {
+		return errors.New("Can not lock user DB")
 	}
-	fsize, err := filesize(db.PolicyPath)
-	if fsize < 0 {
+	defer db.Unlock()
+	if err := db._LoadUsers(); err != nil {
 		return err
 	}
-	if db.PolFileSize == fsize {
+	u, ok := db.Names[name]
+	if !ok {
+		return errors.New("No such user")
+	}
+	if err := fn(&u); err != nil {
+		return err
+	}
+	u.Name = name
+	db.Names[name] = u // new version
+	return db._Save()
+}
+
+// Change (replace) information about user.
+// Gets pointer to User object and write it in DB, replacing old information.
+// Works atomically using rename.
+func (db *UDB) Edit(u *User) error {
+	return db.Modify(u.Name, func(o *User) error {
+		*o = *u
 		return nil
+	})
+}
+
+// Set new password for user.
+func (db *UDB) Passwd(name string, passwd string) error {
+	if !IsPassword(passwd) {
+		return errors.New("Bad password")
 	}
-	db.PolFileSize = fsize
-	db.Policy = make([]*UserPolicy, 0, 1)
+	return db.Modify(name, func(u *User) error {
+		u.Secret = MakeSecret(name + passwd)
+		return nil
+	})
+}
 
-	err = FileLines(db.PolicyPath, func(line string) bool {
+// Set user tag t to value v.
+func (db *UDB) SetTag(name string, t string, v string) error {
+	if t == "" || strings.ContainsAny(t+v, "/:\n") {
+		return errors.New("Wrong tag")
+	}
+	return db.Modify(name, func(u *User) error {
+		return u.Tags.Add(t + "/" + v)
+	})
+}
+
+// Remove user tag t.
+func (db *UDB) DelTag(name string, t string) error {
+	return db.Modify(name, func(u *User) error {
+		if !u.Tags.Del(t) {
+			return errors.New("No such tag")
+		}
+		return nil
+	})
+}
+
+// Moderation actions, used by web interface and ii-tool.
+// approve: verify new user;
+// moderate: allow only few messages (limit/3);
+// block: do not allow messages at all;
+// unblock: verify blocked user;
+// remove: remove user from DB.
+var ModerateActions = []string{"approve", "moderate", "block", "unblock", "remove"}
+
+// Do moderation action on user. See ModerateActions.
+func (db *UDB) Moderate(name string, action string) error {
+	return db.Modify(name, func(u *User) error {
+		switch action {
+		case "moderate":
+			u.Tags.Add("limit/3")
+			u.Tags.Add("status/moderated")
+		case "unblock":
+			u.Tags.Add("status/verified")
+			u.Tags.Del("limit")
+		case "block":
+			u.Tags.Add("status/blocked")
+			u.Tags.Add("limit/0")
+		case "remove":
+			u.Tags.Add("status/remove")
+		case "approve":
+			u.Tags.Del("limit")
+			u.Tags.Add("status/verified")
+		default:
+			return errors.New("Wrong action: " + action)
+		}
+		return nil
+	})
+}
+
+// Lock (closed is true) or unlock registration of new users.
+// Writes or removes !lock line in DB.
+func (db *UDB) SetClosed(closed bool) error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if !db.Lock() {
+		return errors.New("Can not lock user DB")
+	}
+	defer db.Unlock()
+	if err := db._LoadUsers(); err != nil {
+		return err
+	}
+	db.Closed = closed
+	return db._Save()
+}
+
+// Parse users policy file. Returns rules and maximum of new users
+// (-1 if not set). Wrong entries are skipped, the first of them
+// is returned as error.
+func parsePolicy(path string) ([]*UserPolicy, int, error) {
+	var perr error
+	policy := make([]*UserPolicy, 0, 1)
+	max := -1
+	wrong := func(line string) {
+		Error.Printf("Wrong entry in user policy DB: %s", line)
+		if perr == nil {
+			perr = fmt.Errorf("%s: wrong entry: %s", path, line)
+		}
+	}
+	err := FileLines(path, func(line string) bool {
 		a := strings.Split(line, ":")
 		if len(a) < 4 {
-			if len(a) == 1 {
-				n, _ := strconv.Atoi(line)
-				db.NewUsersMax = n
-			} else {
-				Error.Printf("Wrong entry in user policy DB: %s", line)
+			if len(a) != 1 {
+				wrong(line)
+			} else if n, err := strconv.Atoi(line); err == nil {
+				max = n
+			} else if line != "" {
+				wrong(line)
 			}
 			return true
 		}
 		var up UserPolicy
-		up.Name, _ = regexp.Compile(a[0])
-		up.Mail, _ = regexp.Compile(a[1])
-		up.Country, _ = regexp.Compile(a[2])
+		var err [3]error
+		up.Name, err[0] = regexp.Compile(a[0])
+		up.Mail, err[1] = regexp.Compile(a[1])
+		up.Country, err[2] = regexp.Compile(a[2])
+		if err[0] != nil || err[1] != nil || err[2] != nil {
+			wrong(line)
+			return true
+		}
 		up.Status = a[3]
-		db.Policy = append(db.Policy, &up)
+		policy = append(policy, &up)
 		return true
 	})
+	if err != nil {
+		return nil, -1, err
+	}
+	return policy, max, perr
+}
 
-	return nil
+// Load policy information in memory if it is needed (file changed).
+// So, it is safe to call it on every request. If policy file has
+// errors, previous policy is kept. Returns true if policy is changed.
+func (db *UDB) loadPolicy() (bool, error) {
+	if db.PolicyPath == "" {
+		return false, nil
+	}
+	changed, info, err := file_changed(db.PolicyPath, db.PolicyInfo)
+	if err != nil || !changed {
+		return false, err
+	}
+	db.PolicyInfo = info /* do not retry until next change */
+	policy, max, err := parsePolicy(db.PolicyPath)
+	if err != nil {
+		Error.Printf("Policy is not reloaded: %s", err)
+		return false, err
+	}
+	db.Policy = policy
+	db.NewUsersMax = max
+	return true, nil
 }
 
 func (db *UDB) UserStatus(name string, mail string, country string) string {
@@ -1209,31 +1668,54 @@ func (db *UDB) UserStatus(name string, mail string, country string) string {
 	return "status/new"
 }
 
-// Load user information in memory if it is needed (FileSize changed).
+// Load user information in memory if it is needed (file changed).
 // So, it is safe to call it on every request.
 func (db *UDB) LoadUsers() error {
 	db.Sync.Lock()
 	defer db.Sync.Unlock()
-	fsize, err := filesize(db.Path)
-	if fsize < 0 {
+	return db._LoadUsers()
+}
+
+// Force reload of users and policy, even if files look unchanged.
+// Returns error of policy file, previous policy is kept in this case.
+func (db *UDB) Reload() error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	db.FileInfo = nil
+	db.PolicyInfo = nil
+	_, perr := db.loadPolicy()
+	if err := db._LoadUsers(); err != nil {
 		return err
 	}
-	if db.FileSize == fsize {
+	return perr
+}
+
+// Internal function to implement LoadUsers. Does not lock!
+func (db *UDB) _LoadUsers() error {
+	if db.Names == nil {
+		db.NewUsersMax = -1
+	}
+	pchanged, _ := db.loadPolicy()
+	changed, info, err := file_changed(db.Path, db.FileInfo)
+	if err != nil {
+		return err
+	}
+	if !changed && !pchanged && db.Names != nil {
 		return nil
 	}
 	db.Names = make(map[string]User)
 	db.Secrets = make(map[string]string)
+	db.Feeds = make(map[string]string)
 	db.ById = make(map[int32]string)
 	db.List = nil
 	db.Locked = false
-	db.NewUsersMax = -1
-
-	db.loadPolicy()
+	db.Closed = false
 
 	db.NewUsers = 0
 	err = FileLines(db.Path, func(line string) bool {
 		if strings.HasPrefix(line, "!lock") {
 			db.Locked = true
+			db.Closed = true
 			return true
 		}
 		a := strings.Split(line, ":")
@@ -1262,6 +1744,7 @@ func (db *UDB) LoadUsers() error {
 		db.ById[u.Id] = u.Name
 		db.Names[u.Name] = u
 		db.Secrets[u.Secret] = u.Name
+		db.Feeds[FeedToken(&u)] = u.Name
 		db.List = append(db.List, u.Name)
 		return true
 	})
@@ -1269,94 +1752,196 @@ func (db *UDB) LoadUsers() error {
 		Error.Printf("Can not read user DB: %s", err)
 		return errors.New(err.Error())
 	}
-	db.FileSize = fsize
+	db.FileInfo = info
 	return nil
 }
 
+// Echo access rights.
+// Allow: addresses of points that can create topics.
+// Read: addresses of points that can read echo. Empty - everyone.
+// Write: echo is writable.
+// Field: second field of echolist line, it is kept as is.
 type EDBPerm struct {
 	Allow []string
+	Read  []string
 	Write bool
+	Field string
 }
 
 // Echo database entry
 // Holds echo descriptions in Info hash.
 // Perm - access rights
 // List - names of echoareas.
+// Policy - posting policies of echoes (see EchoPolicy).
+// BlockRules - block words rules (see BlockRule), DryRun - only log
+// matches of rules.
+// Configuration is swapped under Sync lock on Reload, maps are never
+// changed in place, so use Snapshot to read them while node is running.
 type EDB struct {
 	Perm       map[string]*EDBPerm
 	List       []string
 	Info       map[string]string
 	Path       string
-	BlockWords []*regexp.Regexp
+	BlockRules []*BlockRule
+	BlockPath  string
+	DryRun     bool
+	Policy     map[string]Tags
+	PolicyPath string
+	FileInfo   os.FileInfo
+	BlockInfo  os.FileInfo
+	PolicyInfo os.FileInfo
+	Sync       sync.RWMutex
+}
+
+// Check if we can create message in DB.
+// Returns nil or error with the reason. Block rules are checked
+// (RuleError is returned, tags of tag rules are added to local
+// messages). Posting policy of echo is checked too, even if message
+// matches quarantine or blacklist rule: u is author (can be nil
+// for messages from other nodes), mdb is database for rate limits
+// (can be nil).
+func (db *EDB) Access(m *Msg, u *User, mdb *DB) error {
+	db = db.Snapshot() /* policy check reads mdb, do not hold lock */
+	repto, _ := m.Tag("repto")
+	policy := db.echoPolicy(m.Echo)
+	topic := repto == ""
+	if len(db.List) != 0 {
+		perm := db.Perm[m.Echo]
+		if perm == nil {
+			return errors.New("No such echo: " + m.Echo)
+		}
+		if len(perm.Allow) != 0 {
+			allowed := false
+			for _, v := range perm.Allow {
+				if m.Addr == v {
+					allowed = true
+				}
+			}
+			if !allowed && repto == "" {
+				return errors.New("Only allowed points can create topics in " + m.Echo)
+			}
+			if !allowed && !perm.Write { //  comment
+				return errors.New("Echo is read-only: " + m.Echo)
+			}
+			topic = false
+		} else if !perm.Write {
+			return errors.New("Echo is read-only: " + m.Echo)
+		}
+	}
+	err := db.checkRules(m, u != nil)
+	if r := MatchedRule(err); r != nil && r.Action == "reject" {
+		return err
+	}
+	if e := policy.Check(m, u, mdb, topic); e != nil {
+		return e
+	}
+	return err
 }
 
-// Check if we can create message in DB
-func (db *EDB) Access(m *Msg) bool {
-	if len(db.List) == 0 {
+// Check if user with address addr can read echo.
+// Echo without read ACL is readable by everyone.
+func (db *EDB) ReadAccess(echo string, user *User, addr string) bool {
+	db.Sync.RLock()
+	defer db.Sync.RUnlock()
+	perm := db.Perm[echo]
+	if perm == nil || len(perm.Read) == 0 {
 		return true
 	}
-	perm := db.Perm[m.Echo]
-	if perm == nil {
+	if user.Name == "" {
 		return false
 	}
-	if len(perm.Allow) != 0 {
-		for _, v := range perm.Allow {
-			if m.Addr == v {
-				return true
-			}
-		}
-		if r, _ := m.Tag("repto"); r != "" { //  comment
-			return perm.Write
-		}
-		return false
-	}
-	if !perm.Write {
-		return false
-	}
-	for _, re := range db.BlockWords {
-		if re.Match([]byte(m.Text)) {
-			return false
+	for _, v := range perm.Read {
+		if v == addr {
+			return true
 		}
 	}
-	return perm.Write
+	return false
 }
 
-// Loads block words
-// Supposed to be called only once
-func (db *EDB) LoadBlockwords(path string) {
-	db.BlockWords = make([]*regexp.Regexp, 0)
+// Return copy of current configuration.
+// It is consistent even if Reload happens while copy is used.
+func (db *EDB) Snapshot() *EDB {
+	db.Sync.RLock()
+	defer db.Sync.RUnlock()
+	return &EDB{Perm: db.Perm, List: db.List, Info: db.Info, Path: db.Path,
+		BlockRules: db.BlockRules, BlockPath: db.BlockPath, DryRun: db.DryRun,
+		Policy: db.Policy, PolicyPath: db.PolicyPath}
+}
 
-	FileLines(path, func(line string) bool {
-		re, _ := regexp.Compile(line)
-		if re != nil {
-			db.BlockWords = append(db.BlockWords, re)
+// Parse block words rules file (see BlockRule). Wrong rules are
+// skipped, the first of them is returned as error.
+func parseBlockwords(path string) ([]*BlockRule, error) {
+	var perr error
+	words := make([]*BlockRule, 0)
+	err := FileLines(path, func(line string) bool {
+		if line == "" || strings.HasPrefix(line, "#") {
+			return true
 		}
+		r, err := parseBlockRule(line)
+		if err != nil {
+			Error.Printf("Wrong entry in blockwords: %s", line)
+			if perr == nil {
+				perr = fmt.Errorf("%s: %s", path, err)
+			}
+			return true
+		}
+		words = append(words, r)
 		return true
 	})
+	if err != nil {
+		return nil, err
+	}
+	return words, perr
 }
 
-// Loads echolist database and returns pointer to EDB
-// Supposed to be called only once
-func LoadEcholist(path string) *EDB {
+// Loads block words
+// Supposed to be called once, use Reload to load changes.
+func (db *EDB) LoadBlockwords(path string) {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	db.BlockPath = path
+	db.BlockInfo, _ = os.Stat(path)
+	db.BlockRules, _ = parseBlockwords(path)
+}
+
+// Parse echolist file. Wrong entries are skipped,
+// the first of them is returned as error.
+func parseEcholist(path string) (*EDB, error) {
 	var db EDB
+	var perr error
 	db.Path = path
 	db.Perm = make(map[string]*EDBPerm)
 	db.Info = make(map[string]string)
 
 	err := FileLines(path, func(line string) bool {
+		if line == "" {
+			return true
+		}
 		a := strings.SplitN(line, ":", 3)
-		if len(a) < 2 {
+		if len(a) < 3 {
 			Error.Printf("Wrong entry in echo DB: %s", line)
+			if perr == nil {
+				perr = fmt.Errorf("%s: wrong entry: %s", path, line)
+			}
 			return true
 		}
-		perm := &EDBPerm{Allow: []string{}, Write: true}
+		perm := &EDBPerm{Allow: []string{}, Write: true, Field: a[1]}
 
-		access := strings.Split(a[0], "!")
 		e := a[0]
-		if len(access) > 0 {
-			e = access[0]
-			for _, v := range access[1:] {
-				perm.Allow = append(perm.Allow, v)
+		if i := strings.IndexAny(e, "!?"); i >= 0 {
+			e, a[0] = e[:i], e[i:]
+			for len(a[0]) > 0 {
+				kind := a[0][0]
+				v := a[0][1:]
+				a[0] = ""
+				if i := strings.IndexAny(v, "!?"); i >= 0 {
+					v, a[0] = v[:i], v[i:]
+				}
+				if kind == '?' {
+					perm.Read = append(perm.Read, v)
+				} else {
+					perm.Allow = append(perm.Allow, v)
+				}
 			}
 		}
 		if strings.HasPrefix(e, "-") {
@@ -1369,8 +1954,80 @@ func LoadEcholist(path string) *EDB {
 		return true
 	})
 	if err != nil {
+		return nil, err
+	}
+	return &db, perr
+}
+
+// Loads echolist database and returns pointer to EDB
+// Supposed to be called once, use Reload to load changes.
+func LoadEcholist(path string) *EDB {
+	db, err := parseEcholist(path)
+	if db == nil {
 		Error.Printf("Can not read echo DB: %s", err)
 		return nil
 	}
-	return &db
+	db.FileInfo, _ = os.Stat(path)
+	return db
+}
+
+// Reload echolist, block words and echo policy if files are changed
+// (or always if force is true). New configuration is swapped
+// under lock. If file can not be read or has wrong entries,
+// previous configuration is kept and error is returned.
+func (db *EDB) Reload(force bool) error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	var rerr error
+	if force {
+		db.FileInfo = nil
+		db.BlockInfo = nil
+		db.PolicyInfo = nil
+	}
+	if changed, info, err := file_changed(db.Path, db.FileInfo); err != nil {
+		rerr = err
+	} else if changed && info == nil {
+		Error.Printf("Echolist is not reloaded: %s is removed", db.Path)
+		db.FileInfo = nil
+		rerr = errors.New("No echolist: " + db.Path)
+	} else if changed {
+		db.FileInfo = info /* do not retry until next change */
+		if n, err := parseEcholist(db.Path); err != nil {
+			Error.Printf("Echolist is not reloaded: %s", err)
+			rerr = err
+		} else {
+			db.Perm, db.List, db.Info = n.Perm, n.List, n.Info
+			Info.Printf("Echolist %s reloaded", db.Path)
+		}
+	}
+	if db.PolicyPath != "" {
+		if changed, info, err := file_changed(db.PolicyPath, db.PolicyInfo); err != nil {
+			rerr = err
+		} else if changed {
+			db.PolicyInfo = info
+			if policy, err := parseEchoPolicy(db.PolicyPath); err != nil {
+				Error.Printf("Echo policy is not reloaded: %s", err)
+				rerr = err
+			} else {
+				db.Policy = policy
+				Info.Printf("Echo policy %s reloaded", db.PolicyPath)
+			}
+		}
+	}
+	if db.BlockPath == "" {
+		return rerr
+	}
+	if changed, info, err := file_changed(db.BlockPath, db.BlockInfo); err != nil {
+		rerr = err
+	} else if changed {
+		db.BlockInfo = info
+		if words, err := parseBlockwords(db.BlockPath); err != nil {
+			Error.Printf("Blockwords are not reloaded: %s", err)
+			rerr = err
+		} else {
+			db.BlockRules = words
+			Info.Printf("Blockwords %s reloaded", db.BlockPath)
+		}
+	}
+	return rerr
 }
@@ -1,9 +1,12 @@
 package ii
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestOpenDB(t *testing.T) {
@@ -67,3 +70,201 @@ func TestOpenDB(t *testing.T) {
 		return
 	}
 }
+
+func TestUsers(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Error("Can not create temp dir")
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/points.txt"
+	db := OpenUsers(path, "")
+	db.LoadUsers()
+	if err := db.Add("admin", "admin@example.com", "pw", "status/verified"); err != nil {
+		t.Error("Can not add user", err)
+		return
+	}
+	db.LoadUsers()
+	if err := db.Add("user", "user@example.com", "pw", "status/new"); err != nil {
+		t.Error("Can not add user", err)
+		return
+	}
+	if err := db.SetClosed(true); err != nil || !db.Locked {
+		t.Error("Can not lock registration", err)
+		return
+	}
+	if err := db.Moderate("user", "block"); err != nil {
+		t.Error("Can not block user", err)
+		return
+	}
+	if err := db.Passwd("user", "newpw"); err != nil {
+		t.Error("Can not change password", err)
+		return
+	}
+	db2 := OpenUsers(path, "") // another process
+	db2.LoadUsers()
+	if err := db2.SetTag("admin", "limit", "10"); err != nil {
+		t.Error("Can not set tag", err)
+		return
+	}
+	db.LoadUsers()
+	if !db.Closed || !db.Auth("user", "newpw") {
+		t.Error("Lost changes")
+		return
+	}
+	if v, _ := db.UserInfoName("user").Tags.Get("status"); v != "blocked" {
+		t.Error("Lost status", v)
+		return
+	}
+	if v, _ := db.UserInfoName("admin").Tags.Get("limit"); v != "10" {
+		t.Error("Lost tag", v)
+		return
+	}
+	if err := db.Moderate("user", "remove"); err != nil ||
+		db.UserInfoName("user") != nil {
+		t.Error("Can not remove user", err)
+		return
+	}
+}
+
+func TestUsersConcurrent(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Error("Can not create temp dir")
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/points.txt"
+	adm := OpenUsers(path, "")
+	adm.LoadUsers()
+	if err := adm.Add("admin", "admin@example.com", "pw", "status/verified"); err != nil {
+		t.Error("Can not add user", err)
+		return
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for p := 0; p < 2; p++ { // two "processes"
+		db := OpenUsers(path, "")
+		db.LoadUsers()
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				errs <- db.Add(fmt.Sprintf("user%d_%d", p, i),
+					"user@example.com", "pw", "status/new")
+				errs <- db.SetTag("admin", fmt.Sprintf("tag%d", p), fmt.Sprint(i))
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("Concurrent write failed", err)
+			return
+		}
+	}
+	db := OpenUsers(path, "")
+	db.LoadUsers()
+	if len(db.List) != 21 || len(db.ById) != 21 {
+		t.Error("Lost users", len(db.List), len(db.ById))
+		return
+	}
+	ui := db.UserInfoName("admin")
+	if v, _ := ui.Tags.Get("tag0"); v != "9" {
+		t.Error("Lost tag", v)
+	}
+	if v, _ := ui.Tags.Get("tag1"); v != "9" {
+		t.Error("Lost tag", v)
+	}
+	// same size edit must be detected
+	if err := db.Passwd("user0_0", "pX"); err != nil {
+		t.Error("Can not change password", err)
+		return
+	}
+	adm.LoadUsers()
+	if !adm.Auth("user0_0", "pX") {
+		t.Error("Same size edit is not detected")
+	}
+}
+
+func TestEcholistReload(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, text string, age int) {
+		path := dir + "/" + name
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		d := time.Now().Add(time.Duration(age) * time.Second)
+		os.Chtimes(path, d, d)
+	}
+	write("list.txt", "std.test:0:Test\n", -10)
+	write("blackwords.txt", "spam\n", -10)
+	edb := LoadEcholist(dir + "/list.txt")
+	edb.LoadBlockwords(dir + "/blackwords.txt")
+	m := &Msg{Echo: "std.new", Text: "eggs"}
+	if edb.Access(m, nil, nil) == nil {
+		t.Error("Access to unknown echo")
+	}
+	snap := edb.Snapshot()
+	write("list.txt", "std.test:0:Test\nstd.new:0:New\n", -5)
+	write("blackwords.txt", "eggs\n", -5)
+	if err := edb.Reload(false); err != nil {
+		t.Fatal(err)
+	}
+	if edb.Access(&Msg{Echo: "std.new", Text: "spam"}, nil, nil) != nil || edb.Access(m, nil, nil) == nil {
+		t.Error("Echolist or blockwords are not reloaded")
+	}
+	if len(snap.List) != 1 || snap.Info["std.new"] != "" {
+		t.Error("Snapshot is changed by reload")
+	}
+	write("list.txt", "std.test:0:Test\nwrong\n", 0)
+	write("blackwords.txt", "(\n", 0)
+	if edb.Reload(false) == nil {
+		t.Error("Wrong configuration is accepted")
+	}
+	if s := edb.Snapshot(); len(s.List) != 2 || s.Info["std.new"] != "New" || edb.Access(m, nil, nil) == nil {
+		t.Error("Previous configuration is dropped")
+	}
+	os.Remove(dir + "/list.txt")
+	if edb.Reload(true) == nil || len(edb.Snapshot().List) != 2 {
+		t.Error("Removed echolist is accepted")
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	policy := dir + "/policy.txt"
+	ioutil.WriteFile(policy, []byte("^admin$:::status/verified\n"), 0644)
+	db := OpenUsers(dir+"/points.txt", policy)
+	db.LoadUsers()
+	if db.UserStatus("admin", "", "") != "status/verified" {
+		t.Fatal("Policy is not loaded")
+	}
+	ioutil.WriteFile(policy, []byte("^bob$:::status/verified\n1\n"), 0644)
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if db.UserStatus("admin", "", "") != "status/new" ||
+		db.UserStatus("bob", "", "") != "status/verified" || db.NewUsersMax != 1 {
+		t.Error("Policy is not reloaded")
+	}
+	ioutil.WriteFile(policy, []byte("^(alice:::status/verified\n"), 0644)
+	if db.Reload() == nil || db.UserStatus("bob", "", "") != "status/verified" ||
+		db.NewUsersMax != 1 {
+		t.Error("Wrong policy is accepted")
+	}
+}
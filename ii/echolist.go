@@ -0,0 +1,210 @@
+// Editing of echolist (list.txt).
+// Echolist is rewritten atomically in the same format, see LoadEcholist.
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Echo area as it is written in echolist.
+// Write: echo is writable (no - prefix).
+// Allow: points that can create topics (!addr).
+// Read: points that can read echo (?addr).
+// Field: second field of line ("0" for new echoes).
+type EchoArea struct {
+	Name  string
+	Desc  string
+	Write bool
+	Allow []string
+	Read  []string
+	Field string
+}
+
+// Actions of EDB.Edit, used by web interface and ii-tool.
+// add: create echo with description;
+// desc: change description;
+// readonly, writable: forbid or allow posting;
+// allow: only listed points can create topics (empty - everyone);
+// read: only listed points can read echo (empty - everyone);
+// archive: make echo read-only and move it to the end of list;
+// move: move echo to position (1 - first);
+// remove: remove echo from list (messages are kept).
+var EchoActions = []string{"add", "desc", "readonly", "writable", "allow",
+	"read", "archive", "move", "remove"}
+
+// Check if string is valid address of point.
+func IsAddr(addr string) bool {
+	return addr != "" && strings.Contains(addr, ",") &&
+		!strings.ContainsAny(addr, ":!? \r\n\t")
+}
+
+// Line of echolist for echo area.
+func (e *EchoArea) String() string {
+	l := e.Name
+	if !e.Write {
+		l = "-" + l
+	}
+	for _, v := range e.Allow {
+		l += "!" + v
+	}
+	for _, v := range e.Read {
+		l += "?" + v
+	}
+	f := e.Field
+	if f == "" {
+		f = "0"
+	}
+	return l + ":" + f + ":" + e.Desc
+}
+
+// Check if echo area can be written to echolist.
+func (e *EchoArea) Valid() error {
+	if !IsEcho(e.Name) || strings.ContainsAny(e.Name, "!?/ \r\n\t") ||
+		strings.HasPrefix(e.Name, "-") {
+		return errors.New("Wrong echo name: " + e.Name)
+	}
+	if strings.ContainsAny(e.Desc, "\r\n") {
+		return errors.New("Wrong description")
+	}
+	if strings.ContainsAny(e.Field, ":\r\n") {
+		return errors.New("Wrong field: " + e.Field)
+	}
+	for _, v := range append(append([]string{}, e.Allow...), e.Read...) {
+		if !IsAddr(v) {
+			return errors.New("Wrong address: " + v)
+		}
+	}
+	return nil
+}
+
+// Echo areas in order of echolist.
+func (db *EDB) Areas() []*EchoArea {
+	s := db.Snapshot()
+	var list []*EchoArea
+	for _, e := range s.List {
+		perm := s.Perm[e]
+		list = append(list, &EchoArea{Name: e, Desc: s.Info[e], Write: perm.Write,
+			Allow: perm.Allow, Read: perm.Read, Field: perm.Field})
+	}
+	return list
+}
+
+func (db *EDB) LockPath() string {
+	pat := strings.Replace(db.Path, "/", "_", -1)
+	return fmt.Sprintf("%s/%s-echo.lock", os.TempDir(), pat)
+}
+
+// Change echolist.
+// Rereads echolist, calls fn with echo areas and writes the returned
+// list back (atomically, using rename). New echolist is loaded
+// in memory. If echolist has wrong lines, it is not changed:
+// they would be lost. If fn returns error, nothing is written.
+// Does lock (file lock too), so it is safe to call it
+// from different processes.
+func (db *EDB) Modify(fn func(list []*EchoArea) ([]*EchoArea, error)) error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	var depth int32
+	if !lock_path(db.LockPath(), &depth) {
+		return errors.New("Can not lock echolist")
+	}
+	defer unlock_path(db.LockPath(), &depth)
+	cur, err := parseEcholist(db.Path)
+	if err != nil {
+		return err
+	}
+	cur.BlockRules, cur.BlockPath = db.BlockRules, db.BlockPath
+	list, err := fn(cur.Areas())
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	var text string
+	for _, e := range list {
+		if err := e.Valid(); err != nil {
+			return err
+		}
+		if names[e.Name] {
+			return errors.New("Duplicate echo: " + e.Name)
+		}
+		names[e.Name] = true
+		text += e.String() + "\n"
+	}
+	if err := replace_file(db.Path, text); err != nil {
+		return err
+	}
+	n, err := parseEcholist(db.Path)
+	if err != nil {
+		return err
+	}
+	db.Perm, db.List, db.Info = n.Perm, n.List, n.Info
+	db.FileInfo, _ = os.Stat(db.Path)
+	return nil
+}
+
+// Find echo area in list.
+func find_area(list []*EchoArea, name string) (int, error) {
+	for i, e := range list {
+		if e.Name == name {
+			return i, nil
+		}
+	}
+	return -1, errors.New("No such echo: " + name)
+}
+
+// Do action on echo. See EchoActions.
+// Arguments are description for add and desc, addresses
+// for allow and read, position for move.
+func (db *EDB) Edit(action string, name string, args ...string) error {
+	return db.Modify(func(list []*EchoArea) ([]*EchoArea, error) {
+		i, err := find_area(list, name)
+		if action == "add" {
+			if err == nil {
+				return nil, errors.New("Echo exists: " + name)
+			}
+			return append(list, &EchoArea{Name: name,
+				Desc: strings.Join(args, " "), Write: true}), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := list[i]
+		switch action {
+		case "desc":
+			e.Desc = strings.Join(args, " ")
+		case "readonly":
+			e.Write = false
+		case "writable":
+			e.Write = true
+		case "allow":
+			e.Allow = args
+		case "read":
+			e.Read = args
+		case "archive":
+			e.Write = false
+			list = append(append(list[:i:i], list[i+1:]...), e)
+		case "move":
+			if len(args) != 1 {
+				return nil, errors.New("No position")
+			}
+			pos, err := strconv.Atoi(args[0])
+			if err != nil || pos < 1 {
+				return nil, errors.New("Wrong position: " + args[0])
+			}
+			if pos > len(list) {
+				pos = len(list)
+			}
+			list = append(list[:i:i], list[i+1:]...)
+			list = append(list[:pos-1], append([]*EchoArea{e}, list[pos-1:]...)...)
+		case "remove":
+			list = append(list[:i:i], list[i+1:]...)
+		default:
+			return nil, errors.New("Wrong action: " + action)
+		}
+		return list, nil
+	})
+}
@@ -0,0 +1,65 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEcholistEdit(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/list.txt"
+	list := "std.test:10:Test\n-std.ro!node,1:0:Read only\nstd.staff?node,1?node,2:0:Staff: only\n"
+	if err := ioutil.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	edb := LoadEcholist(path)
+	for _, a := range [][]string{
+		{"add", "std.new", "New", "echo"},
+		{"allow", "std.new", "node,1", "node,3"},
+		{"desc", "std.test", "Test echo"},
+		{"move", "std.new", "1"},
+		{"archive", "std.test"},
+		{"writable", "std.ro"},
+		{"read", "std.staff"},
+	} {
+		if err := edb.Edit(a[0], a[1], a[2:]...); err != nil {
+			t.Fatalf("%s: %s", a, err)
+		}
+	}
+	for _, a := range [][]string{
+		{"add", "std.new"},
+		{"add", "bad"},
+		{"add", "std.bad!x"},
+		{"allow", "std.new", "node"},
+		{"desc", "std.none"},
+		{"move", "std.new", "0"},
+		{"fly", "std.new"},
+	} {
+		if edb.Edit(a[0], a[1], a[2:]...) == nil {
+			t.Errorf("%s: wrong action is accepted", a)
+		}
+	}
+	b, _ := ioutil.ReadFile(path)
+	want := "std.new!node,1!node,3:0:New echo\nstd.ro!node,1:0:Read only\n" +
+		"std.staff:0:Staff: only\n-std.test:10:Test echo\n"
+	if string(b) != want {
+		t.Errorf("Wrong echolist:\n%s", string(b))
+	}
+	if edb.Access(&Msg{Echo: "std.new", Addr: "node,3"}, nil, nil) != nil ||
+		edb.Access(&Msg{Echo: "std.test", Addr: "node,3"}, nil, nil) == nil {
+		t.Error("Echolist is not reloaded")
+	}
+	if s := LoadEcholist(path).Snapshot(); len(s.List) != 4 || s.Info["std.staff"] != "Staff: only" {
+		t.Errorf("Wrong format of echolist: %v", s.List)
+	}
+	ioutil.WriteFile(path, []byte(want+"wrong\n"), 0644)
+	if edb.Edit("remove", "std.test") == nil {
+		t.Error("Echolist with wrong lines is rewritten")
+	}
+}
@@ -0,0 +1,231 @@
+// Per-echo posting policies.
+// Policy file has lines: <echo>:<tags>, where echo * sets defaults
+// for all echoes and echo lines override them. For example:
+// *:size/16384/day/50
+// std.test:attach/0/hour/5/age/3/replies/1/cooldown/60
+// bot.out:keep/30/max/1000/active/7
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Posting policy of echo. Negative values mean no limit.
+// MaxSize: max size of message body in bytes (size tag);
+// MaxAttach: max size of decoded attachment in bytes (attach tag);
+// PerHour, PerDay: posts of point in echo per hour/day (hour, day tags);
+// MinAge: minimum age of account in days (age tag);
+// Replies: only replies, new topics are not allowed (replies tag);
+// Cooldown: minutes between new topics of point (cooldown tag);
+// KeepDays, KeepCount, KeepActive: retention (keep, max, active
+// tags, see Expire).
+type EchoPolicy struct {
+	MaxSize    int
+	MaxAttach  int
+	PerHour    int
+	PerDay     int
+	MinAge     int
+	Replies    bool
+	Cooldown   int
+	KeepDays   int
+	KeepCount  int
+	KeepActive int
+}
+
+// Policy without limits.
+func NoEchoPolicy() EchoPolicy {
+	return EchoPolicy{MaxSize: -1, MaxAttach: -1, PerHour: -1, PerDay: -1,
+		MinAge: -1, Cooldown: -1, KeepDays: -1, KeepCount: -1, KeepActive: -1}
+}
+
+// Set policy fields from tags.
+func (p *EchoPolicy) apply(t Tags) error {
+	for _, k := range t.List {
+		v := t.Hash[k]
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Wrong value of %s: %s", k, v)
+		}
+		switch k {
+		case "size":
+			p.MaxSize = n
+		case "attach":
+			p.MaxAttach = n
+		case "hour":
+			p.PerHour = n
+		case "day":
+			p.PerDay = n
+		case "age":
+			p.MinAge = n
+		case "replies":
+			p.Replies = n != 0
+		case "cooldown":
+			p.Cooldown = n
+		case "keep":
+			p.KeepDays = n
+		case "max":
+			p.KeepCount = n
+		case "active":
+			p.KeepActive = n
+		default:
+			return errors.New("Wrong policy: " + k)
+		}
+	}
+	return nil
+}
+
+// Parse echo policy file. Returns tags for echoes (and *).
+// Wrong entries are skipped, the first of them is returned as error.
+func parseEchoPolicy(path string) (map[string]Tags, error) {
+	var perr error
+	policy := make(map[string]Tags)
+	err := FileLines(path, func(line string) bool {
+		if line == "" || strings.HasPrefix(line, "#") {
+			return true
+		}
+		a := strings.SplitN(line, ":", 2)
+		var t Tags
+		var err error
+		if len(a) != 2 {
+			err = errors.New("no tags")
+		} else if t, err = MakeTags(a[1]); err == nil {
+			p := NoEchoPolicy()
+			err = p.apply(t)
+		}
+		if err != nil {
+			Error.Printf("Wrong entry in echo policy: %s", line)
+			if perr == nil {
+				perr = fmt.Errorf("%s: %s: %s", path, line, err)
+			}
+			return true
+		}
+		policy[a[0]] = t
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policy, perr
+}
+
+// Loads echo policy.
+// Supposed to be called once, use Reload to load changes.
+func (db *EDB) LoadPolicy(path string) {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	db.PolicyPath = path
+	db.PolicyInfo, _ = os.Stat(path)
+	db.Policy, _ = parseEchoPolicy(path)
+}
+
+// Policy of echo: defaults (*) with echo settings.
+func (db *EDB) EchoPolicy(echo string) EchoPolicy {
+	db.Sync.RLock()
+	defer db.Sync.RUnlock()
+	return db.echoPolicy(echo)
+}
+
+func (db *EDB) echoPolicy(echo string) EchoPolicy {
+	p := NoEchoPolicy()
+	p.apply(db.Policy["*"])
+	p.apply(db.Policy[echo])
+	return p
+}
+
+// Sizes of message body and decoded attachment (@base64: section)
+// in bytes. Size of attachment is computed from length of base64
+// data (without marker line, spaces and padding). Returns true if
+// message has attachment.
+func msg_sizes(text string) (int, int, bool) {
+	var attach string
+	body := len(text)
+	if strings.HasPrefix(text, "@base64:") {
+		body, attach = 0, text
+	} else if i := strings.Index(text, "\n@base64:"); i >= 0 {
+		body, attach = i, text[i+1:]
+	} else {
+		return body, 0, false
+	}
+	data := 0
+	if i := strings.IndexByte(attach, '\n'); i >= 0 {
+		for _, c := range attach[i+1:] {
+			if c != '\n' && c != '\r' && c != ' ' && c != '=' {
+				data++
+			}
+		}
+	}
+	return body, data * 3 / 4, true
+}
+
+// Check posting policy of echo for message m of user u.
+// Topic is true for new topics. Database mdb is used for rate limits
+// and cooldown (can be nil), user is used for account age (can be nil).
+// Messages of author are checked from the newest ones back to 24 hours
+// (or cooldown if it is longer).
+func (p *EchoPolicy) Check(m *Msg, u *User, mdb *DB, topic bool) error {
+	body, attach, has := msg_sizes(m.Text)
+	if p.MaxSize >= 0 && body > p.MaxSize {
+		return fmt.Errorf("Message is too long: %d > %d bytes", body, p.MaxSize)
+	}
+	if p.MaxAttach == 0 && has {
+		return errors.New("Attachments are not allowed in " + m.Echo)
+	}
+	if p.MaxAttach >= 0 && attach > p.MaxAttach {
+		return fmt.Errorf("Attachment is too big: %d > %d bytes", attach, p.MaxAttach)
+	}
+	if topic && p.Replies {
+		return errors.New("Only replies are allowed in " + m.Echo)
+	}
+	now := time.Now().Unix()
+	if u != nil && p.MinAge > 0 {
+		var reg int64
+		if v, ok := u.Tags.Get("reg"); ok {
+			reg, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if reg > 0 && now-reg < int64(p.MinAge)*24*60*60 {
+			return fmt.Errorf("Account must be at least %d days old to post in %s",
+				p.MinAge, m.Echo)
+		}
+	}
+	if mdb == nil || (p.PerHour < 0 && p.PerDay < 0 && (!topic || p.Cooldown < 0)) {
+		return nil
+	}
+	hour, day := 0, 0
+	window := int64(24 * 60 * 60)
+	if topic && int64(p.Cooldown)*60 > window {
+		window = int64(p.Cooldown) * 60
+	}
+	ids := mdb.SelectIDS(&Query{Echo: m.Echo, From: m.From, NoAccess: true})
+	for i := len(ids) - 1; i >= 0; i-- { /* from newest, until window */
+		o := mdb.Get(ids[i])
+		if o == nil || o.Addr != m.Addr || o.MsgId == m.MsgId {
+			continue
+		}
+		if now-o.Date >= window {
+			break
+		}
+		if now-o.Date < 60*60 {
+			hour++
+		}
+		if now-o.Date < 24*60*60 {
+			day++
+		}
+		if r, _ := o.Tag("repto"); topic && r == "" && p.Cooldown >= 0 &&
+			now-o.Date < int64(p.Cooldown)*60 {
+			return fmt.Errorf("Wait %d minutes before new topic in %s",
+				(int64(p.Cooldown)*60-(now-o.Date)+59)/60, m.Echo)
+		}
+	}
+	if p.PerHour >= 0 && hour >= p.PerHour {
+		return fmt.Errorf("Too many posts in %s: %d per hour", m.Echo, p.PerHour)
+	}
+	if p.PerDay >= 0 && day >= p.PerDay {
+		return fmt.Errorf("Too many posts in %s: %d per day", m.Echo, p.PerDay)
+	}
+	return nil
+}
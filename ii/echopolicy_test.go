@@ -0,0 +1,96 @@
+package ii
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoPolicy(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/list.txt", []byte("std.test:0:Test\nstd.news:0:News\n"), 0644)
+	ioutil.WriteFile(dir+"/policy.txt", []byte("*:size/10/day/2\n"+
+		"std.news:size/100/attach/0/replies/1/age/3\nstd.bad:size/-1\n"), 0644)
+	edb := LoadEcholist(dir + "/list.txt")
+	edb.LoadPolicy(dir + "/policy.txt")
+	if p := edb.EchoPolicy("std.news"); p.MaxSize != 100 || p.MaxAttach != 0 ||
+		p.PerDay != 2 || p.PerHour != -1 || !p.Replies || p.MinAge != 3 {
+		t.Errorf("Wrong policy: %v", p)
+	}
+	if p := edb.EchoPolicy("std.bad"); p.MaxSize != 10 {
+		t.Error("Wrong entry is accepted")
+	}
+	db := OpenDB(dir + "/db")
+	now := time.Now().Unix()
+	user := &User{Name: "alice", Tags: NewTags(fmt.Sprintf("reg/%d", now-5*24*60*60))}
+	topic := &Msg{Echo: "std.news", From: "bob", Addr: "node,3", To: "All",
+		Text: "topic", Date: now, Tags: NewTags("ii/ok")}
+	topic.Encode()
+	db.Store(topic)
+	post := func(echo string, text string, repto string) error {
+		m := &Msg{Echo: echo, From: "alice", Addr: "node,2", To: "All",
+			Text: text, Date: now, Tags: NewTags("ii/ok")}
+		if repto != "" {
+			m.Tags.Add("repto/" + topic.MsgId)
+		}
+		m.Encode()
+		if err := edb.Access(m, user, db); err != nil {
+			return err
+		}
+		return db.Store(m)
+	}
+	for _, c := range []struct {
+		echo, text, repto, err string
+	}{
+		{"std.test", "too long text", "", "too long"},
+		{"std.test", "topic", "", ""},
+		{"std.test", "reply", "x", ""},
+		{"std.test", "third", "x", "per day"},
+		{"std.news", "topic", "", "Only replies"},
+		{"std.news", "reply\n@base64:a.txt\nYQ==", "x", "Attachments"},
+		{"std.news", "reply", "x", ""},
+		{"std.none", "reply", "x", "No such echo"},
+	} {
+		err := post(c.echo, c.text, c.repto)
+		if (c.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s %q: %v", c.echo, c.text, err)
+		}
+	}
+	for _, c := range []struct {
+		text   string
+		body   int
+		attach int
+	}{
+		{"text", 4, 0},
+		{"text\n@base64:a.txt\nYWJj\nZA==", 4, 4},
+		{"@base64:a.txt\nYWJjZGVm\n", 0, 6},
+	} {
+		if body, attach, _ := msg_sizes(c.text); body != c.body || attach != c.attach {
+			t.Errorf("Wrong sizes of %q: %d %d", c.text, body, attach)
+		}
+	}
+	user.Tags = NewTags(fmt.Sprintf("reg/%d", now))
+	if err := post("std.news", "reply", "x"); err == nil || !strings.Contains(err.Error(), "3 days") {
+		t.Errorf("Account age is not checked: %v", err)
+	}
+	ioutil.WriteFile(dir+"/policy.txt", []byte("std.test:cooldown/10\n"), 0644)
+	d := time.Now().Add(time.Second) /* mtime must change */
+	os.Chtimes(dir+"/policy.txt", d, d)
+	if err := edb.Reload(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := post("std.test", "topic 2", ""); err == nil || !strings.Contains(err.Error(), "Wait 10 minutes") {
+		t.Errorf("Cooldown is not checked: %v", err)
+	}
+	if err := post("std.test", "long reply", "x"); err != nil {
+		t.Errorf("Policy is not reloaded: %v", err)
+	}
+}
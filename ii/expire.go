@@ -0,0 +1,116 @@
+// Expiry of old messages by retention policies of echoes.
+// Retention is set in echo policy file with tags:
+// keep/<days>: max age of messages;
+// max/<count>: max number of messages in echo;
+// active/<days>: topics with replies newer than days are kept.
+// Expired messages are replaced with tombstones: blacklisted records
+// without text, so fetchers do not import them again. Old records
+// are removed from bundle file by ii-tool clean.
+package ii
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Check if echo policy has retention limits.
+func (p *EchoPolicy) Retention() bool {
+	return p.KeepDays >= 0 || p.KeepCount >= 0
+}
+
+// Ids of messages of echo which are expired at time now
+// (in order of database).
+func (p *EchoPolicy) Expired(db *DB, echo string, now int64) []string {
+	var expired []string
+	if !p.Retention() {
+		return expired
+	}
+	var msgs []*Msg
+	hash := make(map[string]*Msg)
+	for _, id := range db.SelectIDS(&Query{Echo: echo, NoAccess: true}) {
+		if m := db.Get(id); m != nil {
+			msgs = append(msgs, m)
+			hash[id] = m
+		}
+	}
+	root := func(m *Msg) *Msg {
+		for i := 0; i < 64; i++ { /* avoid loops */
+			r, _ := m.Tag("repto")
+			if hash[r] == nil {
+				break
+			}
+			m = hash[r]
+		}
+		return m
+	}
+	active := make(map[string]int64) /* date of last message in topic */
+	for _, m := range msgs {
+		if r := root(m); active[r.MsgId] < m.Date {
+			active[r.MsgId] = m.Date
+		}
+	}
+	for i, m := range msgs {
+		old := p.KeepDays >= 0 && now-m.Date > int64(p.KeepDays)*24*60*60
+		over := p.KeepCount >= 0 && i < len(msgs)-p.KeepCount
+		if !old && !over {
+			continue
+		}
+		if p.KeepActive >= 0 &&
+			now-active[root(m).MsgId] <= int64(p.KeepActive)*24*60*60 {
+			continue
+		}
+		expired = append(expired, m.MsgId)
+	}
+	return expired
+}
+
+// Replace message with tombstone: blacklisted record with the same
+// id, echo, addresses and repto, but without subject and text.
+func (db *DB) Tombstone(m *Msg, now int64) error {
+	t := &Msg{MsgId: m.MsgId, Echo: m.Echo, Date: m.Date, From: m.From,
+		Addr: m.Addr, To: m.To, Tags: NewTags("ii/ok")}
+	if r, _ := m.Tag("repto"); r != "" {
+		t.Tags.Add("repto/" + r)
+	}
+	t.Tags.Add(fmt.Sprintf("expired/%d", now))
+	return db.Blacklist(t)
+}
+
+// Check if message is tombstone of expired message.
+func IsTombstone(m *Msg) bool {
+	_, ok := m.Tag("expired")
+	return ok
+}
+
+// Expire messages of all echoes by retention policies of edb.
+// Returns ids of expired messages. If dryrun is true, messages
+// are not changed.
+func (db *DB) Expire(edb *EDB, now int64, dryrun bool) ([]string, error) {
+	var list []string
+	var echoes []string
+	for _, e := range db.Echoes(nil, &Query{NoAccess: true}) {
+		echoes = append(echoes, e.Name)
+	}
+	sort.Strings(echoes)
+	for _, e := range echoes {
+		p := edb.EchoPolicy(e)
+		ids := p.Expired(db, e, now)
+		for _, id := range ids {
+			if dryrun {
+				continue
+			}
+			m := db.Get(id)
+			if m == nil {
+				continue
+			}
+			if err := db.Tombstone(m, now); err != nil {
+				return list, err
+			}
+		}
+		if len(ids) > 0 {
+			Info.Printf("Expire %s: %d messages", e, len(ids))
+		}
+		list = append(list, ids...)
+	}
+	return list, nil
+}
@@ -0,0 +1,75 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/policy.txt", []byte("std.test:keep/30/active/7\n"+
+		"bot.out:max/2\n"), 0644)
+	edb := &EDB{}
+	edb.LoadPolicy(dir + "/policy.txt")
+	if p := edb.EchoPolicy("std.test"); p.KeepDays != 30 || p.KeepCount != -1 ||
+		p.KeepActive != 7 || !p.Retention() {
+		t.Errorf("Wrong retention: %v", p)
+	}
+	db := OpenDB(dir + "/db")
+	now := time.Now().Unix()
+	day := int64(24 * 60 * 60)
+	store := func(echo string, text string, age int64, repto string) string {
+		m := &Msg{Echo: echo, From: "user", Addr: "node,2", To: "All",
+			Subj: "subj", Text: text, Date: now - age*day, Tags: NewTags("ii/ok")}
+		if repto != "" {
+			m.Tags.Add("repto/" + repto)
+		}
+		m.Encode()
+		if err := db.Store(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.MsgId
+	}
+	old := store("std.test", "old", 40, "")
+	active := store("std.test", "active topic", 50, "")
+	store("std.test", "recent reply", 1, active)
+	fresh := store("std.test", "fresh", 10, "")
+	bot1 := store("bot.out", "bot 1", 1, "")
+	store("bot.out", "bot 2", 1, "")
+	store("bot.out", "bot 3", 1, "")
+	store("std.other", "forever", 1000, "")
+
+	ids, err := db.Expire(edb, now, true)
+	if err != nil || len(ids) != 2 || ids[0] != bot1 || ids[1] != old {
+		t.Fatalf("Wrong expired messages: %v %v", ids, err)
+	}
+	if db.Lookup(old) == nil {
+		t.Fatal("Message is expired in dry run mode")
+	}
+	if ids, err = db.Expire(edb, now, false); err != nil || len(ids) != 2 {
+		t.Fatalf("Messages are not expired: %v %v", ids, err)
+	}
+	if db.Lookup(old) != nil || db.Exists(old) == nil {
+		t.Error("Expired message is not tombstoned")
+	}
+	m, err := DecodeBundle(db.GetBundleAll(old))
+	if err != nil || !IsTombstone(m) || m.Text != "" || m.Echo != "std.test" {
+		t.Errorf("Wrong tombstone: %v %v", m, err)
+	}
+	if db.Lookup(active) == nil || db.Lookup(fresh) == nil {
+		t.Error("Active or fresh topic is expired")
+	}
+	if ids, _ := db.Expire(edb, now, false); len(ids) != 0 {
+		t.Errorf("Tombstones are expired again: %v", ids)
+	}
+	if msg, _ := DecodeBundle(db.GetBundleAll(old)); msg != nil && db.Store(msg) == nil {
+		t.Error("Expired message is imported again")
+	}
+}
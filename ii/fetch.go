@@ -0,0 +1,492 @@
+// Fetch from node: pool of workers with shared queue of requests.
+// Index of every echo is got by own task, new ids of all echoes
+// are collected in batches of /u/m requests.
+
+package ii
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default number of parallel requests of Fetch.
+const DEFAULT_CONNECTIONS = 6
+
+// Max number of ids in one /u/m request.
+const FETCH_BATCH = 32
+
+// Queue of tasks processed by pool of workers. Tasks can add
+// new tasks. Workers exit when queue is empty and no task is
+// running (so no new tasks can be added).
+type taskQueue struct {
+	sync.Mutex
+	cond  *sync.Cond
+	tasks []func()
+	busy  int
+}
+
+func newTaskQueue() *taskQueue {
+	q := &taskQueue{}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// Add task to queue.
+func (q *taskQueue) push(t func()) {
+	q.Lock()
+	q.tasks = append(q.tasks, t)
+	q.busy++
+	q.Unlock()
+	q.cond.Signal()
+}
+
+// Worker: run tasks until all work is done.
+func (q *taskQueue) worker(wait *sync.WaitGroup) {
+	defer wait.Done()
+	q.Lock()
+	defer q.Unlock()
+	for {
+		for len(q.tasks) == 0 && q.busy > 0 {
+			q.cond.Wait()
+		}
+		if q.busy == 0 {
+			q.cond.Broadcast()
+			return
+		}
+		t := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.Unlock()
+		t()
+		q.Lock()
+		q.busy--
+		if q.busy == 0 {
+			q.cond.Broadcast()
+		}
+	}
+}
+
+// Results of storing of fetched message.
+const (
+	fetchNew = iota
+	fetchSkipped
+	fetchDuplicate
+	fetchInvalid
+	fetchFailed
+)
+
+func (r *EchoReport) count(res int) {
+	switch res {
+	case fetchNew:
+		r.New++
+	case fetchSkipped:
+		r.Skipped++
+	case fetchDuplicate:
+		r.Duplicate++
+	case fetchInvalid:
+		r.Invalid++
+	default:
+		r.Failed++
+	}
+}
+
+// Check if message is already got from node: it is in db
+// or in premoderation queue.
+func (n *Node) exists(db *DB, id string) bool {
+	return db.Exists(id) != nil || (n.Pending != nil && n.Pending.Exists(id) != nil)
+}
+
+// Decode bundle, filter and store message in db.
+// Returns result of storing.
+func (n *Node) storeBundle(db *DB, b string) int {
+	m, e := DecodeBundle(b)
+	if e != nil {
+		Error.Printf("Can not decode message %s (%s)\n", b, e)
+		return fetchInvalid
+	}
+	if n.exists(db, m.MsgId) {
+		return fetchDuplicate
+	}
+	if n.Filter != nil {
+		e = n.Filter(m)
+	}
+	if e == nil {
+		e = db.Store(m)
+	}
+	var re *RuleError
+	if e == ErrQuarantined || errors.As(e, &re) {
+		return fetchSkipped
+	} else if e != nil {
+		Error.Printf("Can not write message %s (%s)\n", m.MsgId, e)
+		return fetchFailed
+	}
+	atomic.AddInt64(&n.Stored, 1)
+	return fetchNew
+}
+
+// Fetch and write selected messages in db.
+// ids: selected message ids.
+// db: Database.
+// This function make /u/m requests (FETCH_BATCH ids per request),
+// decodes bundles, checks, and write them to db (line by line).
+func (n *Node) Store(ctx context.Context, db *DB, ids []string) error {
+	Trace.Printf("Get and store messages")
+	for len(ids) > 0 {
+		nr := len(ids)
+		if nr > FETCH_BATCH {
+			nr = FETCH_BATCH
+		}
+		if err := n.client().Lines(ctx, n.Host+"/u/m/"+strings.Join(ids[:nr], "/"),
+			func(b string) bool {
+				if b != "" {
+					n.storeBundle(db, b)
+				}
+				return true
+			}); err != nil {
+			return err
+		}
+		ids = ids[nr:]
+	}
+	return nil
+}
+
+// State of Fetch.
+// noprobe: echoes which are fetched without check of last message;
+// owner: report of echo of requested id;
+// batch: ids for next /u/m request;
+// indexing: number of echoes which index is not got yet.
+type fetcher struct {
+	sync.Mutex
+	n        *Node
+	ctx      context.Context
+	db       *DB
+	limit    int
+	queue    *taskQueue
+	noprobe  map[string]bool
+	owner    map[string]*EchoReport
+	batch    []string
+	indexing int
+}
+
+// Add new ids of echo r. Full batches are queued, the rest
+// is queued after indexes of all echoes are got.
+func (f *fetcher) add(r *EchoReport, ids []string) {
+	f.Lock()
+	defer f.Unlock()
+	for _, id := range ids {
+		if f.owner[id] != nil { /* already requested in other echo */
+			continue
+		}
+		f.owner[id] = r
+		f.batch = append(f.batch, id)
+	}
+	f.indexing--
+	for len(f.batch) >= FETCH_BATCH || (f.indexing == 0 && len(f.batch) > 0) {
+		nr := len(f.batch)
+		if nr > FETCH_BATCH {
+			nr = FETCH_BATCH
+		}
+		batch := f.batch[:nr:nr]
+		f.batch = f.batch[nr:]
+		f.queue.push(func() { f.get(batch) })
+	}
+	r.finish()
+}
+
+// Task: get index of echo r and add new ids.
+func (f *fetcher) index(r *EchoReport) {
+	ids, err := f.n.index(f.ctx, f.db, r, f.limit, !f.noprobe[r.Echo])
+	f.Lock()
+	if err != nil {
+		r.error(err)
+	}
+	f.Unlock()
+	f.add(r, ids)
+}
+
+// Get index of echo r and return ids of new messages.
+// Can work in different modes.
+// If limit > 0, just fetch last [limit] messages (-limit:limit slice)
+// if limit < 0, use adaptive mode, probe (-(2*n)* limit:1) messages
+// untill find old message.
+// if node does not support u/e slices, than full sync performed
+// if node connection is not in Force mode and probe is true,
+// do not perform sync if not needed
+func (n *Node) index(ctx context.Context, db *DB, r *EchoReport, limit int, probe bool) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	Echo := r.Echo
+	r.Mode = FETCH_FULL
+	if n.IsFeature("u/e") { /* fast path */
+		if !n.Force && probe {
+			id, err := n.get_id(ctx, n.Host+"/u/e/"+Echo+"/-1:1")
+			var ierr *IDECError
+			if errors.As(err, &ierr) { /* empty echo */
+				Info.Printf("%s %s: %s", n.Host, Echo, err)
+				r.Mode = FETCH_SKIP
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			r.last = id
+			if n.exists(db, id) { /* no sync needed */
+				Info.Printf("%s %s: no sync needed", n.Host, Echo)
+				r.Mode = FETCH_SKIP
+				return nil, nil
+			}
+		}
+		if limit > 0 {
+			r.Mode = FETCH_LIMIT
+		} else if limit < 0 {
+			r.Mode = FETCH_ADAPTIVE
+			limit = -limit
+			try := 0
+			for { // adaptive
+				if try > 16 { /* fallback to old scheme */
+					Info.Printf("%s %s: fallback to old scheme", n.Host, Echo)
+					r.Mode = FETCH_FALLBACK
+					limit = 0
+					break
+				}
+				id, err := n.get_id(ctx, fmt.Sprintf("%s/u/e/%s/%d:1",
+					n.Host, Echo, -limit))
+				var ierr *IDECError
+				if err != nil && !errors.As(err, &ierr) {
+					return nil, err
+				}
+				if err != nil { /* fallback to old scheme */
+					Info.Printf("%s %s: fallback to old scheme", n.Host, Echo)
+					r.Mode = FETCH_FALLBACK
+					limit = 0
+					break
+				}
+				if n.exists(db, id) {
+					break
+				}
+				try++
+				limit *= 2
+			}
+		}
+	} else {
+		limit = 0
+	}
+	req := fmt.Sprintf("%s/u/e/%s", n.Host, Echo)
+	if limit > 0 {
+		req = fmt.Sprintf("%s/%d:%d", req, -limit, limit)
+	}
+	Info.Printf("Get %s", req)
+	var res []string
+	seen := make(map[string]bool)
+	if err := n.client().Lines(ctx, req, func(line string) bool {
+		if strings.Contains(line, ".") || line == "" {
+			return true
+		}
+		if !IsMsgId(line) {
+			r.Invalid++
+			return true
+		}
+		r.last = line
+		if n.exists(db, line) || seen[line] {
+			r.Duplicate++
+		} else {
+			seen[line] = true
+			res = append(res, line)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Task: get messages with one /u/m request and store them.
+// Results are counted in reports of echoes.
+func (f *fetcher) get(ids []string) {
+	err := f.ctx.Err()
+	got := make(map[string]bool)
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	if err == nil {
+		err = f.n.client().Lines(f.ctx, f.n.Host+"/u/m/"+strings.Join(ids, "/"),
+			func(b string) bool {
+				id := strings.SplitN(b, ":", 2)[0]
+				if !want[id] || got[id] { /* not requested */
+					return true
+				}
+				f.Lock()
+				r := f.owner[id]
+				f.Unlock()
+				got[id] = true
+				res := f.n.storeBundle(f.db, b)
+				f.Lock()
+				r.count(res)
+				f.Unlock()
+				return true
+			})
+	}
+	f.Lock()
+	defer f.Unlock()
+	missing := make(map[*EchoReport]int)
+	var reports []*EchoReport
+	for _, id := range ids {
+		r := f.owner[id]
+		if !got[id] {
+			r.Failed++
+			if missing[r] == 0 {
+				reports = append(reports, r)
+			}
+			missing[r]++
+		}
+		r.finish()
+	}
+	for _, r := range reports {
+		if err != nil {
+			r.error(err)
+		} else { /* node did not send some messages */
+			r.error(fmt.Errorf("%d messages are not received", missing[r]))
+		}
+	}
+}
+
+// Get counts of echoes with x/c (if node supports it and not in
+// Force mode) and select echoes to fetch: not empty, with counts
+// or last messages changed since last fetch (Counts). Count is not
+// changed by removed (blacklisted) messages or by max size of echo,
+// so last ids of echoes with same counts are checked with batched
+// u/e request. Echoes which are empty in db or which last message
+// is already got are fetched without probe. Returns nil counts
+// if all echoes should be fetched.
+func (f *fetcher) selectEchoes(report *FetchReport) map[string]int {
+	n := f.n
+	if n.Force || !n.IsFeature("x/c") || len(report.Echoes) == 0 {
+		return nil
+	}
+	var names []string
+	for _, r := range report.Echoes {
+		names = append(names, r.Echo)
+	}
+	counts, err := n.EchoCounts(f.ctx, names)
+	if err != nil {
+		Error.Printf("%s: can not get counts: %s", n.Host, err)
+		return nil
+	}
+	local := make(map[string]int)
+	for _, e := range f.db.Echoes(names, &Query{NoAccess: true}) {
+		local[e.Name] = e.Count
+	}
+	var same []string
+	for _, r := range report.Echoes {
+		r.Count = counts[r.Echo]
+		if r.Count == 0 {
+			r.Mode = FETCH_SKIP
+		} else if local[r.Echo] == 0 {
+			f.noprobe[r.Echo] = true
+		} else if prev, ok := n.Counts[r.Echo]; ok && prev.Count == r.Count && prev.Last != "" {
+			same = append(same, r.Echo)
+		}
+	}
+	if len(same) == 0 || !n.IsFeature("u/e") {
+		return counts
+	}
+	last, err := n.LastIds(f.ctx, same)
+	if err != nil {
+		Error.Printf("%s: can not get last messages: %s", n.Host, err)
+		return counts
+	}
+	for _, r := range report.Echoes {
+		id, ok := last[r.Echo]
+		if !ok {
+			continue
+		}
+		r.last = id
+		if id == n.Counts[r.Echo].Last && n.exists(f.db, id) {
+			r.Mode = FETCH_UNCHANGED
+		} else {
+			f.noprobe[r.Echo] = true
+		}
+	}
+	return counts
+}
+
+// This is Fetcher master function. It makes fetch from node
+// with pool of MaxConnections workers. Index of every echo is got
+// by own task (see index), new messages of all echoes are requested
+// in common batches. Echoes are selected by counts (see selectEchoes),
+// counts of fetched echoes are saved in Counts.
+// Echolist: list with echoarea names. If list is empty,
+// function will try to get list via list.txt request.
+// limit: describe fetching mode/limit (see index).
+// Returns report of fetch and its error (see FetchReport.Err).
+func (n *Node) Fetch(ctx context.Context, db *DB, Echolist []string, limit int) (*FetchReport, error) {
+	report := &FetchReport{Host: n.Host, Start: time.Now()}
+	n.client()
+	if len(Echolist) == 0 {
+		var err error
+		if Echolist, err = n.List(ctx); err != nil {
+			report.error(err)
+			report.finish()
+			return report, report.Err()
+		}
+	}
+	f := &fetcher{n: n, ctx: ctx, db: db, limit: limit, queue: newTaskQueue(),
+		noprobe: make(map[string]bool), owner: make(map[string]*EchoReport)}
+	seen := make(map[string]bool)
+	for _, v := range Echolist {
+		if !IsEcho(v) || seen[v] {
+			if strings.Trim(v, " ") != "" {
+				Trace.Printf("Skip echo: %s", v)
+			}
+			continue
+		}
+		seen[v] = true
+		r := &EchoReport{Echo: v, Count: -1, Start: time.Now()}
+		report.Echoes = append(report.Echoes, r)
+	}
+	counts := f.selectEchoes(report)
+	var tasks []*EchoReport
+	for _, r := range report.Echoes {
+		if r.Mode == "" {
+			tasks = append(tasks, r)
+		} else {
+			r.finish()
+		}
+	}
+	f.indexing = len(tasks)
+	for _, r := range tasks {
+		r := r
+		f.queue.push(func() { f.index(r) })
+	}
+	workers := n.MaxConnections
+	if workers <= 0 {
+		workers = DEFAULT_CONNECTIONS
+	}
+	Info.Printf("Start %d fetcher(s) for %s", workers, n.Host)
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go f.queue.worker(&wait)
+	}
+	wait.Wait()
+	if err := ctx.Err(); err != nil {
+		report.error(err)
+	}
+	if counts != nil {
+		if n.Counts == nil {
+			n.Counts = make(map[string]EchoCount)
+		}
+		for _, r := range report.Echoes {
+			if len(r.Errors) == 0 && r.Failed == 0 {
+				n.Counts[r.Echo] = EchoCount{Count: counts[r.Echo], Last: r.last}
+			}
+		}
+	}
+	report.finish()
+	return report, report.Err()
+}
@@ -0,0 +1,381 @@
+package ii
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-process fake node with u/e, u/m, x/c and list.txt.
+// Counts requests (by first two path elements)
+// and max number of parallel requests.
+type fakeNode struct {
+	sync.Mutex
+	echoes      map[string][]*Msg
+	bundles     map[string]string
+	requests    map[string]int
+	inflight    int
+	maxInflight int
+	delay       time.Duration
+	srv         *httptest.Server
+}
+
+func newFakeNode() *fakeNode {
+	f := &fakeNode{echoes: make(map[string][]*Msg),
+		bundles: make(map[string]string), requests: make(map[string]int)}
+	f.srv = httptest.NewServer(f)
+	return f
+}
+
+// Add nr messages to echo.
+func (f *fakeNode) add(echo string, nr int) []*Msg {
+	f.Lock()
+	defer f.Unlock()
+	msgs := []*Msg{}
+	if f.echoes[echo] == nil {
+		f.echoes[echo] = msgs
+	}
+	for i := 0; i < nr; i++ {
+		m := &Msg{Echo: echo, From: "user", Addr: "fake,2", To: "All",
+			Subj: "subj", Tags: NewTags("ii/ok"),
+			Text: fmt.Sprintf("%s %d", echo, len(f.bundles)),
+			Date: time.Now().Unix()}
+		f.bundles[m.Encode()[:20]] = m.Encode()
+		f.echoes[echo] = append(f.echoes[echo], m)
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// Remove message nr from echo.
+func (f *fakeNode) drop(echo string, nr int) {
+	f.Lock()
+	defer f.Unlock()
+	msgs := f.echoes[echo]
+	f.echoes[echo] = append(msgs[:nr:nr], msgs[nr+1:]...)
+}
+
+func (f *fakeNode) count(req string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests[req]
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	f.Lock()
+	if len(path) > 1 {
+		f.requests[path[0]+"/"+path[1]]++
+	}
+	f.inflight++
+	if f.inflight > f.maxInflight {
+		f.maxInflight = f.inflight
+	}
+	delay := f.delay
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		f.inflight--
+		f.Unlock()
+	}()
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch {
+	case r.URL.Path == "/x/features":
+		fmt.Fprintf(w, "u/e\nlist.txt\nx/c\n")
+	case r.URL.Path == "/list.txt":
+		var names []string
+		for e := range f.echoes {
+			names = append(names, e)
+		}
+		sort.Strings(names)
+		for _, e := range names {
+			fmt.Fprintf(w, "%s:%d:\n", e, len(f.echoes[e]))
+		}
+	case strings.HasPrefix(r.URL.Path, "/u/e/"):
+		args := path[2:]
+		start, count := 0, -1
+		if l := args[len(args)-1]; strings.Contains(l, ":") {
+			a := strings.Split(l, ":")
+			start, _ = strconv.Atoi(a[0])
+			count, _ = strconv.Atoi(a[1])
+			args = args[:len(args)-1]
+		}
+		for _, e := range args {
+			msgs := f.echoes[e]
+			s := start
+			if s < 0 {
+				s += len(msgs)
+			}
+			if s < 0 {
+				s = 0
+			}
+			fmt.Fprintf(w, "%s\n", e)
+			for i := s; i < len(msgs) && (count < 0 || i < s+count); i++ {
+				fmt.Fprintf(w, "%s\n", msgs[i].MsgId)
+			}
+		}
+	case strings.HasPrefix(r.URL.Path, "/x/c/"):
+		for _, e := range path[2:] {
+			if msgs, ok := f.echoes[e]; ok {
+				fmt.Fprintf(w, "%s:%d:\n", e, len(msgs))
+			}
+		}
+	case strings.HasPrefix(r.URL.Path, "/u/m/"):
+		for _, id := range path[2:] {
+			if b, ok := f.bundles[id]; ok {
+				fmt.Fprintf(w, "%s\n", b)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testDB(t *testing.T) (*DB, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	return OpenDB(dir + "/db"), func() { os.RemoveAll(dir) }
+}
+
+func TestFetch(t *testing.T) {
+	InitLog()
+	f := newFakeNode()
+	defer f.srv.Close()
+	db, clean := testDB(t)
+	defer clean()
+	var echoes []string
+	for i := 0; i < 5; i++ {
+		e := fmt.Sprintf("std.echo%d", i)
+		echoes = append(echoes, e)
+		msgs := f.add(e, 20)
+		if i == 0 {
+			for _, m := range msgs[:5] {
+				db.Store(m)
+			}
+		}
+	}
+	f.add("std.empty", 0)
+	ctx := context.Background()
+	n, err := Connect(ctx, f.srv.URL, &Client{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.MaxConnections = 3
+	f.delay = 5 * time.Millisecond
+	report, err := n.Fetch(ctx, db, append(echoes, "std.empty", echoes[1]), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total.New != 95 || report.Total.Duplicate != 5 || len(report.Echoes) != 6 {
+		t.Errorf("Wrong report: %s", report.Summary(true))
+	}
+	if ids := db.SelectIDS(&Query{NoAccess: true}); len(ids) != 100 {
+		t.Errorf("Wrong number of messages: %d", len(ids))
+	}
+	if nr := f.count("u/m"); nr != (95+FETCH_BATCH-1)/FETCH_BATCH {
+		t.Errorf("Messages of echoes are not batched: %d /u/m requests", nr)
+	}
+	if f.maxInflight > 3 {
+		t.Errorf("Too many parallel requests: %d", f.maxInflight)
+	}
+	if report.Echoes[5].Mode != FETCH_SKIP {
+		t.Errorf("Empty echo is fetched: %s", report.Echoes[5])
+	}
+
+	if f.count("x/c") != 1 || f.count("u/e") != 6 { /* probe only std.echo0 */
+		t.Errorf("Wrong requests: %v", f.requests)
+	}
+
+	/* nothing new: only counts and last ids are checked */
+	f.requests = make(map[string]int)
+	report, err = n.Fetch(ctx, db, nil, 0)
+	if err != nil || report.Total.New != 0 || len(report.Echoes) != 6 ||
+		report.Echoes[0].Echo != "std.echo0" || report.Echoes[0].Mode != FETCH_UNCHANGED {
+		t.Errorf("Wrong report: %s %v", report.Summary(true), err)
+	}
+	if f.count("x/c") != 1 || f.count("u/m") != 0 || f.count("u/e") != 1 {
+		t.Errorf("Wrong requests: %v", f.requests)
+	}
+
+	/* only changed echo is fetched */
+	f.add("std.echo2", 3)
+	f.requests = make(map[string]int)
+	report, err = n.Fetch(ctx, db, echoes, 0)
+	if err != nil || report.Total.New != 3 || report.Echoes[2].Count != 23 {
+		t.Errorf("Wrong report: %s %v", report.Summary(true), err)
+	}
+	if f.count("x/c") != 1 || f.count("u/e") != 3 || f.count("u/m") != 1 {
+		t.Errorf("Wrong requests: %v", f.requests)
+	}
+	if c := n.Counts["std.echo2"]; c.Count != 23 || c.Last != f.echoes["std.echo2"][22].MsgId ||
+		n.Counts["std.empty"].Count != 0 {
+		t.Errorf("Wrong counts: %v", n.Counts)
+	}
+
+	/* force mode does not use counts */
+	n.Force = true
+	f.requests = make(map[string]int)
+	if report, _ = n.Fetch(ctx, db, echoes, 0); f.count("x/c") != 0 ||
+		f.count("u/e") != len(echoes) || report.Total.Duplicate != 103 {
+		t.Errorf("Wrong requests in force mode: %v %s", f.requests, report.Summary(true))
+	}
+}
+
+func TestCounts(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	cdb := OpenCounts(dir + "/counts.txt")
+	if c := cdb.Get("http://node"); len(c) != 0 {
+		t.Errorf("Wrong counts of new db: %v", c)
+	}
+	if err := cdb.Set("http://node", map[string]EchoCount{
+		"std.test": {10, "rE7bZbUIqYDJlS6T7tnP"}, "std.empty": {}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.SetPushed("http://node", 1600000000); err != nil {
+		t.Fatal(err)
+	}
+	cdb.Set("http://other", map[string]EchoCount{"std.test": {Count: 5}})
+	cdb = OpenCounts(dir + "/counts.txt")
+	if p := cdb.GetPushed("http://node"); p != 1600000000 {
+		t.Errorf("Wrong push time: %d", p)
+	}
+	if p := cdb.GetPushed("http://other"); p != 0 {
+		t.Errorf("Wrong push time: %d", p)
+	}
+	if c := cdb.Get("http://node"); len(c) != 2 ||
+		c["std.test"] != (EchoCount{10, "rE7bZbUIqYDJlS6T7tnP"}) {
+		t.Errorf("Wrong counts: %v", c)
+	}
+	if c := cdb.Get("http://other"); len(c) != 1 || c["std.test"].Count != 5 {
+		t.Errorf("Wrong counts: %v", c)
+	}
+}
+
+// Count of echo is the same, but one message is removed and
+// one is added.
+func TestFetchReplaced(t *testing.T) {
+	InitLog()
+	f := newFakeNode()
+	defer f.srv.Close()
+	db, clean := testDB(t)
+	defer clean()
+	f.add("std.test", 10)
+	f.add("std.other", 5)
+	ctx := context.Background()
+	n, err := Connect(ctx, f.srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Fetch(ctx, db, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.drop("std.test", 0)
+	m := f.add("std.test", 1)[0]
+	f.requests = make(map[string]int)
+	report, err := n.Fetch(ctx, db, nil, 0)
+	if err != nil || report.Total.New != 1 || db.Lookup(m.MsgId) == nil {
+		t.Errorf("Replaced message is not fetched: %s %v", report.Summary(true), err)
+	}
+	for _, r := range report.Echoes {
+		if r.Echo == "std.other" && r.Mode != FETCH_UNCHANGED {
+			t.Errorf("Wrong report: %s", r)
+		}
+	}
+	if f.count("u/e") != 2 { /* last ids and index of std.test */
+		t.Errorf("Wrong requests: %v", f.requests)
+	}
+	if c := n.Counts["std.test"]; c.Count != 10 || c.Last != m.MsgId {
+		t.Errorf("Wrong counts: %v", n.Counts)
+	}
+}
+
+func TestFetchAdaptive(t *testing.T) {
+	InitLog()
+	f := newFakeNode()
+	defer f.srv.Close()
+	db, clean := testDB(t)
+	defer clean()
+	msgs := f.add("std.test", 40)
+	for _, m := range msgs[:30] {
+		db.Store(m)
+	}
+	ctx := context.Background()
+	n, err := Connect(ctx, f.srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := n.Fetch(ctx, db, []string{"std.test"}, -4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := report.Echoes[0]; r.Mode != FETCH_ADAPTIVE || r.New != 10 {
+		t.Errorf("Wrong report: %s", r)
+	}
+	if ids := db.SelectIDS(&Query{NoAccess: true}); len(ids) != 40 {
+		t.Errorf("Wrong number of messages: %d", len(ids))
+	}
+}
+
+func TestFetchLimits(t *testing.T) {
+	InitLog()
+	f := newFakeNode()
+	defer f.srv.Close()
+	db, clean := testDB(t)
+	defer clean()
+	var echoes []string
+	for i := 0; i < 8; i++ {
+		e := fmt.Sprintf("std.echo%d", i)
+		echoes = append(echoes, e)
+		f.add(e, 4)
+	}
+	f.delay = 10 * time.Millisecond
+	ctx := context.Background()
+	c := &Client{Timeout: 5 * time.Second, MaxPerHost: 2}
+	n, err := Connect(ctx, f.srv.URL, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.MaxConnections = 8
+	if _, err := n.Fetch(ctx, db, echoes, 0); err != nil {
+		t.Fatal(err)
+	}
+	if f.maxInflight > 2 {
+		t.Errorf("Per host limit is not used: %d", f.maxInflight)
+	}
+
+	f.delay = time.Second
+	db2, clean2 := testDB(t)
+	defer clean2()
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report, err := n.Fetch(tctx, db2, echoes, 0)
+	if err != context.DeadlineExceeded || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Fetch is not cancelled: %v", err)
+	}
+	if report.Total.New != 0 || report.Failed != len(echoes) {
+		t.Errorf("Wrong report of cancelled fetch: %s", report.Summary(true))
+	}
+}
@@ -0,0 +1,91 @@
+// Small text databases of node: killfiles, read state, bookmarks,
+// notifications, echo counts and audit log. Files are reloaded
+// when changed and rewritten atomically under file lock.
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Common part of small text databases.
+// Name: short name of database used in path of lock.
+// LockDepth: used for recursive file lock, see DB.Lock.
+type FileDB struct {
+	Path      string
+	Name      string
+	Sync      sync.RWMutex
+	FileInfo  os.FileInfo
+	LockDepth int32
+}
+
+func (db *FileDB) LockPath() string {
+	pat := strings.Replace(db.Path, "/", "_", -1)
+	return fmt.Sprintf("%s/%s-%s.lock", os.TempDir(), pat, db.Name)
+}
+
+// Lock database for write operations.
+// Unlock should not be called if Lock fails.
+func (db *FileDB) Lock() bool {
+	if lock_path(db.LockPath(), &db.LockDepth) {
+		return true
+	}
+	atomic.AddInt32(&db.LockDepth, -1)
+	return false
+}
+
+func (db *FileDB) Unlock() {
+	unlock_path(db.LockPath(), &db.LockDepth)
+}
+
+// Internal function. Read lines of file with fn if file was changed
+// since last read or data is not loaded yet. Returns true if file was
+// read, so parsed data should replace old one. Does not lock!
+func (db *FileDB) _Read(loaded bool, fn func(line string) bool) (bool, error) {
+	changed, info, err := file_changed(db.Path, db.FileInfo)
+	if err != nil {
+		return false, err
+	}
+	if !changed && loaded {
+		return false, nil
+	}
+	if err := FileLines(db.Path, fn); err != nil {
+		Error.Printf("Can not read %s: %s", db.Path, err)
+		return false, err
+	}
+	db.FileInfo = info
+	return true, nil
+}
+
+// Internal function. Replace file with text atomically and reload
+// it with load. Does not lock!
+func (db *FileDB) _Write(text string, load func() error) error {
+	if err := replace_file(db.Path, text); err != nil {
+		return err
+	}
+	db.FileInfo = nil
+	return load()
+}
+
+// Internal function. Make modification fn under locks with fresh
+// copy of data (loaded by load) and save it.
+func (db *FileDB) modify(load func() error, fn func() error, save func() error) error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if !db.Lock() {
+		return errors.New("Can not lock " + db.Path)
+	}
+	defer db.Unlock()
+	db.FileInfo = nil
+	if err := load(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return save()
+}
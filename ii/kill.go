@@ -0,0 +1,341 @@
+// Killfiles: per user ignore lists.
+// All killfiles are stored in one file with lines:
+// <user id>:<kind>:<value>
+package ii
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of killfile rules.
+// from, addr, echo: exact match of author name, address or echo;
+// subj, text: regexp on subject or message body.
+var KillKinds = []string{"from", "addr", "echo", "subj", "text"}
+
+// Killfile rule
+type KillRule struct {
+	Kind  string
+	Value string
+	re    *regexp.Regexp
+}
+
+// Results of body rules by index number of message (MsgInfo.Num):
+// offset of checked record + 1, negative if message is killed,
+// 0 if message is not checked. Edited messages are checked again.
+type killCache struct {
+	offs []int64
+	sync sync.Mutex
+}
+
+// Killfile of one user.
+// Results of body rules are cached (see killCache), cache is
+// shared by killfiles with the same body rules.
+type Killfile struct {
+	Rules []*KillRule
+	cache *killCache
+	sync  sync.Mutex
+}
+
+// Killfiles database.
+// Users: killfiles by user id.
+// Caches of body rules are kept while rules are used by users.
+type KDB struct {
+	FileDB
+	Users  map[int32]*Killfile
+	caches map[string]*killCache
+}
+
+// Create and check killfile rule
+func NewKillRule(kind string, value string) (*KillRule, error) {
+	if value == "" || strings.ContainsAny(value, "\r\n") {
+		return nil, errors.New("Wrong killfile value")
+	}
+	r := &KillRule{Kind: kind, Value: value}
+	switch kind {
+	case "from", "addr", "echo":
+	case "subj", "text":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		r.re = re
+	default:
+		return nil, errors.New("Wrong killfile rule: " + kind)
+	}
+	return r, nil
+}
+
+// Returns true if rule needs message body to match.
+func (r *KillRule) msg() bool {
+	return r.Kind == "addr" || r.re != nil
+}
+
+// Get cached result for message.
+func (c *killCache) get(info *MsgInfo) (bool, bool) {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	if info.Num >= len(c.offs) {
+		return false, false
+	}
+	v, off := c.offs[info.Num], abs_off(info)+1
+	if v != off && v != -off {
+		return false, false
+	}
+	return v < 0, true
+}
+
+// Save result for message.
+func (c *killCache) set(info *MsgInfo, killed bool) {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	if info.Num >= len(c.offs) {
+		c.offs = append(c.offs, make([]int64, info.Num+1-len(c.offs))...)
+	}
+	c.offs[info.Num] = abs_off(info) + 1
+	if killed {
+		c.offs[info.Num] = -c.offs[info.Num]
+	}
+}
+
+func abs_off(info *MsgInfo) int64 {
+	if info.Off < 0 {
+		return -info.Off
+	}
+	return info.Off
+}
+
+// Body rules of killfile as key of cache.
+func (k *Killfile) bodyKey() string {
+	var key string
+	for _, r := range k.Rules {
+		if r.msg() {
+			key += r.Kind + ":" + r.Value + "\n"
+		}
+	}
+	return key
+}
+
+// Decode only header of bundle (address and subject) for rules
+// which do not need text of message. Returns nil if header is
+// not decoded, then whole bundle should be decoded.
+func decode_header(b string) *Msg {
+	if i := strings.IndexByte(b, ':'); i >= 0 {
+		b = b[i+1:]
+	}
+	if len(b) > 1024 { /* multiple of 4 */
+		b = b[:1024]
+	}
+	b = strings.NewReplacer("-", "+", "_", "/").Replace(b)
+	data, err := base64.StdEncoding.DecodeString(b)
+	if err != nil {
+		return nil
+	}
+	a := strings.SplitN(strings.Replace(string(data), "\r", "", -1), "\n", 8)
+	if len(a) < 8 {
+		return nil
+	}
+	return &Msg{Addr: a[4], Subj: a[6]}
+}
+
+func (r *KillRule) match(info *MsgInfo, m *Msg) bool {
+	switch r.Kind {
+	case "from":
+		return info.From == r.Value
+	case "echo":
+		return info.Echo == r.Value
+	case "addr":
+		return m != nil && m.Addr == r.Value
+	case "subj":
+		return m != nil && r.re.MatchString(m.Subj)
+	case "text":
+		return m != nil && r.re.MatchString(m.Text)
+	}
+	return false
+}
+
+// Check if message is killed by killfile.
+// Message is read from db only if needed, text of message is
+// decoded only for text rules.
+// Does not lock db, so it can be used in Query.Match.
+func (k *Killfile) Killed(db *DB, info *MsgInfo) bool {
+	if k == nil || info == nil {
+		return false
+	}
+	body, text := false, false
+	for _, r := range k.Rules {
+		if r.msg() {
+			body = true
+			text = text || r.Kind == "text"
+		} else if r.match(info, nil) {
+			return true
+		}
+	}
+	if !body {
+		return false
+	}
+	k.sync.Lock()
+	if k.cache == nil {
+		k.cache = &killCache{}
+	}
+	c := k.cache
+	k.sync.Unlock()
+	if killed, ok := c.get(info); ok {
+		return killed
+	}
+	b := db._ReadBundle(info)
+	var m *Msg
+	if !text {
+		m = decode_header(b)
+	}
+	if m == nil {
+		var err error
+		if m, err = DecodeBundle(b); err != nil {
+			return false
+		}
+	}
+	killed := false
+	for _, r := range k.Rules {
+		if r.msg() && r.match(info, m) {
+			killed = true
+			break
+		}
+	}
+	c.set(info, killed)
+	return killed
+}
+
+// Open killfiles database.
+func OpenKillfiles(path string) *KDB {
+	return &KDB{FileDB: FileDB{Path: path, Name: "kill"}}
+}
+
+// Load killfiles if file was changed.
+func (db *KDB) Load() error {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	return db._Load()
+}
+
+// Internal function to implement Load. Does not lock!
+func (db *KDB) _Load() error {
+	users := make(map[int32]*Killfile)
+	read, err := db._Read(db.Users != nil, func(line string) bool {
+		a := strings.SplitN(line, ":", 3)
+		if len(a) < 3 {
+			Error.Printf("Wrong entry in killfile: %s", line)
+			return true
+		}
+		var id int32
+		if _, err := fmt.Sscanf(a[0], "%d", &id); err != nil {
+			Error.Printf("Wrong ID in killfile: %s", a[0])
+			return true
+		}
+		r, err := NewKillRule(a[1], a[2])
+		if err != nil {
+			Error.Printf("Wrong rule in killfile: %s: %s", line, err)
+			return true
+		}
+		k, ok := users[id]
+		if !ok {
+			k = &Killfile{}
+			users[id] = k
+		}
+		k.Rules = append(k.Rules, r)
+		return true
+	})
+	if read {
+		caches := make(map[string]*killCache)
+		for _, k := range users {
+			key := k.bodyKey()
+			if key == "" {
+				continue
+			}
+			if caches[key] == nil {
+				caches[key] = db.caches[key]
+			}
+			if caches[key] == nil {
+				caches[key] = &killCache{}
+			}
+			k.cache = caches[key]
+		}
+		db.Users, db.caches = users, caches
+	}
+	return err
+}
+
+// Get killfile of user. Returns nil if killfile is empty.
+// Reloads killfiles if needed.
+func (db *KDB) Get(id int32) *Killfile {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if err := db._Load(); err != nil {
+		return nil
+	}
+	return db.Users[id]
+}
+
+// Internal function. Save all killfiles atomically. Does not lock!
+func (db *KDB) _Save() error {
+	var text string
+	var ids []int32
+	for id := range db.Users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		for _, r := range db.Users[id].Rules {
+			text += fmt.Sprintf("%d:%s:%s\n", id, r.Kind, r.Value)
+		}
+	}
+	return db._Write(text, db._Load)
+}
+
+// Modify killfile of user with id. Modifications are
+// done under lock with fresh copy of killfiles. Killfile
+// returned by Get is not changed (it can be in use).
+func (db *KDB) Modify(id int32, fn func(k *Killfile) error) error {
+	return db.modify(db._Load, func() error {
+		k := &Killfile{}
+		if old, ok := db.Users[id]; ok {
+			k.Rules = append(k.Rules, old.Rules...)
+		}
+		db.Users[id] = k
+		return fn(k)
+	}, db._Save)
+}
+
+// Add rule to killfile of user.
+func (db *KDB) Add(id int32, kind string, value string) error {
+	r, err := NewKillRule(kind, value)
+	if err != nil {
+		return err
+	}
+	return db.Modify(id, func(k *Killfile) error {
+		for _, v := range k.Rules {
+			if v.Kind == kind && v.Value == value {
+				return errors.New("Rule already exists")
+			}
+		}
+		k.Rules = append(k.Rules, r)
+		return nil
+	})
+}
+
+// Remove rule from killfile of user.
+func (db *KDB) Del(id int32, kind string, value string) error {
+	return db.Modify(id, func(k *Killfile) error {
+		for i, v := range k.Rules {
+			if v.Kind == kind && v.Value == value {
+				k.Rules = append(k.Rules[:i], k.Rules[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("No such rule")
+	})
+}
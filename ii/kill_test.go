@@ -0,0 +1,101 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKillfile(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	db := OpenDB(dir + "/db")
+	m, _ := DecodeBundle(Test_msg)
+	if err := db.Store(m); err != nil {
+		t.Fatal("Can not save msg", err)
+	}
+	info := db.Lookup(m.MsgId)
+
+	kdb := OpenKillfiles(dir + "/killfile.txt")
+	if kdb.Get(1) != nil {
+		t.Error("Empty killfile is not nil")
+	}
+	for _, v := range [][2]string{{"from", "nobody"}, {"bad", "x"},
+		{"subj", "("}, {"text", ""}} {
+		err := kdb.Add(1, v[0], v[1])
+		if (v[0] == "from") != (err == nil) {
+			t.Errorf("Add %s:%s: %v", v[0], v[1], err)
+		}
+	}
+	if kdb.Add(1, "from", "nobody") == nil {
+		t.Error("Duplicate rule added")
+	}
+	if kdb.Get(1).Killed(db, info) {
+		t.Error("Message killed by wrong rule")
+	}
+	for _, v := range [][2]string{{"from", m.From}, {"echo", m.Echo},
+		{"addr", m.Addr}, {"subj", "^" + m.Subj[:2]}, {"text", "(?s)."}} {
+		k := &Killfile{}
+		r, err := NewKillRule(v[0], v[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.Rules = append(k.Rules, r)
+		if !k.Killed(db, info) {
+			t.Errorf("Message is not killed by %s:%s", v[0], v[1])
+		}
+	}
+	long := &Msg{Echo: "std.test", From: "bob", Addr: "node,2", To: "All",
+		Subj: "long", Text: strings.Repeat("text ", 1000), Tags: NewTags("ii/ok")}
+	long.Encode()
+	if err := db.Store(long); err != nil {
+		t.Fatal(err)
+	}
+	if h := decode_header(db.GetBundle(long.MsgId)); h == nil ||
+		h.Addr != long.Addr || h.Subj != long.Subj {
+		t.Errorf("Wrong header: %v", h)
+	}
+	k := &Killfile{}
+	r, _ := NewKillRule("subj", "^long$")
+	k.Rules = append(k.Rules, r)
+	if !k.Killed(db, db.Lookup(long.MsgId)) || k.Killed(db, info) {
+		t.Error("Wrong result of subject rule")
+	}
+	long.Subj = "edited"
+	if err := db.Edit(long); err != nil {
+		t.Fatal(err)
+	}
+	if k.Killed(db, db.Lookup(long.MsgId)) {
+		t.Error("Result for edited message is cached")
+	}
+	if err := kdb.Add(3, "subj", "^edited$"); err != nil {
+		t.Fatal(err)
+	}
+	kdb.Add(4, "subj", "^edited$")
+	c := kdb.Get(3).cache
+	if c == nil || kdb.Get(4).cache != c {
+		t.Error("Cache is not shared")
+	}
+	kdb.Add(4, "from", "nobody")
+	if kdb.Get(3).cache != c || kdb.Get(4).cache != c {
+		t.Error("Cache is not kept after reload")
+	}
+	if err := kdb.Add(2, "echo", m.Echo); err != nil {
+		t.Fatal(err)
+	}
+	kdb2 := OpenKillfiles(kdb.Path) // other process
+	if !kdb2.Get(2).Killed(db, info) || kdb2.Get(1).Killed(db, info) {
+		t.Error("Killfiles are not shared")
+	}
+	if err := kdb2.Del(2, "echo", m.Echo); err != nil {
+		t.Fatal(err)
+	}
+	if kdb.Get(2).Killed(db, info) {
+		t.Error("Rule is not removed")
+	}
+}
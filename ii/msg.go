@@ -82,6 +82,9 @@ func IsEmptySubject(s string) bool {
 	return len(strings.TrimSpace(s)) > 0
 }
 
+// Max size of message in DecodeMsgline.
+var MaxMsgSize = 65536
+
 // Decode message from point sent with /u/point scheme.
 // Try to use URL save and STD base64.
 // Returns pointrt to decoded Msg or nil (and error)
@@ -91,7 +94,7 @@ func DecodeMsgline(msg string, enc bool) (*Msg, error) {
 	var m Msg
 	var data []byte
 	var err error
-	if len(msg) > 65536 {
+	if len(msg) > MaxMsgSize {
 		return nil, errors.New("Message too long")
 	}
 	if enc {
@@ -1,65 +1,60 @@
-// Network operations: fetch, post/get message from point
-// Check node extensions.
+// Network operations: post/get message from point, push,
+// check node extensions. Fetch is in fetch.go.
 
 package ii
 
 import (
-	"bufio"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	//	"net/smtp"
 	"net/url"
 	"strings"
-	"sync"
 )
 
 // Node object. Use Connect to create it.
 // Host: url node
 // Features: extensions map
 // Force: force sync even last message is not new
+// Auth: node auth (secret of account on node) for Push
+// Filter: called before fetched message is stored, error rejects it
+// Pending: premoderation queue, messages in it are not fetched again
+// Stored: number of fetched messages stored in db (atomic)
+// Client: http client (NewClient() if nil)
+// MaxConnections: max parallel requests of Fetch
+// Counts: counts and last messages of echoes at last fetch, Fetch
+// updates them and does not fetch echoes with the same counts and
+// last messages (if not Force)
 type Node struct {
-	Host     string
-	Features map[string]bool
-	Force    bool
+	Host           string
+	Features       map[string]bool
+	Force          bool
+	Auth           string
+	Filter         func(m *Msg) error
+	Pending        *DB
+	Stored         int64
+	Client         *Client
+	MaxConnections int
+	Counts         map[string]EchoCount
 }
 
-// utility function to make get request and call fn
-// for every line. Stops on EOF or fn return false.
-func http_req_lines(url string, fn func(string) bool) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	reader := bufio.NewReader(resp.Body)
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil && err != io.EOF {
-			return err
-		}
-		line = strings.TrimSuffix(line, "\n")
-		if err == io.EOF {
-			if line != "" { /* node do not send final \n */
-				fn(line)
-			}
-			break
-		}
-		if !fn(line) {
-			break
-		}
+// Max number of messages in one u/push request.
+const PUSH_BATCH = 32
+
+// Client of node (default client if it is not set).
+func (n *Node) client() *Client {
+	if n.Client == nil {
+		n.Client = NewClient()
 	}
-	return nil
+	return n.Client
 }
 
-// short variant of http_get_lines. Read one line and
-// interpret it as message id. Return it.
-func http_get_id(url string) (string, error) {
+// Make get request and interpret response as message id.
+// Returns error if response is not valid message id.
+func (n *Node) get_id(ctx context.Context, url string) (string, error) {
 	res := ""
-	if err := http_req_lines(url, func(line string) bool {
+	if err := n.client().Lines(ctx, url, func(line string) bool {
 		if strings.Contains(line, ".") {
 			return true
 		}
@@ -68,149 +63,65 @@ func http_get_id(url string) (string, error) {
 	}); err != nil {
 		return "", err
 	}
+	if !IsMsgId(res) {
+		return res, &IDECError{URL: url, Msg: "No valid MsgId"}
+	}
 	return res, nil
 }
 
-// Fetcher internal goroutine.
-// DB: db to write
-// Echo: echo to fetch
-// wait: sync for Fetch master to detect finishing of work
-// cond: used for wake-up new goroutines
-// Can work in different modes.
-// If limit > 0, just fetch last [limit] messages (-limit:limit slice)
-// if limit < 0, use adaptive mode, probe (-(2*n)* limit:1) messages
-// untill find old message.
-// if node does not support u/e slices, than full sync performed
-// if node connection is not in Force mode, do not perform sync if not needed
-func (n *Node) Fetcher(db *DB, Echo string, limit int, wait *sync.WaitGroup, cond *sync.Cond) {
-	defer func() {
-		cond.L.Lock()
-		cond.Broadcast()
-		cond.L.Unlock()
-	}()
-	defer wait.Done()
-	if n.IsFeature("u/e") { /* fast path */
-		if !n.Force {
-			id, err := http_get_id(n.Host + "/u/e/" + Echo + "/-1:1")
-			if err != nil || !IsMsgId(id) {
-				Info.Printf("%s %s: no valid MsgId (%s)", n.Host, Echo, id)
-				return
-			} else if db.Exists(id) != nil { /* no sync needed */
-				Info.Printf("%s %s: no sync needed", n.Host, Echo)
-				return
-			}
-		}
-		if limit < 0 {
-			limit = -limit
-			try := 0
-			for { // adaptive
-				if try > 16 { /* fallback to old scheme */
-					Info.Printf("%s %s: fallback to old scheme", n.Host, Echo)
-					limit = 0
-					break
-				}
-				id, err := http_get_id(fmt.Sprintf("%s/u/e/%s/%d:1",
-					n.Host, Echo, -limit))
-				if err != nil || !IsMsgId(id) { /* fallback to old scheme */
-					Info.Printf("%s %s: fallback to old scheme", n.Host, Echo)
-					limit = 0
-					break
-				}
-				if db.Exists(id) != nil {
-					break
-				}
-				try++
-				limit *= 2
-			}
-		}
-	} else {
-		limit = 0
-	}
-	req := fmt.Sprintf("%s/u/e/%s", n.Host, Echo)
-	if limit > 0 {
-		req = fmt.Sprintf("%s/%d:%d", req, -limit, limit)
+// Check reply of node on point message.
+func point_reply(url string, buf []byte) error {
+	if strings.HasPrefix(string(buf), "msg ok") {
+		Trace.Printf("Server responced msg ok")
+		return nil
 	}
-	Info.Printf("Get %s", req)
-	var res []string
-	if err := http_req_lines(req, func(line string) bool {
-		if strings.Contains(line, ".") {
-			return true
-		}
-		if db.Exists(line) == nil {
-			res = append(res, line)
-		}
-		return true
-	}); err != nil {
-		return
+	msg := strings.TrimSpace(string(buf))
+	if msg == "" {
+		msg = "Server did not response with ok"
 	}
-	n.Store(db, res)
+	return &IDECError{URL: url, Msg: msg}
 }
 
-// Do not run more then MaxConnections goroutines in the same time
-var MaxConnections = 6
-
 // Send point message to node using GET method of /u/point scheme.
 // pauth: secret string. msg - raw message in plaintext
-// returns error
-func (n *Node) Send(pauth string, msg string) error {
+// returns error. Request is not repeated on errors.
+func (n *Node) Send(ctx context.Context, pauth string, msg string) error {
 	msg = base64.URLEncoding.EncodeToString([]byte(msg))
 	//	msg = url.QueryEscape(msg)
 	req := fmt.Sprintf("%s/u/point/%s/%s", n.Host, pauth, msg)
-	resp, err := http.Get(req)
-	Trace.Printf("Get %s", req)
+	buf, err := n.client().read(ctx, "GET", req, nil, false)
 	if err != nil {
 		return err
 	}
-	buf, err := ioutil.ReadAll(resp.Body)
-	if strings.HasPrefix(string(buf), "msg ok") {
-		Trace.Printf("Server responced msg ok")
-		return nil
-	} else if len(buf) > 0 {
-		err = errors.New(string(buf))
-	}
-	if err == nil {
-		err = errors.New("Server did not response with ok")
-	}
-	return err
+	return point_reply(n.Host+"/u/point", buf)
 }
 
 // Send point message to node using POST method of /u/point scheme.
 // pauth: secret string. msg - raw message in plaintext
-// returns error
-func (n *Node) Post(pauth string, msg string) error {
+// returns error. Request is not repeated on errors.
+func (n *Node) Post(ctx context.Context, pauth string, msg string) error {
 	msg = base64.StdEncoding.EncodeToString([]byte(msg))
 	// msg = url.QueryEscape(msg)
 	postData := url.Values{
 		"pauth": {pauth},
 		"tmsg":  {msg},
 	}
-	resp, err := http.PostForm(n.Host+"/u/point", postData)
-	Trace.Printf("Post %s/u/point", n.Host)
+	buf, err := n.client().Post(ctx, n.Host+"/u/point", postData, false)
 	if err != nil {
 		return err
 	}
-	buf, err := ioutil.ReadAll(resp.Body)
-	if strings.HasPrefix(string(buf), "msg ok") {
-		Trace.Printf("Server responced msg ok")
-		return nil
-	} else if len(buf) > 0 {
-		err = errors.New(string(buf))
-	}
-	if err == nil {
-		err = errors.New("Server did not response with ok")
-	}
-	return err
+	return point_reply(n.Host+"/u/point", buf)
 }
 
 // Return list.txt in []string if node supports it.
 // WARNING: Only echo names are returned! Each string is just echoarea.
 // Used for fetch all mode.
-func (n *Node) List() ([]string, error) {
+func (n *Node) List(ctx context.Context) ([]string, error) {
 	var list []string
 	if !n.IsFeature("list.txt") {
 		return list, nil
 	}
-	if err := http_req_lines(n.Host+"/list.txt", func(line string) bool {
+	if err := n.client().Lines(ctx, n.Host+"/list.txt", func(line string) bool {
 		list = append(list, strings.Split(line, ":")[0])
 		return true
 	}); err != nil {
@@ -219,81 +130,77 @@ func (n *Node) List() ([]string, error) {
 	return list, nil
 }
 
-// Fetch and write selected messages in db.
-// ids: selected message ids.
-// db: Database.
-// This function make /u/m request, decodes bundles, checks,
-// and write them to db (line by line).
-func (n *Node) Store(db *DB, ids []string) error {
-	req := ""
-	var nreq int
-	count := len(ids)
-	Trace.Printf("Get and store messages")
-	for i := 0; i < count; i++ {
-		req = req + "/" + string(ids[i])
-		nreq++
-		if nreq < 8 && i < count-1 {
-			continue
-		}
-		if err := http_req_lines(n.Host+"/u/m"+req, func(b string) bool {
-			m, e := DecodeBundle(b)
-			if e != nil {
-				Error.Printf("Can not decode message %s (%s)\n", b, e)
-				return true
-			}
-			if e := db.Store(m); e != nil {
-				Error.Printf("Can not write message %s (%s)\n", m.MsgId, e)
-			}
-			return true
-		}); err != nil {
-			return err
+// Send bundle with u/push request (form fields nauth and upush).
+// Returns number of messages accepted by node. Request is
+// repeated on errors, messages with the same ids are not stored twice.
+func (n *Node) push(ctx context.Context, bundle string) (int, error) {
+	data, err := n.client().Post(ctx, n.Host+"/u/push",
+		url.Values{"nauth": {n.Auth}, "upush": {bundle}}, true)
+	if err != nil {
+		return 0, err
+	}
+	ok := 0
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(l, "message saved: ok") {
+			ok++
+		} else if strings.HasPrefix(l, "error: auth") {
+			return 0, &IDECError{URL: n.Host + "/u/push", Msg: "Access denied"}
+		} else if l != "" {
+			Info.Printf("%s/u/push: %s", n.Host, l)
 		}
-		nreq = 0
-		req = ""
 	}
-	return nil
+	return ok, nil
 }
 
-// This is Fetcher master function. It makes fetch from node
-// and run goroutines in parralel mode (one goroutine per echo).
-// Echolist: list with echoarea names. If list is empty,
-// function will try to get list via list.txt request.
-// limit: see Fetcher function. Describe fetching mode/limit.
-func (n *Node) Fetch(db *DB, Echolist []string, limit int) error {
-	if len(Echolist) == 0 {
-		Echolist, _ = n.List()
-	}
-	if Echolist == nil {
-		return nil
-	}
-	var wait sync.WaitGroup
-	cond := sync.NewCond(&sync.Mutex{})
-	num := 0
-	Info.Printf("Start fetcher(s) for %s", n.Host)
-	for _, v := range Echolist {
-		if !IsEcho(v) {
-			if strings.Trim(v, " ") != "" {
-				Trace.Printf("Skip echo: %s", v)
-			}
+// Push locally originated messages (with address of db.Name)
+// from echoes to node with u/push extension. Messages stored (or
+// edited) in db since position from (see DB.Position) with date
+// not older than since (unix time) are pushed, so messages stored
+// with old date (approved after premoderation) are pushed too.
+// Messages are selected by index and read with one pass over db
+// (see ReadBundles). Returns number of messages accepted and
+// position to push from next time (from if push is failed).
+func (n *Node) Push(ctx context.Context, db *DB, echoes []string, since int64, from int64) (int, int64, error) {
+	if !n.IsFeature("u/push") {
+		return 0, from, errors.New("Node does not support u/push: " + n.Host)
+	}
+	next := db.Position() /* messages stored while pushing are pushed next time */
+	q := Query{Match: func(mi *MsgInfo, q *Query) bool {
+		return mi.Off >= from && mi.Off < next
+	}}
+	var ids, bundles []string
+	for _, e := range echoes {
+		if !IsEcho(e) || IsPrivate(e) {
 			continue
 		}
-		wait.Add(1)
-		num += 1
-		if num >= MaxConnections { /* add per one */
-			cond.L.Lock()
-			Trace.Printf("Start fetcher for: %s", v)
-			go n.Fetcher(db, v, limit, &wait, cond)
-			Trace.Printf("Waiting free thread")
-			cond.Wait()
-			cond.L.Unlock()
-		} else {
-			Trace.Printf("Start fetcher for: %s", v)
-			go n.Fetcher(db, v, limit, &wait, cond)
+		q.Echo = e
+		ids = append(ids, db.SelectIDS(&q)...)
+	}
+	if err := db.ReadBundles(ids, func(b string) bool {
+		m, err := DecodeBundle(b)
+		if err == nil && m.Date >= since &&
+			strings.HasPrefix(m.Addr, db.Name+",") {
+			bundles = append(bundles, b)
 		}
+		return true
+	}); err != nil {
+		return 0, from, err
 	}
-	Trace.Printf("Waiting thread(s)")
-	wait.Wait()
-	return nil
+	total := 0
+	for len(bundles) > 0 {
+		nr := len(bundles)
+		if nr > PUSH_BATCH {
+			nr = PUSH_BATCH
+		}
+		ok, err := n.push(ctx, strings.Join(bundles[:nr], "\n"))
+		total += ok
+		if err != nil {
+			return total, from, err
+		}
+		bundles = bundles[nr:]
+	}
+	Info.Printf("Pushed %d messages to %s", total, n.Host)
+	return total, next, nil
 }
 
 // Check if node has feature?
@@ -304,12 +211,14 @@ func (n *Node) IsFeature(f string) bool {
 }
 
 // Connect to node, get features and returns
-// pointer to Node object.
-func Connect(addr string) (*Node, error) {
+// pointer to Node object. c: http client (NewClient() if nil).
+func Connect(ctx context.Context, addr string, c *Client) (*Node, error) {
 	var n Node
 	n.Host = strings.TrimSuffix(addr, "/")
 	n.Features = make(map[string]bool)
-	if err := http_req_lines(n.Host+"/x/features", func(line string) bool {
+	n.Client = c
+	n.MaxConnections = DEFAULT_CONNECTIONS
+	if err := n.client().Lines(ctx, n.Host+"/x/features", func(line string) bool {
 		n.Features[line] = true
 		Trace.Printf("%s supports %s", n.Host, line)
 		return true
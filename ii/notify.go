@@ -0,0 +1,499 @@
+// Notifications of users: replies, To: addressing and @mentions.
+// All notifications are stored in one file with lines:
+// <user id>:n:<kind>:<msgid>:<date>
+// <user id>:r:<date of last read notification>
+// <user id>:p:<kinds|none>:<e-mail 0/1>:<webhook url>
+package ii
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Max number of stored notifications per user.
+const NOTIFY_MAX = 100
+
+// Max number of e-mails and webhook calls waiting for delivery.
+const NOTIFY_QUEUE = 64
+
+// Kinds of notifications in order of priority.
+var NotifyKinds = []string{"reply", "to", "mention"}
+
+// Notification about message.
+type Notification struct {
+	Kind  string
+	MsgId string
+	Date  int64
+}
+
+// Notification preferences of user.
+// Kinds: enabled kinds of notifications.
+// Email: deliver notifications to e-mail of user.
+// Webhook: deliver notifications to this URL (JSON POST).
+type NotifyPrefs struct {
+	Kinds   []string
+	Email   bool
+	Webhook string
+}
+
+// Notifications of one user. Notifications with Date > Read are unread.
+type Notifications struct {
+	List  []Notification
+	Read  int64
+	Prefs NotifyPrefs
+}
+
+// Notifications database.
+// Users: notifications by user id.
+type NDB struct {
+	FileDB
+	Users map[int32]*Notifications
+}
+
+// Check if kind of notifications is enabled.
+func (p *NotifyPrefs) Enabled(kind string) bool {
+	for _, v := range p.Kinds {
+		if v == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of unread notifications.
+func (n *Notifications) Unread() int {
+	count := 0
+	for _, v := range n.List {
+		if v.Date > n.Read {
+			count++
+		}
+	}
+	return count
+}
+
+// Check if string is valid webhook URL.
+func IsWebhook(url string) bool {
+	return (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) &&
+		!strings.ContainsAny(url, " \r\n\t")
+}
+
+func newNotifications() *Notifications {
+	return &Notifications{Prefs: NotifyPrefs{Kinds: NotifyKinds}}
+}
+
+// Open notifications database.
+func OpenNotifications(path string) *NDB {
+	return &NDB{FileDB: FileDB{Path: path, Name: "notify"}}
+}
+
+// Internal function. Load notifications if file was changed. Does not lock!
+func (db *NDB) _Load() error {
+	users := make(map[int32]*Notifications)
+	read, err := db._Read(db.Users != nil, func(line string) bool {
+		a := strings.SplitN(line, ":", 5)
+		var id int32
+		if len(a) < 3 {
+			Error.Printf("Wrong entry in notifications: %s", line)
+			return true
+		}
+		if _, err := fmt.Sscanf(a[0], "%d", &id); err != nil {
+			Error.Printf("Wrong ID in notifications: %s", a[0])
+			return true
+		}
+		n, ok := users[id]
+		if !ok {
+			n = newNotifications()
+			users[id] = n
+		}
+		switch {
+		case a[1] == "n" && len(a) == 5 && IsMsgId(a[3]):
+			v := Notification{Kind: a[2], MsgId: a[3]}
+			fmt.Sscanf(a[4], "%d", &v.Date)
+			n.List = append(n.List, v)
+		case a[1] == "r":
+			fmt.Sscanf(a[2], "%d", &n.Read)
+		case a[1] == "p" && len(a) == 5:
+			n.Prefs.Kinds = nil
+			if a[2] != "none" {
+				n.Prefs.Kinds = strings.Split(a[2], ",")
+			}
+			n.Prefs.Email = a[3] == "1"
+			n.Prefs.Webhook = a[4]
+		default:
+			Error.Printf("Wrong entry in notifications: %s", line)
+		}
+		return true
+	})
+	if read {
+		db.Users = users
+	}
+	return err
+}
+
+// Get notifications of user (copy). Reloads notifications if needed.
+func (db *NDB) Get(id int32) *Notifications {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	n := newNotifications()
+	if err := db._Load(); err != nil {
+		return n
+	}
+	if v, ok := db.Users[id]; ok {
+		n.List = append(n.List, v.List...)
+		n.Read = v.Read
+		n.Prefs = v.Prefs
+		n.Prefs.Kinds = append([]string(nil), v.Prefs.Kinds...)
+	}
+	return n
+}
+
+// Internal function. Save all notifications atomically. Does not lock!
+func (db *NDB) _Save() error {
+	var text string
+	var ids []int32
+	for id := range db.Users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		n := db.Users[id]
+		for _, v := range n.List {
+			text += fmt.Sprintf("%d:n:%s:%s:%d\n", id, v.Kind, v.MsgId, v.Date)
+		}
+		if n.Read != 0 {
+			text += fmt.Sprintf("%d:r:%d\n", id, n.Read)
+		}
+		kinds := strings.Join(n.Prefs.Kinds, ",")
+		if kinds == "" {
+			kinds = "none"
+		}
+		if kinds != strings.Join(NotifyKinds, ",") || n.Prefs.Email || n.Prefs.Webhook != "" {
+			text += fmt.Sprintf("%d:p:%s:%s:%s\n", id, kinds, b2s(n.Prefs.Email),
+				n.Prefs.Webhook)
+		}
+	}
+	return db._Write(text, db._Load)
+}
+
+// Modify notifications of user with id. Modifications are
+// done under lock with fresh copy of notifications.
+func (db *NDB) Modify(id int32, fn func(n *Notifications) error) error {
+	return db.modify(db._Load, func() error {
+		n, ok := db.Users[id]
+		if !ok {
+			n = newNotifications()
+			db.Users[id] = n
+		}
+		return fn(n)
+	}, db._Save)
+}
+
+// Add notification. Only NOTIFY_MAX last notifications are kept.
+func (db *NDB) Add(id int32, v Notification) error {
+	return db.Modify(id, func(n *Notifications) error {
+		for _, o := range n.List {
+			if o.MsgId == v.MsgId {
+				return nil
+			}
+		}
+		n.List = append(n.List, v)
+		if len(n.List) > NOTIFY_MAX {
+			n.List = n.List[len(n.List)-NOTIFY_MAX:]
+		}
+		return nil
+	})
+}
+
+// Mark all notifications of user as read.
+func (db *NDB) MarkRead(id int32) error {
+	return db.Modify(id, func(n *Notifications) error {
+		for _, v := range n.List {
+			if v.Date > n.Read {
+				n.Read = v.Date
+			}
+		}
+		return nil
+	})
+}
+
+// Change notification preferences of user.
+func (db *NDB) SetPrefs(id int32, prefs NotifyPrefs) error {
+	if prefs.Webhook != "" && !IsWebhook(prefs.Webhook) {
+		return errors.New("Wrong webhook URL")
+	}
+	for _, k := range prefs.Kinds {
+		found := false
+		for _, v := range NotifyKinds {
+			found = found || k == v
+		}
+		if !found {
+			return errors.New("Wrong kind of notification: " + k)
+		}
+	}
+	return db.Modify(id, func(n *Notifications) error {
+		n.Prefs = prefs
+		return nil
+	})
+}
+
+var quoteRegex = regexp.MustCompile("^[^ >]*>")
+var mentionRegex = regexp.MustCompile(`(^|[^a-zA-Z0-9_])@([^ \t@:/,;!?()<>"'*]+)`)
+
+// Get names mentioned in message text as @name.
+// Quoted lines are skipped.
+func Mentions(text string) []string {
+	var names []string
+	for _, l := range strings.Split(text, "\n") {
+		if quoteRegex.MatchString(l) {
+			continue
+		}
+		for _, v := range mentionRegex.FindAllStringSubmatch(l, -1) {
+			names = append(names, strings.TrimRight(v[2], "."))
+		}
+	}
+	return names
+}
+
+// Notifier finds local users to notify about new message
+// and delivers notifications. E-mails and webhooks are delivered
+// in background from queue of NOTIFY_QUEUE size (see Close).
+// SMTP: mail server (host:port) for e-mail delivery, "" - no e-mail.
+// MailFrom: sender of e-mails.
+// Host: node address for links.
+// Client: http client of webhooks, if nil, only public addresses
+// of webhooks are allowed.
+type Notifier struct {
+	DB       *DB
+	UDB      *UDB
+	NDB      *NDB
+	SMTP     string
+	MailFrom string
+	Host     string
+	Client   *http.Client
+
+	sync   sync.Mutex
+	queue  chan func()
+	done   chan struct{}
+	closed bool
+}
+
+// Get users to notify about message: map of user names to kinds.
+// Users are notified about replies to own messages, messages addressed
+// to them and @mentions. Author and users without read access
+// are skipped.
+func (n *Notifier) Targets(m *Msg) map[string]string {
+	targets := make(map[string]string)
+	add := func(name string, kind string) {
+		if _, ok := targets[name]; !ok && name != m.From {
+			targets[name] = kind
+		}
+	}
+	if repto, _ := m.Tag("repto"); repto != "" {
+		if p := n.DB.Get(repto); p != nil {
+			if u := n.UDB.UserInfoName(p.From); u != nil &&
+				p.Addr == n.DB.Addr(u) {
+				add(p.From, "reply")
+			}
+		}
+	}
+	if m.To != "All" {
+		add(m.To, "to")
+	}
+	for _, name := range Mentions(m.Text) {
+		add(name, "mention")
+	}
+	info := n.DB.Lookup(m.MsgId)
+	for name := range targets {
+		u := n.UDB.UserInfoName(name)
+		if u == nil || info == nil || !n.DB.Access(info, u) {
+			delete(targets, name)
+		}
+	}
+	return targets
+}
+
+// Notify users about new message. Supposed to be used as DB.Stored.
+func (n *Notifier) Notify(m *Msg) {
+	for name, kind := range n.Targets(m) {
+		u := n.UDB.UserInfoName(name)
+		if !n.NDB.Get(u.Id).Prefs.Enabled(kind) {
+			continue
+		}
+		if err := n.Send(u, kind, m); err != nil {
+			Error.Printf("Can not add notification for %s: %s", name, err)
+		}
+	}
+}
+
+// Add notification for user and queue its delivery
+// by e-mail and webhook if user wants it.
+func (n *Notifier) Send(u *User, kind string, m *Msg) error {
+	v := Notification{Kind: kind, MsgId: m.MsgId, Date: time.Now().Unix()}
+	if err := n.NDB.Add(u.Id, v); err != nil {
+		return err
+	}
+	Trace.Printf("Notification %s for %s: %s", kind, u.Name, m.MsgId)
+	prefs := n.NDB.Get(u.Id).Prefs
+	if prefs.Email && n.SMTP != "" {
+		n.deliver(func() {
+			if err := n.Mail(u, kind, m); err != nil {
+				Error.Printf("Can not send e-mail to %s: %s", u.Name, err)
+			}
+		})
+	}
+	if prefs.Webhook != "" {
+		n.deliver(func() {
+			if err := n.Webhook(prefs.Webhook, u, kind, m); err != nil {
+				Error.Printf("Can not call webhook of %s: %s", u.Name, err)
+			}
+		})
+	}
+	return nil
+}
+
+// Queue delivery. Worker is started on first delivery.
+// Delivery is dropped if queue is full or notifier is closed.
+func (n *Notifier) deliver(fn func()) {
+	n.sync.Lock()
+	defer n.sync.Unlock()
+	if n.closed {
+		Error.Printf("Notifier is closed, delivery is dropped")
+		return
+	}
+	if n.queue == nil {
+		n.queue = make(chan func(), NOTIFY_QUEUE)
+		n.done = make(chan struct{})
+		go func(queue chan func(), done chan struct{}) {
+			for fn := range queue {
+				fn()
+			}
+			close(done)
+		}(n.queue, n.done)
+	}
+	select {
+	case n.queue <- fn:
+	default:
+		Error.Printf("Notification queue is full, delivery is dropped")
+	}
+}
+
+// Wait for delivery of queued notifications and stop worker.
+// Notifications are not delivered after Close.
+func (n *Notifier) Close() {
+	n.sync.Lock()
+	n.closed = true
+	queue, done := n.queue, n.done
+	n.queue = nil
+	n.sync.Unlock()
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+}
+
+func notify_subj(kind string, m *Msg) string {
+	switch kind {
+	case "reply":
+		return fmt.Sprintf("%s replied: %s", m.From, m.Subj)
+	case "to":
+		return fmt.Sprintf("%s wrote to you: %s", m.From, m.Subj)
+	case "approved":
+		return fmt.Sprintf("Your message is approved: %s", m.Subj)
+	}
+	return fmt.Sprintf("%s mentioned you: %s", m.From, m.Subj)
+}
+
+// Send notification to e-mail of user.
+func (n *Notifier) Mail(u *User, kind string, m *Msg) error {
+	text := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n%s/%s#%s\r\n",
+		n.MailFrom, u.Mail, notify_subj(kind, m), m.Echo, n.Host, m.MsgId, m.MsgId)
+	return smtp.SendMail(n.SMTP, nil, n.MailFrom, []string{u.Mail}, []byte(text))
+}
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, v := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+		"100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(v)
+		privateNets = append(privateNets, n)
+	}
+}
+
+// Check if address is public: not loopback, private,
+// link-local, multicast or unspecified one.
+func public_ip(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Webhooks can connect only to public addresses. Address is
+// checked at dial time, after name of host is resolved.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !public_ip(ip) {
+					return errors.New("Address of webhook is not allowed: " + host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// Send notification to webhook of user as JSON POST request.
+func (n *Notifier) Webhook(url string, u *User, kind string, m *Msg) error {
+	data, err := json.Marshal(map[string]string{
+		"user": u.Name,
+		"kind": kind,
+		"id":   m.MsgId,
+		"echo": m.Echo,
+		"from": m.From,
+		"subj": m.Subj,
+		"text": notify_subj(kind, m),
+		"link": fmt.Sprintf("%s/%s#%s", n.Host, m.MsgId, m.MsgId),
+	})
+	if err != nil {
+		return err
+	}
+	client := n.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package ii
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	names := Mentions("Hi @alice, @bob.\nalice> @carol\nmail@example.com (@dave)")
+	if len(names) != 3 || names[0] != "alice" || names[1] != "bob" || names[2] != "dave" {
+		t.Errorf("Wrong mentions: %v", names)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	ndb := OpenNotifications(dir + "/notify.txt")
+	if n := ndb.Get(1); len(n.List) != 0 || !n.Prefs.Enabled("reply") {
+		t.Error("Wrong empty notifications")
+	}
+	for i := 0; i < NOTIFY_MAX+2; i++ {
+		m := &Msg{Echo: "std.test", Text: string(rune('a' + i%26)), Date: int64(i)}
+		m.Encode()
+		ndb.Add(1, Notification{Kind: "to", MsgId: m.MsgId, Date: int64(i + 1)})
+	}
+	ndb2 := OpenNotifications(ndb.Path) // other process
+	if n := ndb2.Get(1); len(n.List) != NOTIFY_MAX || n.Unread() != NOTIFY_MAX {
+		t.Errorf("Wrong notifications: %d", len(n.List))
+	}
+	ndb2.MarkRead(1)
+	if ndb.Get(1).Unread() != 0 {
+		t.Error("Notifications are not read")
+	}
+	if ndb.SetPrefs(1, NotifyPrefs{Webhook: "ftp://x"}) == nil ||
+		ndb.SetPrefs(1, NotifyPrefs{Kinds: []string{"bad"}}) == nil {
+		t.Error("Wrong preferences accepted")
+	}
+	if err := ndb.SetPrefs(1, NotifyPrefs{Kinds: []string{"to"}, Email: true,
+		Webhook: "http://example.com/hook?a=b"}); err != nil {
+		t.Fatal(err)
+	}
+	p := ndb2.Get(1).Prefs
+	if p.Enabled("reply") || !p.Enabled("to") || !p.Email ||
+		p.Webhook != "http://example.com/hook?a=b" {
+		t.Errorf("Wrong preferences: %v", p)
+	}
+	ndb.SetPrefs(1, NotifyPrefs{})
+	if len(ndb2.Get(1).Prefs.Kinds) != 0 {
+		t.Error("All notifications are not disabled")
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	db := OpenDB(dir + "/db")
+	udb := OpenUsers(dir+"/points.txt", "")
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := udb.Add(u, u+"@example.com", u, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := &Notifier{DB: db, UDB: udb, NDB: OpenNotifications(dir + "/notify.txt")}
+	db.Stored = n.Notify
+	store := func(m *Msg) *Msg {
+		m.Tags.Add("ii/ok")
+		m.Encode()
+		if err := db.Store(m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := store(&Msg{Echo: "std.test", From: "alice", Addr: "node,1", To: "bob",
+		Subj: "hi", Text: "Hi @carol and @nobody, @alice"})
+	r := store(&Msg{Tags: NewTags("repto/" + m.MsgId), Echo: "std.test",
+		From: "bob", Addr: "node,2", To: "alice", Subj: "Re: hi", Text: "@alice"})
+	store(&Msg{Echo: ".private", From: "alice", Addr: "node,1", To: "bob",
+		Subj: "private", Text: "@carol"})
+	for _, v := range []struct {
+		id    int32
+		kinds []string
+	}{
+		{1, []string{"reply"}},
+		{2, []string{"to", "to"}},
+		{3, []string{"mention"}},
+	} {
+		list := n.NDB.Get(v.id).List
+		if len(list) != len(v.kinds) {
+			t.Errorf("Wrong notifications of %d: %v", v.id, list)
+			continue
+		}
+		for i, k := range v.kinds {
+			if list[i].Kind != k {
+				t.Errorf("Wrong notifications of %d: %v", v.id, list)
+			}
+		}
+	}
+	if n.NDB.Get(1).List[0].MsgId != r.MsgId {
+		t.Error("Wrong reply notification")
+	}
+
+	/* webhooks are delivered in background, local addresses are denied */
+	called := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called <- true
+	}))
+	defer srv.Close()
+	if err := n.NDB.SetPrefs(3, NotifyPrefs{Kinds: NotifyKinds, Webhook: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Webhook(srv.URL, udb.UserInfoName("carol"), "mention", m); err == nil ||
+		!strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Webhook to local address: %v", err)
+	}
+	store(&Msg{Echo: "std.test", From: "alice", Addr: "node,1", To: "All",
+		Subj: "hook", Text: "@carol"})
+	n.Close()
+	if len(called) != 0 || len(n.NDB.Get(3).List) != 2 {
+		t.Error("Wrong webhook delivery")
+	}
+	for _, v := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254",
+		"::1", "fd00::1", "0.0.0.0"} {
+		if public_ip(net.ParseIP(v)) {
+			t.Errorf("Address is public: %s", v)
+		}
+	}
+	if !public_ip(net.ParseIP("8.8.8.8")) {
+		t.Error("Public address is denied")
+	}
+}
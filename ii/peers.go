@@ -0,0 +1,104 @@
+// Peers of node for scheduled sync.
+// Peers file has lines:
+// <url> <echoes> [key=value...]
+// Echoes are comma separated list or * (all echoes of peer).
+// Keys: interval (minutes between fetches, 60 by default),
+// lim (fetch limit mode, see Fetcher), auth (node auth for u/push,
+// local messages are pushed to peer if it is set).
+// For example:
+// http://hub.example.com std.talk,std.test interval=30 lim=-100 auth=secret
+// https://other.example.com * interval=120
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default interval between syncs with peer.
+const PEER_INTERVAL = 60 * time.Minute
+
+// Peer of node.
+// Echoes: nil means all echoes of peer.
+type Peer struct {
+	URL      string
+	Echoes   []string
+	Limit    int
+	Interval time.Duration
+	Auth     string
+}
+
+// Parse line of peers file.
+func parsePeer(line string) (*Peer, error) {
+	a := strings.Fields(line)
+	if len(a) < 2 {
+		return nil, errors.New("No echoes")
+	}
+	if !strings.HasPrefix(a[0], "http://") && !strings.HasPrefix(a[0], "https://") {
+		return nil, errors.New("Wrong url: " + a[0])
+	}
+	p := &Peer{URL: strings.TrimSuffix(a[0], "/"), Interval: PEER_INTERVAL}
+	if a[1] != "*" {
+		for _, e := range strings.Split(a[1], ",") {
+			if !IsEcho(e) {
+				return nil, errors.New("Wrong echo: " + e)
+			}
+			p.Echoes = append(p.Echoes, e)
+		}
+	}
+	for _, o := range a[2:] {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Wrong option: " + o)
+		}
+		switch kv[0] {
+		case "interval":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n <= 0 {
+				return nil, errors.New("Wrong interval: " + kv[1])
+			}
+			p.Interval = time.Duration(n) * time.Minute
+		case "lim":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, errors.New("Wrong lim: " + kv[1])
+			}
+			p.Limit = n
+		case "auth":
+			p.Auth = kv[1]
+		default:
+			return nil, errors.New("Wrong option: " + o)
+		}
+	}
+	return p, nil
+}
+
+// Load peers file. Wrong entries are skipped,
+// the first of them is returned as error.
+func LoadPeers(path string) ([]*Peer, error) {
+	var perr error
+	var peers []*Peer
+	err := FileLines(path, func(line string) bool {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return true
+		}
+		p, err := parsePeer(line)
+		if err != nil {
+			Error.Printf("Wrong entry in peers: %s", line)
+			if perr == nil {
+				perr = fmt.Errorf("%s: %s: %s", path, line, err)
+			}
+			return true
+		}
+		peers = append(peers, p)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return peers, perr
+}
@@ -0,0 +1,38 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPeers(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	text := "# peers\n" +
+		"http://hub.example.com/ std.talk,std.test interval=30 lim=-100 auth=secret\n" +
+		"https://other.example.com *\n" +
+		"ftp://wrong.example.com *\n" +
+		"http://wrong.example.com * interval=0\n"
+	ioutil.WriteFile(dir+"/peers.txt", []byte(text), 0644)
+	peers, err := LoadPeers(dir + "/peers.txt")
+	if err == nil || len(peers) != 2 {
+		t.Fatalf("Wrong peers: %v %v", peers, err)
+	}
+	p := peers[0]
+	if p.URL != "http://hub.example.com" || len(p.Echoes) != 2 ||
+		p.Interval != 30*time.Minute || p.Limit != -100 || p.Auth != "secret" {
+		t.Errorf("Wrong peer: %v", p)
+	}
+	if p := peers[1]; p.Echoes != nil || p.Interval != PEER_INTERVAL || p.Limit != 0 {
+		t.Errorf("Wrong peer: %v", p)
+	}
+	if peers, err := LoadPeers(dir + "/none.txt"); err != nil || len(peers) != 0 {
+		t.Error("Wrong peers for absent file")
+	}
+}
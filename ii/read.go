@@ -0,0 +1,250 @@
+// Read state of users: echo subscriptions and read positions.
+// State is stored in append only file with lines:
+// <user id>:<echo>:<first unread num>:<subscribed 0/1>[:<read nums>]
+// Read nums is optional comma separated list of messages
+// read out of order (after first unread).
+// Last line for user and echo wins. File is compacted
+// when it has too many old lines.
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Read position of user in echo.
+// Num: messages with index number (MsgInfo.Num) less than Num are read.
+// Sub: echo is subscribed.
+// Seen: index numbers of messages read after Num.
+type ReadPos struct {
+	Num  int
+	Sub  bool
+	Seen []int
+}
+
+// Read state database.
+// Users: positions by user id and echo name.
+// Lines: number of lines in file, used for compaction.
+type RDB struct {
+	FileDB
+	Users map[int32]map[string]ReadPos
+	Lines int
+}
+
+// Open read state database.
+func OpenReadState(path string) *RDB {
+	return &RDB{FileDB: FileDB{Path: path, Name: "read"}}
+}
+
+// Internal function. Load read state if file was changed. Does not lock!
+func (db *RDB) _Load() error {
+	users := make(map[int32]map[string]ReadPos)
+	lines := 0
+	read, err := db._Read(db.Users != nil, func(line string) bool {
+		lines++
+		a := strings.Split(line, ":")
+		if (len(a) != 4 && len(a) != 5) || !IsEcho(a[1]) {
+			Error.Printf("Wrong entry in read state: %s", line)
+			return true
+		}
+		var id int32
+		var p ReadPos
+		if _, err := fmt.Sscanf(a[0]+" "+a[2], "%d %d", &id, &p.Num); err != nil {
+			Error.Printf("Wrong entry in read state: %s", line)
+			return true
+		}
+		p.Sub = a[3] == "1"
+		if len(a) == 5 {
+			for _, v := range strings.Split(a[4], ",") {
+				var n int
+				if _, err := fmt.Sscanf(v, "%d", &n); err == nil && n >= p.Num {
+					p.Seen = append(p.Seen, n)
+				}
+			}
+		}
+		if users[id] == nil {
+			users[id] = make(map[string]ReadPos)
+		}
+		if p.Num == 0 && !p.Sub && len(p.Seen) == 0 {
+			delete(users[id], a[1])
+		} else {
+			users[id][a[1]] = p
+		}
+		return true
+	})
+	if read {
+		db.Users = users
+		db.Lines = lines
+	}
+	return err
+}
+
+// Get read state of user: map of echo names to positions.
+// Reloads state if needed. Returns copy of state.
+func (db *RDB) Get(id int32) map[string]ReadPos {
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	state := make(map[string]ReadPos)
+	if err := db._Load(); err != nil {
+		return state
+	}
+	for k, v := range db.Users[id] {
+		state[k] = v
+	}
+	return state
+}
+
+// Returns sorted list of echoes subscribed by user.
+func (db *RDB) Subscriptions(id int32) []string {
+	var list []string
+	for k, v := range db.Get(id) {
+		if v.Sub {
+			list = append(list, k)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Internal function. Rewrite file with actual state only. Does not lock!
+func (db *RDB) _Compact() error {
+	var text string
+	var ids []int32
+	for id := range db.Users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		var echoes []string
+		for e := range db.Users[id] {
+			echoes = append(echoes, e)
+		}
+		sort.Strings(echoes)
+		for _, e := range echoes {
+			text += db.Users[id][e].line(id, e) + "\n"
+		}
+	}
+	return db._Write(text, db._Load)
+}
+
+// Line of read state file.
+func (p ReadPos) line(id int32, echo string) string {
+	l := fmt.Sprintf("%d:%s:%d:%s", id, echo, p.Num, b2s(p.Sub))
+	if len(p.Seen) > 0 {
+		var nums []string
+		for _, n := range p.Seen {
+			nums = append(nums, fmt.Sprintf("%d", n))
+		}
+		l += ":" + strings.Join(nums, ",")
+	}
+	return l
+}
+
+func b2s(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Change read position of user in echo.
+// Change is appended to file under lock. If there are too many
+// lines in file, file is compacted.
+func (db *RDB) Set(id int32, echo string, fn func(p *ReadPos)) error {
+	if !IsEcho(echo) {
+		return errors.New("Wrong echo name")
+	}
+	db.Sync.Lock()
+	defer db.Sync.Unlock()
+	if !db.Lock() {
+		return errors.New("Can not lock read state")
+	}
+	defer db.Unlock()
+	if err := db._Load(); err != nil {
+		return err
+	}
+	p := db.Users[id][echo]
+	old := p.line(id, echo)
+	p.Seen = append([]int(nil), p.Seen...)
+	fn(&p)
+	var seen []int
+	for _, n := range p.Seen { /* read before Num */
+		if n >= p.Num {
+			seen = append(seen, n)
+		}
+	}
+	p.Seen = seen
+	line := p.line(id, echo)
+	if line == old {
+		return nil
+	}
+	if err := append_file(db.Path, line); err != nil {
+		return err
+	}
+	if db.Users[id] == nil {
+		db.Users[id] = make(map[string]ReadPos)
+	}
+	if p.Num == 0 && !p.Sub && len(p.Seen) == 0 {
+		delete(db.Users[id], echo)
+	} else {
+		db.Users[id][echo] = p
+	}
+	db.Lines++
+	if info, err := os.Stat(db.Path); err == nil { /* our own change */
+		db.FileInfo = info
+	}
+	count := 0
+	for _, v := range db.Users {
+		count += len(v)
+	}
+	if db.Lines > 2*count+1024 {
+		return db._Compact()
+	}
+	return nil
+}
+
+// Subscribe or unsubscribe user to echo.
+func (db *RDB) Subscribe(id int32, echo string, sub bool) error {
+	return db.Set(id, echo, func(p *ReadPos) {
+		p.Sub = sub
+	})
+}
+
+// Mark messages in echo as read up to index number num (including).
+// Position never goes back.
+func (db *RDB) MarkRead(id int32, echo string, num int) error {
+	return db.Set(id, echo, func(p *ReadPos) {
+		if num >= p.Num {
+			p.Num = num + 1
+		}
+	})
+}
+
+// Mark messages in echo with index numbers nums as read
+// out of order. Use MarkRead to move read position.
+func (db *RDB) MarkSeen(id int32, echo string, nums []int) error {
+	return db.Set(id, echo, func(p *ReadPos) {
+		for _, n := range nums {
+			if p.Unread(&MsgInfo{Num: n}) {
+				p.Seen = append(p.Seen, n)
+			}
+		}
+		sort.Ints(p.Seen)
+	})
+}
+
+// Check if message is unread in state of user.
+func (p ReadPos) Unread(info *MsgInfo) bool {
+	if info.Num < p.Num {
+		return false
+	}
+	for _, n := range p.Seen {
+		if n == info.Num {
+			return false
+		}
+	}
+	return true
+}
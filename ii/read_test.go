@@ -0,0 +1,64 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadState(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	rdb := OpenReadState(dir + "/read.txt")
+	if len(rdb.Get(1)) != 0 {
+		t.Error("Empty state is not empty")
+	}
+	if rdb.Subscribe(1, "bad", true) == nil {
+		t.Error("Wrong echo accepted")
+	}
+	if err := rdb.Subscribe(1, "std.test", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.MarkRead(1, "std.test", 10); err != nil {
+		t.Fatal(err)
+	}
+	rdb.MarkRead(1, "std.test", 5) // never goes back
+	rdb.MarkRead(2, "std.other", 0)
+	p := rdb.Get(1)["std.test"]
+	if !p.Sub || p.Num != 11 || p.Unread(&MsgInfo{Num: 10}) ||
+		!p.Unread(&MsgInfo{Num: 11}) {
+		t.Errorf("Wrong read position: %v", p)
+	}
+	if !rdb.Get(3)["std.test"].Unread(&MsgInfo{Num: 0}) {
+		t.Error("First message is not unread")
+	}
+	rdb2 := OpenReadState(rdb.Path) // other process
+	if s := rdb2.Subscriptions(1); len(s) != 1 || s[0] != "std.test" {
+		t.Errorf("Wrong subscriptions: %v", s)
+	}
+	rdb2.Subscribe(1, "std.test", false)
+	if len(rdb.Subscriptions(1)) != 0 || rdb.Get(2)["std.other"].Num != 1 {
+		t.Error("State is not shared")
+	}
+	for i := 0; i < 1100; i++ {
+		rdb.MarkRead(1, "std.test", 100+i)
+	}
+	if rdb.Lines > 1100 || rdb2.Get(1)["std.test"].Num != 1200 {
+		t.Errorf("State is not compacted: %d lines", rdb.Lines)
+	}
+	// out of order reads
+	rdb.MarkSeen(2, "std.other", []int{5, 7, 0})
+	if p := rdb2.Get(2)["std.other"]; p.Unread(&MsgInfo{Num: 5}) ||
+		!p.Unread(&MsgInfo{Num: 6}) || len(p.Seen) != 2 {
+		t.Errorf("Wrong read position: %v", p)
+	}
+	rdb.MarkRead(2, "std.other", 5)
+	if p := rdb2.Get(2)["std.other"]; p.Num != 6 || len(p.Seen) != 1 ||
+		p.Unread(&MsgInfo{Num: 7}) {
+		t.Errorf("Wrong read position: %v", p)
+	}
+}
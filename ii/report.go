@@ -0,0 +1,141 @@
+// Report of fetch from node.
+
+package ii
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Fetch modes of echo.
+// FETCH_SKIP: last message of echo exists or echo is empty, no sync needed;
+// FETCH_UNCHANGED: count of messages (x/c) is the same as on last fetch;
+// FETCH_LIMIT: last messages (limit > 0);
+// FETCH_ADAPTIVE: adaptive probing (limit < 0);
+// FETCH_FALLBACK: full index after failed adaptive probing;
+// FETCH_FULL: full index (limit = 0 or node without u/e slices).
+const (
+	FETCH_SKIP      = "skip"
+	FETCH_UNCHANGED = "unchanged"
+	FETCH_LIMIT     = "limit"
+	FETCH_ADAPTIVE  = "adaptive"
+	FETCH_FALLBACK  = "fallback"
+	FETCH_FULL      = "full"
+)
+
+// Result of fetch of one echo.
+// New: messages stored in db;
+// Skipped: messages rejected or quarantined by Filter;
+// Duplicate: messages which are already in db;
+// Invalid: wrong ids in index and messages which can not be decoded;
+// Failed: messages which are not received or can not be stored;
+// Count: messages in echo on node (x/c), -1 if unknown;
+// Errors: request errors (echo is not fetched completely).
+// Id of last message of echo on node is saved in Node.Counts.
+type EchoReport struct {
+	Echo      string    `json:"echo"`
+	Mode      string    `json:"mode"`
+	New       int       `json:"new"`
+	Skipped   int       `json:"skipped"`
+	Duplicate int       `json:"duplicate"`
+	Invalid   int       `json:"invalid"`
+	Failed    int       `json:"failed"`
+	Count     int       `json:"count"`
+	Start     time.Time `json:"start"`
+	Seconds   float64   `json:"seconds"`
+	Errors    []string  `json:"errors,omitempty"`
+	err       error
+	last      string
+}
+
+// Report of Fetch.
+// Total: sums of counters of all echoes (Mode is "total");
+// Errors: errors of fetch (list of echoes, cancel).
+type FetchReport struct {
+	Host    string        `json:"host"`
+	Start   time.Time     `json:"start"`
+	Seconds float64       `json:"seconds"`
+	Echoes  []*EchoReport `json:"echoes"`
+	Total   EchoReport    `json:"total"`
+	Failed  int           `json:"failed_echoes"`
+	Errors  []string      `json:"errors,omitempty"`
+	err     error
+}
+
+func (r *EchoReport) error(err error) {
+	Error.Printf("%s: %s", r.Echo, err)
+	if r.err == nil {
+		r.err = err
+	}
+	r.Errors = append(r.Errors, err.Error())
+}
+
+func (r *EchoReport) finish() {
+	r.Seconds = time.Since(r.Start).Seconds()
+}
+
+// Summary line of echo report.
+func (r *EchoReport) String() string {
+	s := fmt.Sprintf("%s: %s, %d new, %d skipped, %d duplicate, %d invalid, %d failed (%.2fs)",
+		r.Echo, r.Mode, r.New, r.Skipped, r.Duplicate, r.Invalid, r.Failed, r.Seconds)
+	if len(r.Errors) > 0 {
+		s += ": " + strings.Join(r.Errors, "; ")
+	}
+	return s
+}
+
+func (r *FetchReport) error(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Count totals and time of fetch.
+func (r *FetchReport) finish() {
+	r.Seconds = time.Since(r.Start).Seconds()
+	r.Total = EchoReport{Mode: "total", Start: r.Start, Seconds: r.Seconds}
+	r.Failed = 0
+	for _, e := range r.Echoes {
+		r.Total.New += e.New
+		r.Total.Skipped += e.Skipped
+		r.Total.Duplicate += e.Duplicate
+		r.Total.Invalid += e.Invalid
+		r.Total.Failed += e.Failed
+		if len(e.Errors) > 0 {
+			r.Failed++
+		}
+	}
+}
+
+// Error of fetch: fetch error or errors of echoes (the
+// first of them is wrapped). Nil if fetch is completed.
+func (r *FetchReport) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	for _, e := range r.Echoes {
+		if e.err != nil {
+			return fmt.Errorf("%d of %d echoes failed, %s: %w",
+				r.Failed, len(r.Echoes), e.Echo, e.err)
+		}
+	}
+	return nil
+}
+
+// Summary of fetch: line per echo (only changed or failed
+// echoes if all is false) and total line.
+func (r *FetchReport) Summary(all bool) string {
+	var s []string
+	for _, e := range r.Echoes {
+		if all || e.New+e.Skipped+e.Invalid+e.Failed > 0 || len(e.Errors) > 0 {
+			s = append(s, e.String())
+		}
+	}
+	s = append(s, r.Errors...)
+	s = append(s, fmt.Sprintf("%s: %d echoes (%d failed), %d new, %d skipped, %d duplicate, %d invalid, %d failed (%.2fs)",
+		r.Host, len(r.Echoes), r.Failed, r.Total.New, r.Total.Skipped,
+		r.Total.Duplicate, r.Total.Invalid, r.Total.Failed, r.Seconds))
+	return strings.Join(s, "\n")
+}
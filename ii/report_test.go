@@ -0,0 +1,107 @@
+package ii
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchReport(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	db := OpenDB(dir + "/db")
+	msg := func(subj string) *Msg {
+		m := &Msg{Echo: "std.a", From: "user", Addr: "node,2", To: "All",
+			Subj: subj, Text: "text of " + subj, Date: time.Now().Unix(),
+			Tags: NewTags("ii/ok")}
+		m.Encode()
+		return m
+	}
+	dup, m1, spam, lost := msg("dup"), msg("new"), msg("spam"), msg("lost")
+	if err := db.Store(dup); err != nil {
+		t.Fatal(err)
+	}
+	bundles := map[string]string{m1.MsgId: m1.Encode(), spam.MsgId: spam.Encode()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/x/features", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("u/e\n"))
+	})
+	mux.HandleFunc("/u/e/std.a", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join([]string{"std.a", dup.MsgId, m1.MsgId,
+			spam.MsgId, lost.MsgId, "wrong-id"}, "\n")))
+	})
+	mux.HandleFunc("/u/e/std.a/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("std.a\n" + m1.MsgId + "\n"))
+	})
+	mux.HandleFunc("/u/e/std.b", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/u/m/", func(w http.ResponseWriter, r *http.Request) {
+		for _, id := range strings.Split(r.URL.Path[5:], "/") {
+			if b, ok := bundles[id]; ok {
+				w.Write([]byte(b + "\n"))
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	n, err := Connect(ctx, srv.URL, &Client{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Force = true
+	n.Filter = func(m *Msg) error {
+		if m.Subj == "spam" {
+			return ErrQuarantined
+		}
+		return nil
+	}
+	report, err := n.Fetch(ctx, db, []string{"std.a", "std.b"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "1 messages are not received") {
+		t.Errorf("Wrong error of fetch: %v", err)
+	}
+	if len(report.Echoes) != 2 || report.Failed != 2 {
+		t.Fatalf("Wrong report: %v", report.Summary(true))
+	}
+	r := report.Echoes[0]
+	if r.Mode != FETCH_FULL || r.New != 1 || r.Duplicate != 1 || r.Skipped != 1 ||
+		r.Invalid != 1 || r.Failed != 1 || len(r.Errors) != 1 {
+		t.Errorf("Wrong echo report: %v", r)
+	}
+	var herr *HTTPError
+	if !errors.As(report.Echoes[1].err, &herr) || herr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Wrong error of echo: %v", report.Echoes[1].err)
+	}
+	if report.Total.New != 1 || len(report.Echoes[1].Errors) != 1 {
+		t.Errorf("Wrong total: %v", report.Summary(true))
+	}
+	if db.Lookup(m1.MsgId) == nil || db.Lookup(spam.MsgId) != nil {
+		t.Error("Wrong messages are stored")
+	}
+
+	/* messages in premoderation queue are not fetched again */
+	n.Pending = OpenDB(dir + "/pending")
+	n.Pending.Store(spam)
+	report, _ = n.Fetch(ctx, db, []string{"std.a"}, 0)
+	if r := report.Echoes[0]; r.Skipped != 0 || r.Duplicate != 3 {
+		t.Errorf("Wrong echo report: %v", r)
+	}
+
+	n.Force = false
+	report, err = n.Fetch(ctx, db, []string{"std.a"}, 0)
+	if err != nil || report.Echoes[0].Mode != FETCH_SKIP {
+		t.Errorf("Wrong report: %v %v", report.Summary(true), err)
+	}
+}
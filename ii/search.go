@@ -0,0 +1,125 @@
+// Search query language.
+package ii
+
+import (
+	"errors"
+	"strings"
+)
+
+// Term of search query.
+// Field: "" (subject or text), "subj" or "text".
+// Not: message should not contain Text.
+type SearchTerm struct {
+	Field string
+	Text  string
+	Not   bool
+}
+
+// Split search string in words. Words in quotes are joined.
+func search_words(str string) ([]string, error) {
+	var words []string
+	var word []rune
+	quote := false
+	for _, c := range str {
+		switch {
+		case c == '"':
+			quote = !quote
+		case !quote && (c == ' ' || c == '\t'):
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+		default:
+			word = append(word, c)
+		}
+	}
+	if quote {
+		return nil, errors.New("Unterminated quote")
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// Parse search query and make Query for SelectIDS.
+// Query is the list of terms separated by spaces (logical AND):
+// echo:<echo>, from:<name>, to:<name> - match message headers;
+// topics - only topic starters;
+// subj:<word>, text:<word> - word in subject or text;
+// <word> - word in subject or text;
+// "some words" - phrase, can be used with prefixes;
+// -<term> - message should not contain word.
+// Words are case insensitive. Words are matched by Query.Filter.
+func (db *DB) ParseSearch(str string) (*Query, error) {
+	words, err := search_words(str)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, errors.New("Empty search query")
+	}
+	q := &Query{}
+	var terms []SearchTerm
+	for _, w := range words {
+		var t SearchTerm
+		if strings.HasPrefix(w, "-") && len(w) > 1 {
+			t.Not = true
+			w = w[1:]
+		}
+		if w == "topics" && !t.Not {
+			q.Repto = "!"
+			continue
+		}
+		if a := strings.SplitN(w, ":", 2); len(a) == 2 && !t.Not {
+			switch a[0] {
+			case "echo":
+				if !IsEcho(a[1]) {
+					return nil, errors.New("Wrong echo name: " + a[1])
+				}
+				q.Echo = a[1]
+				continue
+			case "from":
+				q.From = a[1]
+				continue
+			case "to":
+				q.To = a[1]
+				continue
+			}
+		}
+		if a := strings.SplitN(w, ":", 2); len(a) == 2 &&
+			(a[0] == "subj" || a[0] == "text") {
+			t.Field = a[0]
+			w = a[1]
+		}
+		if w == "" {
+			return nil, errors.New("Empty search term")
+		}
+		t.Text = strings.ToLower(w)
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 {
+		return q, nil
+	}
+	q.Filter = func(m *Msg) bool {
+		subj := strings.ToLower(m.Subj)
+		text := strings.ToLower(m.Text)
+		for _, t := range terms {
+			found := false
+			switch t.Field {
+			case "subj":
+				found = strings.Contains(subj, t.Text)
+			case "text":
+				found = strings.Contains(text, t.Text)
+			default:
+				found = strings.Contains(subj, t.Text) ||
+					strings.Contains(text, t.Text)
+			}
+			if found == t.Not {
+				return false
+			}
+		}
+		return true
+	}
+	return q, nil
+}
@@ -0,0 +1,66 @@
+package ii
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	db := OpenDB(dir + "/db")
+	for _, v := range [][4]string{
+		{"std.test", "alice", "Hello world", "First message"},
+		{"std.test", "bob", "Re: Hello world", "Some reply text"},
+		{"std.other", "alice", "Other", "hello again"},
+	} {
+		m := &Msg{Tags: NewTags("ii/ok"), Echo: v[0], From: v[1], Addr: "test,1",
+			To: "All", Subj: v[2], Text: v[3]}
+		if v[2] == "Re: Hello world" {
+			m.Tags.Add("repto/" + db.SelectIDS(&Query{Echo: "std.test"})[0])
+		}
+		m.Encode()
+		if err := db.Store(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []struct {
+		query string
+		count int
+	}{
+		{"hello", 3},
+		{"HELLO echo:std.test", 2},
+		{"hello topics", 2},
+		{"from:alice", 2},
+		{"subj:hello", 2},
+		{"text:hello", 1},
+		{"hello -reply", 2},
+		{"\"reply text\"", 1},
+		{"\"text reply\"", 0},
+		{"to:All from:bob", 1},
+	} {
+		q, err := db.ParseSearch(v.query)
+		if err != nil {
+			t.Errorf("%s: %s", v.query, err)
+			continue
+		}
+		if ids := db.SelectIDS(q); len(ids) != v.count {
+			t.Errorf("%s: %d found, %d expected", v.query, len(ids), v.count)
+		}
+	}
+	q, _ := db.ParseSearch("hello")
+	q.Start, q.Lim = -2, 1
+	if ids := db.SelectIDS(q); len(ids) != 1 || ids[0] != db.SelectIDS(&Query{Start: -2, Lim: 1})[0] {
+		t.Errorf("Wrong slice of search: %v", ids)
+	}
+	for _, v := range []string{"", " ", "echo:bad", "\"unterminated", "subj:"} {
+		if _, err := db.ParseSearch(v); err == nil {
+			t.Errorf("Wrong query accepted: %q", v)
+		}
+	}
+}
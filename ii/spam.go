@@ -0,0 +1,237 @@
+// Naive Bayes spam filter.
+// Filter is trained from blacklisted messages (spam) and normal
+// messages (ham). Model file has lines:
+// !<spam messages>:<ham messages>
+// <token>:<spam messages with token>:<ham messages with token>
+package ii
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Messages with score not less than threshold are spam.
+const SPAM_THRESHOLD = 0.9
+
+// Max number of tokens used for score (most significant).
+const SPAM_TOKENS = 32
+
+// Returned by filters when message is put in quarantine.
+var ErrQuarantined = errors.New("Message is quarantined")
+
+// Spam filter.
+// Spam, Ham: number of messages in training set.
+// Tokens: number of spam and ham messages with token.
+type SpamFilter struct {
+	Path      string
+	Threshold float64
+	Spam      int
+	Ham       int
+	Tokens    map[string][2]int
+	FileInfo  os.FileInfo
+	Sync      sync.RWMutex
+}
+
+// Open spam filter model. Model is loaded on first use.
+func OpenSpamFilter(path string) *SpamFilter {
+	return &SpamFilter{Path: path, Threshold: SPAM_THRESHOLD}
+}
+
+// Tokens of message: words of subject and body (without attachment)
+// and address of author. Every token is returned once.
+func SpamTokens(m *Msg) []string {
+	body, _, _ := msg_sizes(m.Text)
+	words := strings.FieldsFunc(strings.ToLower(m.Subj+"\n"+m.Text[:body]),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	if m.Addr != "" && !strings.ContainsAny(m.Addr, ":\r\n") {
+		words = append(words, "@"+m.Addr)
+	}
+	var list []string
+	seen := make(map[string]bool)
+	for _, w := range words {
+		if l := len([]rune(w)); l < 2 || l > 32 || seen[w] {
+			continue
+		}
+		seen[w] = true
+		list = append(list, w)
+	}
+	return list
+}
+
+func (f *SpamFilter) LockPath() string {
+	pat := strings.Replace(f.Path, "/", "_", -1)
+	return fmt.Sprintf("%s/%s-spam.lock", os.TempDir(), pat)
+}
+
+// Load model if file is changed.
+func (f *SpamFilter) Load() error {
+	f.Sync.Lock()
+	defer f.Sync.Unlock()
+	changed, info, err := file_changed(f.Path, f.FileInfo)
+	if err != nil || !changed {
+		return err
+	}
+	spam, ham := 0, 0
+	tokens := make(map[string][2]int)
+	err = FileLines(f.Path, func(line string) bool {
+		if strings.HasPrefix(line, "!") {
+			fmt.Sscanf(line, "!%d:%d", &spam, &ham)
+			return true
+		}
+		a := strings.Split(line, ":")
+		var c [2]int
+		if len(a) != 3 {
+			Error.Printf("Wrong entry in spam model: %s", line)
+			return true
+		}
+		if _, err := fmt.Sscanf(a[1]+" "+a[2], "%d %d", &c[0], &c[1]); err != nil {
+			Error.Printf("Wrong entry in spam model: %s", line)
+			return true
+		}
+		tokens[a[0]] = c
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	f.Spam, f.Ham, f.Tokens, f.FileInfo = spam, ham, tokens, info
+	return nil
+}
+
+// Train filter from scratch and save model.
+// Spam: blacklisted messages of db (except tombstones) and rejected
+// messages of moderation queue pdb (can be nil). Ham: other messages of db.
+func (f *SpamFilter) Train(db *DB, pdb *DB) error {
+	spam, ham := 0, 0
+	tokens := make(map[string][2]int)
+	learn := func(m *Msg, kind int) {
+		if kind == 0 {
+			spam++
+		} else {
+			ham++
+		}
+		for _, t := range SpamTokens(m) {
+			c := tokens[t]
+			c[kind]++
+			tokens[t] = c
+		}
+	}
+	for _, id := range db.SelectIDS(&Query{NoAccess: true}) {
+		kind := 1
+		if db.Lookup(id) == nil { /* blacklisted */
+			kind = 0
+		}
+		if m, err := DecodeBundle(db.GetBundleAll(id)); err == nil && !IsTombstone(m) {
+			learn(m, kind)
+		}
+	}
+	if pdb != nil {
+		for _, id := range pdb.SelectIDS(&Query{Blacklisted: true}) {
+			m, err := DecodeBundle(pdb.GetBundleAll(id))
+			if err != nil {
+				continue
+			}
+			if v, _ := m.Tag("moderation"); v == "rejected" {
+				learn(m, 0)
+			}
+		}
+	}
+	var list []string
+	for t, c := range tokens {
+		if c[0]+c[1] > 1 { /* skip rare tokens */
+			list = append(list, t)
+		}
+	}
+	sort.Strings(list)
+	var b strings.Builder
+	fmt.Fprintf(&b, "!%d:%d\n", spam, ham)
+	for _, t := range list {
+		fmt.Fprintf(&b, "%s:%d:%d\n", t, tokens[t][0], tokens[t][1])
+	}
+	var depth int32
+	if !lock_path(f.LockPath(), &depth) {
+		return errors.New("Can not lock spam model")
+	}
+	defer unlock_path(f.LockPath(), &depth)
+	if err := replace_file(f.Path, b.String()); err != nil {
+		return err
+	}
+	Info.Printf("Spam filter is trained: %d spam, %d ham, %d tokens",
+		spam, ham, len(list))
+	return f.Load()
+}
+
+// Probability (0..1) that message is spam.
+// Returns 0 if filter is not trained.
+func (f *SpamFilter) Score(m *Msg) float64 {
+	if err := f.Load(); err != nil {
+		Error.Printf("Can not load spam model: %s", err)
+	}
+	f.Sync.RLock()
+	defer f.Sync.RUnlock()
+	if f.Spam == 0 || f.Ham == 0 {
+		return 0
+	}
+	var logs []float64 /* log(P(t|spam)/P(t|ham)) */
+	for _, t := range SpamTokens(m) {
+		c, ok := f.Tokens[t]
+		if !ok {
+			continue
+		}
+		ps := (float64(c[0]) + 1) / (float64(f.Spam) + 2)
+		ph := (float64(c[1]) + 1) / (float64(f.Ham) + 2)
+		logs = append(logs, math.Log(ps/ph))
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return math.Abs(logs[i]) > math.Abs(logs[j])
+	})
+	if len(logs) > SPAM_TOKENS {
+		logs = logs[:SPAM_TOKENS]
+	}
+	sum := math.Log(float64(f.Spam) / float64(f.Ham))
+	for _, v := range logs {
+		sum += v
+	}
+	return 1 / (1 + math.Exp(-sum))
+}
+
+// Check if message is spam.
+func (f *SpamFilter) IsSpam(m *Msg) bool {
+	return f.Score(m) >= f.Threshold
+}
+
+// Put message in quarantine database (moderation queue)
+// with tags (reason of quarantine). Messages which are
+// already queued or moderated (rejected) are not changed.
+func Quarantine(pdb *DB, m *Msg, tags string) error {
+	if pdb.Exists(m.MsgId) != nil {
+		return nil
+	}
+	m.Tags.Add(tags)
+	return pdb.Store(m)
+}
+
+// Filter for DB.Filter: spam is put in quarantine database pdb
+// instead of db (ErrQuarantined is returned).
+func (f *SpamFilter) Filter(pdb *DB) func(m *Msg) error {
+	return func(m *Msg) error {
+		score := f.Score(m)
+		if score < f.Threshold {
+			return nil
+		}
+		Info.Printf("Spam %s (%d%%) from %s is quarantined", m.MsgId,
+			int(score*100), m.Addr)
+		if err := Quarantine(pdb, m, fmt.Sprintf("spam/%d", int(score*100))); err != nil {
+			return err
+		}
+		return ErrQuarantined
+	}
+}
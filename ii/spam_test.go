@@ -0,0 +1,96 @@
+package ii
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSpamFilter(t *testing.T) {
+	InitLog()
+	dir, err := ioutil.TempDir(os.TempDir(), "ii.test.*")
+	if err != nil {
+		t.Fatal("Can not create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	db := OpenDB(dir + "/db")
+	pdb := OpenDB(dir + "/pending")
+	now := time.Now().Unix()
+	msg := func(i int, addr string, text string) *Msg {
+		m := &Msg{Echo: "std.test", From: "user", Addr: addr, To: "All",
+			Subj: fmt.Sprintf("subj %d", i), Text: text,
+			Date: now + int64(i), Tags: NewTags("ii/ok")}
+		m.Encode()
+		return m
+	}
+	for i := 0; i < 10; i++ {
+		m := msg(i, "node,2", "hello friends, let us talk about golang")
+		if err := db.Store(m); err != nil {
+			t.Fatal(err)
+		}
+		s := msg(100+i, "spam,1", "buy cheap pills now, best casino offer")
+		if err := db.Store(s); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			db.Blacklist(s)
+		} else { /* rejected in queue */
+			pdb.Store(s)
+			s.Tags.Add("moderation/rejected")
+			pdb.Blacklist(s)
+		}
+	}
+	f := OpenSpamFilter(dir + "/spam.txt")
+	if f.Score(msg(200, "node,2", "cheap pills")) != 0 {
+		t.Error("Untrained filter scores messages")
+	}
+	if err := f.Train(db, pdb); err != nil {
+		t.Fatal(err)
+	}
+	if f.Spam != 10 || f.Ham != 15 {
+		t.Errorf("Wrong training set: %d spam, %d ham", f.Spam, f.Ham)
+	}
+	if !f.IsSpam(msg(201, "node,3", "best cheap pills in casino")) {
+		t.Error("Spam is not detected")
+	}
+	if f.IsSpam(msg(202, "node,3", "let us talk about golang, friends")) {
+		t.Error("Ham is detected as spam")
+	}
+
+	f2 := OpenSpamFilter(dir + "/spam.txt")
+	if s := f2.Score(msg(201, "node,3", "best cheap pills in casino")); s < f.Threshold {
+		t.Errorf("Model is not loaded: %f", s)
+	}
+
+	db.Filter = f.Filter(pdb)
+	spam := msg(203, "spam,1", "cheap pills offer")
+	if err := db.Store(spam); err != ErrQuarantined {
+		t.Errorf("Spam is not quarantined: %v", err)
+	}
+	if db.Exists(spam.MsgId) != nil || pdb.Lookup(spam.MsgId) == nil {
+		t.Error("Spam is not in quarantine")
+	}
+	if m := pdb.Get(spam.MsgId); m == nil {
+		t.Error("Can not get quarantined message")
+	} else if v, _ := m.Tag("spam"); v == "" {
+		t.Error("No spam score tag")
+	}
+	edited := pdb.Get(spam.MsgId)
+	edited.Subj = "edited by moderator"
+	if err := pdb.Edit(edited); err != nil {
+		t.Fatal(err)
+	}
+	size := pdb.Lookup(spam.MsgId).Off
+	if err := db.Store(msg(203, "spam,1", "cheap pills offer")); err != ErrQuarantined {
+		t.Errorf("Spam is not quarantined: %v", err)
+	}
+	if m := pdb.Get(spam.MsgId); m == nil || m.Subj != "edited by moderator" ||
+		pdb.Lookup(spam.MsgId).Off != size {
+		t.Error("Quarantined message is changed")
+	}
+	if err := db.Store(msg(204, "node,2", "golang talk")); err != nil {
+		t.Errorf("Ham is not stored: %s", err)
+	}
+}